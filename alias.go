@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Alias map a friendly path to an upstream url, eg /tools/kubectl -> a release asset
+type Alias struct {
+	Path    string `json:"path"`
+	URL     string `json:"url"`
+	Updated int64  `json:"updated"`
+}
+
+// Aliases is stored in <CacheDir>/aliases.json
+type Aliases struct {
+	filename string
+	mu       sync.Mutex
+	aliases  map[string]Alias
+}
+
+func NewAliases(filename string) *Aliases {
+	a := &Aliases{filename: filename, aliases: make(map[string]Alias)}
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		var list []Alias
+		json.Unmarshal(data, &list)
+		for _, alias := range list {
+			a.aliases[alias.Path] = alias
+		}
+	}
+	return a
+}
+
+// List return aliases sorted by path
+func (a *Aliases) List() []Alias {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.listLocked()
+}
+
+func (a *Aliases) listLocked() []Alias {
+	list := make([]Alias, 0, len(a.aliases))
+	for _, alias := range a.aliases {
+		list = append(list, alias)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+func (a *Aliases) save() error {
+	data, _ := json.MarshalIndent(a.listLocked(), "", "  ")
+	return ioutil.WriteFile(a.filename, data, 0644)
+}
+
+// Set create or update alias
+func (a *Aliases) Set(path, url string) (Alias, error) {
+	alias := Alias{Path: path, URL: url, Updated: time.Now().Unix()}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.aliases[path] = alias
+	return alias, a.save()
+}
+
+// Remove return false if path not exists
+func (a *Aliases) Remove(path string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.aliases[path]; !ok {
+		return false, nil
+	}
+	delete(a.aliases, path)
+	return true, a.save()
+}
+
+func (a *Aliases) Lookup(path string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alias, ok := a.aliases[path]
+	return alias.URL, ok
+}
+
+// resolveAlias return rule and mirror path of alias target
+func (d *DownloadCache) resolveAlias(target string) (*MirrorRule, string, error) {
+	rule := d.ruleOfURL(target)
+	if rule == nil {
+		return nil, "", errors.Errorf("%s is not mirrored by any rule", target)
+	}
+	return rule, strings.TrimPrefix(target, strings.TrimSuffix(rule.URLPrefix, "/")), nil
+}
+
+// handleAPIAliases GET list aliases, PUT/POST create or update alias, DELETE remove alias
+// query: path=/tools/kubectl, url=<upstream-url>
+func (d *DownloadCache) handleAPIAliases(w http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	switch r.Method {
+	case "GET":
+		writeJSON(w, d.aliases.List())
+	case "POST", "PUT":
+		target := r.FormValue("url")
+		if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "/_") || target == "" {
+			http.Error(w, "path (eg /tools/kubectl, not starting with /_) and url are required", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(target, "?") {
+			http.Error(w, "url with query is not supported", http.StatusBadRequest)
+			return
+		}
+		if _, _, err := d.resolveAlias(target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		alias, err := d.aliases.Set(path, target)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, alias)
+	case "DELETE":
+		ok, err := d.aliases.Remove(path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "alias not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, d.aliases.List())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
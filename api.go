@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleAPICache list cached entries
+// query: sort=hits|size|time|access, limit=N
+func (d *DownloadCache) handleAPICache(w http.ResponseWriter, r *http.Request) {
+	entries, err := d.Entries()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	entries = filterEntriesByTag(entries, r.FormValue("tag"))
+	if !d.isAdmin(r) {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !d.privateURL(e.URL) {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+	sortEntries(entries, r.FormValue("sort"))
+	if limit, err := strconv.Atoi(r.FormValue("limit")); err == nil && limit >= 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	writeJSON(w, entries)
+}
+
+// handleAPICacheUpload save request body as cache of url
+// query: url=<upstream-url>, filename=<name>, sha256=<checksum> (or header X-Checksum-Sha256)
+// header X-Mirror-Meta: meta.json of entry, sent by replication
+func (d *DownloadCache) handleAPICacheUpload(w http.ResponseWriter, r *http.Request) {
+	// do not use FormValue, which would consume the body of form encoded requests
+	query := r.URL.Query()
+	url := query.Get("url")
+	if url == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	filename := query.Get("filename")
+	if filename == "" {
+		filename = path.Base(strings.SplitN(url, "?", 2)[0])
+	}
+	checksum := query.Get("sha256")
+	if checksum == "" {
+		checksum = r.Header.Get("X-Checksum-Sha256")
+	}
+
+	m := &Meta{}
+	if v := r.Header.Get("X-Mirror-Meta"); v != "" {
+		if err := json.Unmarshal([]byte(v), m); err != nil {
+			http.Error(w, "invalid X-Mirror-Meta: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Hits = 0
+	}
+	m.URL, m.Filename = url, filename
+	m.replica = r.Header.Get("X-Mirror-Replica") != ""
+
+	hash := d.entryHash(url)
+	if !d.lockWorker(hash) {
+		http.Error(w, "url is downloading", http.StatusConflict)
+		return
+	}
+	meta, err := d.storeMeta(m, r.Body, nil, checksum)
+	d.unlockWorker(hash, err)
+
+	if errors.Cause(err) == ErrChecksumMismatch {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Println("upload", url, meta.Size)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, meta)
+}
+
+// handleAPICacheFile serve cached file of url without downloading or counting hits
+func (d *DownloadCache) handleAPICacheFile(w http.ResponseWriter, r *http.Request) {
+	url := r.FormValue("url")
+	dir := d.downloadDir(url)
+	meta, err := readMeta(dir)
+	if err != nil || d.privateURL(url) {
+		http.Error(w, "404 Not Found", 404)
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, "cached.file"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	// meta for p2p peers, like replication
+	info := *meta
+	info.Hits = 0
+	data, _ := json.Marshal(info)
+	w.Header().Set("X-Mirror-Meta", string(data))
+	w.Header().Set("X-Checksum-Sha256", meta.SHA256)
+	if meta.SHA256 != "" {
+		w.Header().Set("ETag", `"`+meta.SHA256+`"`)
+	}
+	http.ServeContent(w, r, meta.Filename, time.Unix(meta.Time, 0), f)
+}
+
+// handleAPICachePurge remove cached file of url
+func (d *DownloadCache) handleAPICachePurge(w http.ResponseWriter, r *http.Request) {
+	url := r.FormValue("url")
+	if err := d.Purge(url); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "404 Not Found", 404)
+		} else {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAPIPrefetch download url into cache and wait until finished
+// with async=1 return the queued download job immediately, see /_api/jobs
+func (d *DownloadCache) handleAPIPrefetch(w http.ResponseWriter, r *http.Request) {
+	url := r.FormValue("url")
+	if url == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	if async, _ := strconv.ParseBool(r.FormValue("async")); async {
+		if d.jobs == nil {
+			http.Error(w, "job queue not opened", http.StatusServiceUnavailable)
+			return
+		}
+		job, err := d.jobs.Enqueue(JobDownload, url)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]interface{}{"url": url, "job": job.ID})
+		return
+	}
+	cacheStatus, err := d.DownloadAndWait(url, path.Base(strings.SplitN(url, "?", 2)[0]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]string{"url": url, "cache": cacheStatus})
+}
+
+// handleAPIClean remove files not accessed for keep duration
+// query: keep=30d, dry_run=1 to report without deleting
+func (d *DownloadCache) handleAPIClean(w http.ResponseWriter, r *http.Request) {
+	keep, err := parseDuration(r.FormValue("keep"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	writeJSON(w, d.Clean(keep, dryRun))
+}
+
+func (d *DownloadCache) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	st, err := d.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	st.HitRate = hitRate()
+	writeJSON(w, st)
+}
+
+// ruleMatch is the result of /_api/match
+type ruleMatch struct {
+	Path        string   `json:"path"`
+	Host        string   `json:"host"`
+	Alias       string   `json:"alias,omitempty"` // alias target if path is an alias
+	Rule        int      `json:"rule"`            // index in rules, -1 if no rule matches
+	Pattern     string   `json:"pattern,omitempty"`
+	RuleHost    string   `json:"rule_host,omitempty"`
+	Upstreams   []string `json:"upstreams,omitempty"`
+	URL         string   `json:"url,omitempty"`       // mirrored upstream url, Hash is of its cache key
+	FetchURL    string   `json:"fetch_url,omitempty"` // url downloaded from, the fastest upstream
+	Hash        string   `json:"hash,omitempty"`
+	Dir         string   `json:"dir,omitempty"`
+	ClusterNode string   `json:"cluster_node,omitempty"`
+	Cached      bool     `json:"cached"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// handleAPIMatch report how a request path is mirrored, for debugging rules
+// query: path=/owner/repo/releases/download/v1/asset, host=<request host, default host of this request>
+func (d *DownloadCache) handleAPIMatch(w http.ResponseWriter, r *http.Request) {
+	p := r.FormValue("path")
+	if !strings.HasPrefix(p, "/") {
+		http.Error(w, "path is required, eg /owner/repo/releases/download/v1/asset", http.StatusBadRequest)
+		return
+	}
+	host := r.FormValue("host")
+	if host == "" {
+		host = r.Host
+	}
+	result := ruleMatch{Path: p, Host: host, Rule: -1}
+	// one snapshot of rules, settings may replace them meanwhile
+	rules := d.rules()
+	if target, ok := d.aliases.Lookup(strings.SplitN(p, "?", 2)[0]); ok {
+		result.Alias = target
+		if result.Rule = ruleIndexOfURL(rules, target); result.Rule < 0 {
+			http.Error(w, "alias "+result.Path+": "+target+" is not mirrored by any rule", http.StatusBadGateway)
+			return
+		}
+		p = strings.TrimPrefix(target, strings.TrimSuffix(rules[result.Rule].URLPrefix, "/"))
+	} else {
+		result.Rule = matchRuleIndex(rules, host, strings.SplitN(p, "?", 2)[0])
+	}
+	if result.Rule < 0 {
+		writeJSON(w, result)
+		return
+	}
+	rule := &rules[result.Rule]
+	result.Pattern = rule.Pattern.String()
+	result.RuleHost = rule.Host
+	result.Upstreams = rule.Upstreams
+	result.URL = strings.TrimSuffix(rule.URLPrefix, "/") + p
+	result.FetchURL = d.fetchURL(result.URL)
+	result.Hash = d.entryHash(result.URL)
+	result.Dir = d.downloadDir(result.URL)
+	if d.cluster != nil {
+		result.ClusterNode = d.cluster.Owner(strings.TrimSuffix(rule.URLPrefix, "/") + strings.SplitN(p, "?", 2)[0])
+	}
+	if m, err := readMeta(result.Dir); err == nil {
+		result.Cached, result.Meta = true, m
+		if d.privateURL(result.URL) && !d.isAdmin(r) {
+			result.Meta = nil // headers and tags of forward_auth entries are hidden like in cache apis
+		}
+	}
+	writeJSON(w, result)
+}
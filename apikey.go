@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// APIKey identify a client (eg a team), quotas are reset every day (UTC), 0 means unlimited
+type APIKey struct {
+	Name          string `json:"name"`
+	Key           string `json:"key"`
+	DailyBytes    int64  `json:"daily_bytes"`
+	DailyRequests int64  `json:"daily_requests"`
+	Role          string `json:"role,omitempty"` // RoleViewer or RoleAdmin, empty to only download
+	Created       int64  `json:"created"`
+}
+
+type keyUsage struct {
+	Day      string `json:"day"`
+	Bytes    int64  `json:"bytes"`
+	Requests int64  `json:"requests"`
+}
+
+// APIKeys is stored in <CacheDir>/apikeys.json, usage is kept in memory
+type APIKeys struct {
+	filename string
+	Required bool // reject mirror requests without a valid key
+
+	mu    sync.Mutex
+	keys  []APIKey
+	usage map[string]*keyUsage // name -> usage of today
+}
+
+func NewAPIKeys(filename string) *APIKeys {
+	k := &APIKeys{filename: filename, usage: make(map[string]*keyUsage)}
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		json.Unmarshal(data, &k.keys)
+	}
+	return k
+}
+
+func (k *APIKeys) save() error {
+	data, _ := json.MarshalIndent(k.keys, "", "  ")
+	return ioutil.WriteFile(k.filename, data, 0600)
+}
+
+// Create add a key with random secret, existing key of the same name is replaced
+func (k *APIKeys) Create(name, role string, dailyBytes, dailyRequests int64) (APIKey, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, err
+	}
+	key := APIKey{
+		Name:          name,
+		Key:           "ghm_" + hex.EncodeToString(secret),
+		DailyBytes:    dailyBytes,
+		DailyRequests: dailyRequests,
+		Role:          role,
+		Created:       time.Now().Unix(),
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.removeLocked(name)
+	k.keys = append(k.keys, key)
+	return key, k.save()
+}
+
+// Revoke return false if name not exists
+func (k *APIKeys) Revoke(name string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.removeLocked(name) {
+		return false, nil
+	}
+	delete(k.usage, name)
+	return true, k.save()
+}
+
+func (k *APIKeys) removeLocked(name string) bool {
+	for i, key := range k.keys {
+		if key.Name == name {
+			k.keys = append(k.keys[:i:i], k.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup find key by secret
+func (k *APIKeys) Lookup(secret string) (APIKey, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(secret)) == 1 {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// usageLocked return usage of today, reset on a new day
+func (k *APIKeys) usageLocked(name string) *keyUsage {
+	day := time.Now().UTC().Format("2006-01-02")
+	u := k.usage[name]
+	if u == nil || u.Day != day {
+		u = &keyUsage{Day: day}
+		k.usage[name] = u
+	}
+	return u
+}
+
+// Allow count a request of key, return false if daily quota exceeded
+func (k *APIKeys) Allow(key APIKey) (keyUsage, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	u := k.usageLocked(key.Name)
+	if (key.DailyRequests > 0 && u.Requests >= key.DailyRequests) || (key.DailyBytes > 0 && u.Bytes >= key.DailyBytes) {
+		return *u, false
+	}
+	u.Requests++
+	return *u, true
+}
+
+func (k *APIKeys) AddBytes(name string, n int64) {
+	k.mu.Lock()
+	k.usageLocked(name).Bytes += n
+	k.mu.Unlock()
+}
+
+// apiKeyOf return secret sent with header X-API-Key, as bearer token or basic auth password
+func apiKeyOf(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return requestToken(r)
+}
+
+// writeQuotaHeaders tell client its quota and usage of today
+func writeQuotaHeaders(w http.ResponseWriter, key APIKey, u keyUsage) {
+	reset := quotaReset()
+	if key.DailyRequests > 0 {
+		w.Header().Set("X-Quota-Requests-Limit", strconv.FormatInt(key.DailyRequests, 10))
+		w.Header().Set("X-Quota-Requests-Remaining", strconv.FormatInt(max64(key.DailyRequests-u.Requests, 0), 10))
+	}
+	if key.DailyBytes > 0 {
+		w.Header().Set("X-Quota-Bytes-Limit", strconv.FormatInt(key.DailyBytes, 10))
+		w.Header().Set("X-Quota-Bytes-Remaining", strconv.FormatInt(max64(key.DailyBytes-u.Bytes, 0), 10))
+	}
+	if key.DailyRequests > 0 || key.DailyBytes > 0 {
+		w.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+	}
+}
+
+// quotaReset return next midnight (UTC)
+func quotaReset() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// countingWriter count bytes of response body, and remember status code
+type countingWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// checkAPIKey enforce api key and its quota on mirror requests
+// return the key (empty name for anonymous or admin) and false if request was rejected
+func (d *DownloadCache) checkAPIKey(w http.ResponseWriter, r *http.Request) (APIKey, bool) {
+	secret := apiKeyOf(r)
+	key, ok := d.apiKeys.Lookup(secret)
+	if !ok {
+		if d.apiKeys.Required && !d.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="github-mirror"`)
+			http.Error(w, "401 Unauthorized, api key required", http.StatusUnauthorized)
+			return APIKey{}, false
+		}
+		return APIKey{}, true
+	}
+	u, ok := d.apiKeys.Allow(key)
+	writeQuotaHeaders(w, key, u)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(quotaReset()).Seconds())+1))
+		http.Error(w, "429 Too Many Requests, daily quota of api key "+key.Name+" exceeded", http.StatusTooManyRequests)
+		return key, false
+	}
+	return key, true
+}
+
+type apiKeyStatus struct {
+	APIKey
+	Usage keyUsage `json:"usage"`
+}
+
+// handleAPIKeys GET list keys with usage of today, POST create key, DELETE revoke key
+// query: name=<team>, daily_bytes=10GB, daily_requests=1000, role=viewer|admin
+func (d *DownloadCache) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	switch r.Method {
+	case "GET":
+		k := d.apiKeys
+		k.mu.Lock()
+		list := make([]apiKeyStatus, 0, len(k.keys))
+		for _, key := range k.keys {
+			if len(key.Key) > 8 {
+				key.Key = key.Key[:8] + "..."
+			}
+			list = append(list, apiKeyStatus{APIKey: key, Usage: *k.usageLocked(key.Name)})
+		}
+		k.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		writeJSON(w, list)
+	case "POST", "PUT":
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		var dailyBytes, dailyRequests int64
+		var err error
+		if v := r.FormValue("daily_bytes"); v != "" {
+			if dailyBytes, err = parseSize(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.FormValue("daily_requests"); v != "" {
+			if dailyRequests, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, "invalid daily_requests", http.StatusBadRequest)
+				return
+			}
+		}
+		role := r.FormValue("role")
+		if !isRole(role) {
+			http.Error(w, "role must be viewer or admin", http.StatusBadRequest)
+			return
+		}
+		key, err := d.apiKeys.Create(name, role, dailyBytes, dailyRequests)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, key)
+	case "DELETE":
+		ok, err := d.apiKeys.Revoke(name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
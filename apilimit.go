@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRateLimited is returned instead of calling github api when its rate limit is (nearly) used up
+var ErrRateLimited = errors.New("github api rate limit reached")
+
+type rateBucket struct {
+	remaining int
+	reset     time.Time
+}
+
+// apiRateLimiter is a token bucket per github api resource (core, graphql) and token, refilled by
+// X-RateLimit-Remaining and X-RateLimit-Reset of responses, so the mirror ip is never banned
+// calls are counted locally between responses, so concurrent calls do not overshoot
+type apiRateLimiter struct {
+	Reserve int           // keep this many calls unused, eg for git clients sharing the token
+	MaxWait time.Duration // queue calls if bucket is refilled within MaxWait, otherwise fail
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+var githubRateLimiter = &apiRateLimiter{Reserve: 10, MaxWait: 10 * time.Second}
+
+// Wait take a token of resource, wait for reset if it is soon, else return ErrRateLimited
+func (l *apiRateLimiter) Wait(ctx context.Context, resource string) error {
+	for {
+		l.mu.Lock()
+		b := l.buckets[resource]
+		if b == nil || b.remaining > l.Reserve || time.Now().After(b.reset) {
+			if b != nil {
+				b.remaining--
+			}
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Until(b.reset)
+		l.mu.Unlock()
+		if wait > l.MaxWait {
+			return errors.Wrapf(ErrRateLimited, "%s resets in %s", resource, wait.Round(time.Second))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Update refill bucket by rate limit headers of response, 403/429 with Retry-After empty it
+func (l *apiRateLimiter) Update(resource string, res *http.Response) {
+	b := &rateBucket{remaining: -1}
+	if v, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining")); err == nil {
+		b.remaining = v
+	}
+	if v, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		b.reset = time.Unix(v, 0)
+	}
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests {
+		if v, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			b.remaining, b.reset = 0, time.Now().Add(time.Duration(v)*time.Second)
+		}
+	}
+	if b.remaining < 0 || b.reset.IsZero() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBucket)
+	}
+	l.buckets[resource] = b
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// parseDuration is time.ParseDuration with extra unit d (day), eg: 30d
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid duration %s", strconv.Quote(s))
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Export write entries cached after since into tar archive
+// every entry is stored as <dir>/meta.json followed by <dir>/cached.file
+func (d *DownloadCache) Export(w io.Writer, since time.Time) (count int, err error) {
+	entries, err := d.Entries()
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if time.Unix(e.Time, 0).Before(since) {
+			continue
+		}
+		rel, err := filepath.Rel(d.cacheRoot(e.URL), e.Dir)
+		if err != nil {
+			return count, err
+		}
+		if err = exportEntry(tw, filepath.ToSlash(rel), e, true); err != nil {
+			return count, errors.Wrap(err, e.URL)
+		}
+		count++
+	}
+	return count, tw.Close()
+}
+
+// exportEntry write <name>/meta.json and with payload <name>/cached.file
+func exportEntry(tw *tar.Writer, name string, e Entry, payload bool) error {
+	metaData, err := json.Marshal(e.Meta)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name + "/meta.json",
+		Mode:    0644,
+		Size:    int64(len(metaData)),
+		ModTime: e.AccessTime,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(metaData); err != nil {
+		return err
+	}
+	if !payload {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(e.Dir, "cached.file"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name + "/cached.file",
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: time.Unix(e.Time, 0),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Import read tar archive created by Export, existing entries are overwritten
+// checksum stored in meta.json is verified
+func (d *DownloadCache) Import(r io.Reader) (count int, err error) {
+	tr := tar.NewReader(r)
+	var meta *Meta
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		switch filepath.Base(hdr.Name) {
+		case "meta.json":
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return count, err
+			}
+			meta = &Meta{}
+			if err := json.Unmarshal(data, meta); err != nil {
+				return count, errors.Wrap(err, hdr.Name)
+			}
+		case "cached.file":
+			if meta == nil {
+				return count, errors.Errorf("%s: meta.json not found before cached.file", hdr.Name)
+			}
+			m, err := d.store(meta.URL, meta.Filename, tr, nil, meta.SHA256)
+			if err != nil {
+				return count, errors.Wrap(err, meta.URL)
+			}
+			m.Time, m.Hits = meta.Time, meta.Hits
+			if err := writeMeta(d.downloadDir(meta.URL), m); err != nil {
+				return count, err
+			}
+			meta = nil
+			count++
+		}
+	}
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := fs.String("d", "data", "cached data store path")
+	since := fs.String("since", "", "only export entries cached within duration, eg 30d, 12h")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-mirror export [--since 30d] [-d data] <out.tar|->")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var sinceTime time.Time
+	if *since != "" {
+		duration, err := parseDuration(*since)
+		if err != nil {
+			return err
+		}
+		sinceTime = time.Now().Add(-duration)
+	}
+
+	var w io.Writer = os.Stdout
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := NewDownloadCache(*dir).Export(w, sinceTime)
+	log.Printf("exported %d entries", count)
+	return err
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := fs.String("d", "data", "cached data store path")
+	layout := fs.String("layout", LayoutHash, "Cache directory layout, hash or url")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-mirror import [-d data] <in.tar|->")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	d := NewDownloadCache(*dir)
+	d.Layout = *layout
+	count, err := d.Import(r)
+	log.Printf("imported %d entries", count)
+	return err
+}
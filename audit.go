@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a line of audit log
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // download, purge, pin, unpin, prefetch, upload, clean, sign, key, revoke-key, config
+	Client string    `json:"client"` // ip, key:<name> or cert:<cn>
+	IP     string    `json:"ip,omitempty"`
+	URL    string    `json:"url,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Status int       `json:"status,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+}
+
+// AuditLog append entries as json lines, file is opened in append only mode
+type AuditLog struct {
+	filename string
+	mu       sync.Mutex
+	f        *os.File
+}
+
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{filename: filename, f: f}, nil
+}
+
+func (a *AuditLog) Record(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.f.Write(append(data, '\n'))
+	return err
+}
+
+// AuditQuery filter entries, empty fields match all
+type AuditQuery struct {
+	Since  time.Time
+	Action string
+	Client string
+	URL    string // * matches any characters
+	Limit  int    // newest entries are kept
+}
+
+// Query scan the log file, return matched entries, oldest first
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	f, err := os.Open(a.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var urlRe *regexp.Regexp
+	if q.URL != "" {
+		urlRe = globRegexp(q.URL)
+	}
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if e.Time.Before(q.Since) ||
+			(q.Action != "" && e.Action != q.Action) ||
+			(q.Client != "" && e.Client != q.Client && e.IP != q.Client) ||
+			(urlRe != nil && !urlRe.MatchString(e.URL)) {
+			continue
+		}
+		entries = append(entries, e)
+		if q.Limit > 0 && len(entries) > 2*q.Limit {
+			entries = append(entries[:0], entries[len(entries)-q.Limit:]...)
+		}
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, scanner.Err()
+}
+
+// audit record request of client, no-op if audit log not opened
+func (d *DownloadCache) audit(r *http.Request, e AuditEntry) {
+	if d.auditLog == nil {
+		return
+	}
+	e.Client = clientKey(r)
+	if key, ok := d.apiKeys.Lookup(apiKeyOf(r)); ok {
+		e.Client = "key:" + key.Name
+	} else if login, _, ok := d.session(r); ok {
+		e.Client = "github:" + login
+	} else if user, _, ok := d.ldapUser(r); ok {
+		e.Client = "ldap:" + user
+	}
+	if ip := clientIP(r); ip != e.Client {
+		e.IP = d.anonymizeIP(ip)
+	}
+	e.Client = d.anonymizeIP(e.Client)
+	d.auditLog.Record(e)
+}
+
+// audited record admin action of modifying requests (not GET), with url, pattern or name of query as subject
+func (d *DownloadCache) audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h(w, r)
+			return
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		h(cw, r)
+		// form is parsed by handler, except uploads whose body is file content
+		values := r.Form
+		if values == nil {
+			values = r.URL.Query()
+		}
+		e := AuditEntry{Action: action, URL: values.Get("url"), Status: cw.status}
+		for _, name := range []string{"pattern", "name", "keep", "expires", "path"} {
+			if v := values.Get(name); v != "" {
+				e.Detail = name + "=" + v
+			}
+		}
+		if action == "pin" && r.Method == "DELETE" {
+			e.Action = "unpin"
+		}
+		if action == "key" && r.Method == "DELETE" {
+			e.Action = "revoke-key"
+		}
+		if action == "alias" && r.Method == "DELETE" {
+			e.Action = "unalias"
+		}
+		if action == "tag" && r.Method == "DELETE" {
+			e.Action = "untag"
+		}
+		if tags := values["tag"]; action == "tag" && len(tags) > 0 {
+			e.Detail = "tag=" + strings.Join(tags, ",")
+		}
+		d.audit(r, e)
+	}
+}
+
+// configDigest describe flags and config file of serve, so changes between restarts can be found
+// values of secret flags are not recorded
+func configDigest(fs *flag.FlagSet, configFile string) string {
+	flags := make([]string, 0)
+	fs.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if strings.Contains(f.Name, "token") || strings.Contains(f.Name, "webhook") || strings.Contains(f.Name, "secret") {
+			value = "***"
+		}
+		flags = append(flags, "-"+f.Name+"="+value)
+	})
+	detail := "flags: " + strings.Join(flags, " ")
+	if configFile != "" {
+		if data, err := ioutil.ReadFile(configFile); err == nil {
+			detail += fmt.Sprintf(", %s sha256: %x", configFile, sha256.Sum256(data))
+		}
+	}
+	return detail
+}
+
+// handleAPIAudit query audit log
+// query: since=24h, action=purge, client=<ip, key:name, github:login or ldap:user>, url=<glob>, limit=100
+func (d *DownloadCache) handleAPIAudit(w http.ResponseWriter, r *http.Request) {
+	if d.auditLog == nil {
+		writeJSON(w, []AuditEntry{})
+		return
+	}
+	q := AuditQuery{Action: r.FormValue("action"), Client: r.FormValue("client"), URL: r.FormValue("url"), Limit: 100}
+	if v := r.FormValue("since"); v != "" {
+		since, err := parseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Since = time.Now().Add(-since)
+	}
+	if v := r.FormValue("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	entries, err := d.auditLog.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, entries)
+}
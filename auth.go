@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// requestToken return bearer token, or password of basic auth which browsers prompt for
+func requestToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// isLoopback report whether request comes from loopback address. unix socket peers are not,
+// the socket is usually shared with a reverse proxy which forwards requests of any client
+func isLoopback(r *http.Request) bool {
+	if _, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
+		return false // unix socket
+	}
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+// roles of api keys, keys without role can only download through the mirror
+const (
+	RoleViewer = "viewer" // see dashboard, stats and cached files
+	RoleAdmin  = "admin"  // also purge, pin, cancel retries and edit config, same as admin token
+)
+
+func isRole(role string) bool {
+	return role == "" || role == RoleViewer || role == RoleAdmin
+}
+
+// isAdmin report whether request has admin token, admin api key, admin github or ldap login,
+// or from loopback address when no token configured
+func (d *DownloadCache) isAdmin(r *http.Request) bool {
+	if key, ok := d.apiKeys.Lookup(apiKeyOf(r)); ok && key.Role == RoleAdmin {
+		return true
+	}
+	if _, role, ok := d.session(r); ok && role == RoleAdmin {
+		return true
+	}
+	if d.AdminToken != "" && subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(d.AdminToken)) == 1 {
+		return true
+	}
+	if _, role, ok := d.ldapUser(r); ok && role == RoleAdmin {
+		return true
+	}
+	return d.AdminToken == "" && isLoopback(r)
+}
+
+// isViewer report whether request can see dashboard and stats, admin is a viewer too
+func (d *DownloadCache) isViewer(r *http.Request) bool {
+	if key, ok := d.apiKeys.Lookup(apiKeyOf(r)); ok && key.Role == RoleViewer {
+		return true
+	}
+	if _, _, ok := d.session(r); ok {
+		return true
+	}
+	if d.isAdmin(r) {
+		return true
+	}
+	_, _, ok := d.ldapUser(r)
+	return ok
+}
+
+// hasIdentity report whether request is authenticated by api key, github or ldap login, but may lack a role
+func (d *DownloadCache) hasIdentity(r *http.Request) bool {
+	if _, ok := d.apiKeys.Lookup(apiKeyOf(r)); ok {
+		return true
+	}
+	if _, _, ok := d.session(r); ok {
+		return true
+	}
+	_, _, ok := d.ldapUser(r)
+	return ok
+}
+
+// requireAdmin allow request with admin token or admin api key, or from loopback address when no token configured
+func (d *DownloadCache) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.isAdmin(r) {
+			h(w, r)
+			return
+		}
+		if d.hasIdentity(r) {
+			http.Error(w, "403 Forbidden, admin role required", http.StatusForbidden)
+			return
+		}
+		if d.AdminToken == "" {
+			http.Error(w, "403 Forbidden, admin api only allowed from localhost", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="github-mirror"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// requirePeer guard cached payloads and inventory read by -peers and -sync-from of other mirrors,
+// allow peer token, or requests requireViewer allows, which also need an api key with -require-api-key
+func (d *DownloadCache) requirePeer(h http.HandlerFunc) http.HandlerFunc {
+	viewer := d.requireViewer(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if PeerToken != "" && subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(PeerToken)) == 1 {
+			h(w, r)
+			return
+		}
+		if d.apiKeys.Required && !d.hasIdentity(r) && !d.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="github-mirror"`)
+			http.Error(w, "401 Unauthorized, api key or peer token required", http.StatusUnauthorized)
+			return
+		}
+		viewer(w, r)
+	}
+}
+
+// privateURL report whether url belongs to a rule with forward_auth, its cached files are never
+// handed out by cache apis, only through the mirror url
+func (d *DownloadCache) privateURL(url string) bool {
+	rule := d.ruleOfURL(url)
+	return rule != nil && rule.ForwardAuth
+}
+
+// requireViewer allow any request, or only viewers with -private-dashboard or ldap
+// browsers are redirected to github login if oauth is configured, otherwise asked for basic auth,
+// the password is the api key or admin token
+func (d *DownloadCache) requireViewer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (!d.PrivateDashboard && d.currentLDAP() == nil) || d.isViewer(r) {
+			h(w, r)
+			return
+		}
+		if d.hasIdentity(r) {
+			http.Error(w, "403 Forbidden, viewer role required", http.StatusForbidden)
+			return
+		}
+		if d.OAuth != nil && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, d.BasePath+"/_oauth/login?next="+url.QueryEscape(d.BasePath+r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="github-mirror"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	}
+}
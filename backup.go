@@ -0,0 +1,468 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BackupVersion is version of backup archive layout:
+// backup.json, state/<file> and entries/<dir>/meta.json followed by optional entries/<dir>/cached.file
+const BackupVersion = 1
+
+// maxManifestSize limit backup.json read from archives and requests
+const maxManifestSize = 1 << 30
+
+// state files of data dir and state dir saved in backups
+var (
+	backupDataFiles  = []string{"pins.json", "apikeys.json", "aliases.json"}
+	backupStateFiles = []string{"jobs.db", "usage.db"}
+)
+
+// BackupManifest is backup.json, the first file of backup archive
+type BackupManifest struct {
+	Version  int           `json:"version"`
+	ID       string        `json:"id"`             // time of backup
+	Base     string        `json:"base,omitempty"` // id of previous backup, set for incremental backup
+	Payloads bool          `json:"payloads"`
+	Entries  []BackupEntry `json:"entries"` // all cached entries, payloads are in this backup or its bases
+}
+
+// BackupEntry is a cached entry listed in manifest
+type BackupEntry struct {
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256,omitempty"`
+	Size    int64  `json:"size"`
+	Time    int64  `json:"time"`
+	Payload bool   `json:"payload,omitempty"` // cached.file is in this archive
+}
+
+func (e BackupEntry) key() string {
+	return fmt.Sprintf("%s %s %d %d", e.URL, e.SHA256, e.Size, e.Time)
+}
+
+// Backup write a snapshot of meta of all entries and state files to w, with payloads cached files are included.
+// with base only files cached since base are included, base must be a backup with payloads
+func (d *DownloadCache) Backup(w io.Writer, stateDir string, payloads bool, base *BackupManifest) (*BackupManifest, error) {
+	manifest := &BackupManifest{Version: BackupVersion, ID: time.Now().UTC().Format(time.RFC3339Nano), Payloads: payloads}
+	inBase := make(map[string]bool)
+	if base != nil {
+		if !base.Payloads {
+			return nil, errors.New("base of incremental backup has no payloads")
+		}
+		manifest.Base, manifest.Payloads = base.ID, true
+		for _, e := range base.Entries {
+			inBase[e.key()] = true
+		}
+	}
+	entries, err := d.Entries()
+	if err != nil {
+		return nil, err
+	}
+	manifest.Entries = make([]BackupEntry, 0, len(entries))
+	for _, e := range entries {
+		be := BackupEntry{URL: e.URL, SHA256: e.SHA256, Size: e.Size, Time: e.Time}
+		be.Payload = manifest.Payloads && !inBase[be.key()]
+		manifest.Entries = append(manifest.Entries, be)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, "backup.json", bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, err
+	}
+	for _, name := range backupDataFiles {
+		if err := backupFile(tw, filepath.Join(d.CacheDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range backupStateFiles {
+		if err := d.backupDB(tw, filepath.Join(stateDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	for i, e := range entries {
+		rel, err := filepath.Rel(d.cacheRoot(e.URL), e.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if err := exportEntry(tw, "entries/"+filepath.ToSlash(rel), e, manifest.Entries[i].Payload); err != nil {
+			return nil, errors.Wrap(err, e.URL)
+		}
+	}
+	return manifest, tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+func backupFile(tw *tar.Writer, filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, "state/"+filepath.Base(filename), bytes.NewReader(data), int64(len(data)))
+}
+
+// backupDB write a consistent copy of bbolt db, the db opened by this process is copied in a read transaction
+func (d *DownloadCache) backupDB(tw *tar.Writer, filename string) error {
+	var db *bolt.DB
+	switch {
+	case d.jobs != nil && filepath.Base(filename) == "jobs.db":
+		db = d.jobs.db
+	case d.usage != nil && filepath.Base(filename) == "usage.db":
+		db = d.usage.db
+	default:
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return nil
+		}
+		var err error
+		db, err = bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+		if err != nil {
+			return errors.Wrapf(err, "open %s, use -server if the server is running", filename)
+		}
+		defer db.Close()
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		if err := tw.WriteHeader(&tar.Header{Name: "state/" + filepath.Base(filename), Mode: 0644, Size: tx.Size(), ModTime: time.Now()}); err != nil {
+			return err
+		}
+		_, err := tx.WriteTo(tw)
+		return err
+	})
+}
+
+// Restore read backup archive created by Backup, prev is manifest of the archive restored before,
+// which must be the base of an incremental backup. returned missing are urls whose payload is not in archives
+func (d *DownloadCache) Restore(r io.Reader, stateDir string, prev *BackupManifest) (manifest *BackupManifest, count int, missing []string, err error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "read backup")
+	}
+	if hdr.Name != "backup.json" {
+		return nil, 0, nil, errors.New("not a backup archive, backup.json not found")
+	}
+	manifest = &BackupManifest{}
+	if err := json.NewDecoder(io.LimitReader(tr, maxManifestSize)).Decode(manifest); err != nil {
+		return nil, 0, nil, errors.Wrap(err, "backup.json")
+	}
+	if manifest.Version > BackupVersion {
+		return nil, 0, nil, errors.Errorf("backup version %d is newer than %d", manifest.Version, BackupVersion)
+	}
+	if manifest.Base != "" && (prev == nil || prev.ID != manifest.Base) {
+		return nil, 0, nil, errors.Errorf("incremental backup of %s, restore its base first", manifest.Base)
+	}
+	// meta without cached.file keeps the local copy or is downloaded again
+	var pending *Meta
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		m := pending
+		pending = nil
+		local, err := readMeta(d.downloadDir(m.URL))
+		if err != nil || local.SHA256 != m.SHA256 || local.Size != m.Size {
+			missing = append(missing, m.URL)
+			return nil
+		}
+		local.Time, local.Hits, local.Tags, local.Note = m.Time, m.Hits, m.Tags, m.Note
+		return writeMeta(d.downloadDir(m.URL), local)
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, count, missing, err
+		}
+		switch {
+		case strings.HasPrefix(hdr.Name, "state/"):
+			if err := restoreFile(d.CacheDir, stateDir, path.Base(hdr.Name), tr); err != nil {
+				return manifest, count, missing, err
+			}
+		case path.Base(hdr.Name) == "meta.json":
+			if err := flush(); err != nil {
+				return manifest, count, missing, err
+			}
+			pending = &Meta{}
+			if err := json.NewDecoder(tr).Decode(pending); err != nil {
+				return manifest, count, missing, errors.Wrap(err, hdr.Name)
+			}
+		case path.Base(hdr.Name) == "cached.file":
+			if pending == nil {
+				return manifest, count, missing, errors.Errorf("%s: meta.json not found before cached.file", hdr.Name)
+			}
+			meta := pending
+			pending = nil
+			m, err := d.store(meta.URL, meta.Filename, tr, nil, meta.SHA256)
+			if err != nil {
+				return manifest, count, missing, errors.Wrap(err, meta.URL)
+			}
+			m.Time, m.Hits, m.Tags, m.Note = meta.Time, meta.Hits, meta.Tags, meta.Note
+			if err := writeMeta(d.downloadDir(meta.URL), m); err != nil {
+				return manifest, count, missing, err
+			}
+			count++
+		}
+	}
+	return manifest, count, missing, flush()
+}
+
+// restoreFile replace a state file, bbolt dbs go to stateDir
+func restoreFile(dataDir, stateDir, name string, r io.Reader) error {
+	dir := dataDir
+	for _, n := range backupStateFiles {
+		if n == name {
+			dir = stateDir
+		}
+	}
+	known := dir == stateDir
+	for _, n := range backupDataFiles {
+		known = known || n == name
+	}
+	if !known {
+		log.Printf("restore: skip unknown state file %s", name)
+		return nil
+	}
+	filename := filepath.Join(dir, name)
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// readBackupManifest read backup.json of backup archive
+func readBackupManifest(filename string) (*BackupManifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "backup.json" {
+		return nil, errors.Errorf("%s is not a backup archive", filename)
+	}
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(io.LimitReader(tr, maxManifestSize)).Decode(manifest); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	return manifest, nil
+}
+
+// handleAPIBackup stream backup archive of running server, payloads=1 to include cached files,
+// POST backup.json of previous backup as body for incremental backup
+func (d *DownloadCache) handleAPIBackup(w http.ResponseWriter, r *http.Request) {
+	payloads, _ := strconv.ParseBool(r.FormValue("payloads"))
+	var base *BackupManifest
+	if r.Method == "POST" {
+		base = &BackupManifest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxManifestSize)).Decode(base); err != nil {
+			http.Error(w, "invalid base manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !base.Payloads {
+			http.Error(w, "base of incremental backup has no payloads", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="github-mirror-backup.tar"`)
+	manifest, err := d.Backup(w, d.stateDir, payloads, base)
+	if err != nil {
+		logErrorf("backup: %v", err) // headers are sent, the client gets a truncated archive
+		return
+	}
+	log.Printf("backup %s: %d entries", manifest.ID, len(manifest.Entries))
+}
+
+func runBackup(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("backup", "[-payloads] [-incremental previous.tar] [-d data | -server URL] <out.tar|->")
+	c.register(fs)
+	stateDir := fs.String("state-dir", "", "Directory of databases, default is -d")
+	payloads := fs.Bool("payloads", false, "Include cached files, without them restore downloads files again")
+	incremental := fs.String("incremental", "", "Previous backup with payloads, only files cached since it are included")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var base *BackupManifest
+	if *incremental != "" {
+		var err error
+		if base, err = readBackupManifest(*incremental); err != nil {
+			return err
+		}
+	}
+	var w io.Writer = os.Stdout
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if c.server != "" {
+		return c.download(base, *payloads, w)
+	}
+	if *stateDir == "" {
+		*stateDir = c.dir
+	}
+	d, err := c.cache()
+	if err != nil {
+		return err
+	}
+	manifest, err := d.Backup(w, *stateDir, *payloads, base)
+	if err != nil {
+		return err
+	}
+	log.Printf("backup %s: %d entries", manifest.ID, len(manifest.Entries))
+	return nil
+}
+
+// download backup of -server into w
+func (c *cliFlags) download(base *BackupManifest, payloads bool, w io.Writer) error {
+	u := strings.TrimSuffix(c.server, "/") + "/_api/backup?payloads=" + strconv.FormatBool(payloads)
+	method, body := "GET", []byte(nil)
+	if base != nil {
+		data, err := json.Marshal(base)
+		if err != nil {
+			return err
+		}
+		method, body = "POST", data
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("%s /_api/backup: %s", method, strings.TrimSpace(string(data)))
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func runRestore(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("restore", "[-d data] <full.tar> [incremental.tar ...]")
+	c.register(fs)
+	stateDir := fs.String("state-dir", "", "Directory of databases, default is -d")
+	fs.Parse(args)
+	if fs.NArg() == 0 || c.server != "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *stateDir == "" {
+		*stateDir = c.dir
+	}
+	if err := os.MkdirAll(*stateDir, 0755); err != nil {
+		return err
+	}
+	d, err := c.cache()
+	if err != nil {
+		return err
+	}
+	var manifest *BackupManifest
+	restored := make(map[string]bool)
+	missing := make(map[string]bool)
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		m, count, urls, err := d.Restore(f, *stateDir, manifest)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		manifest = m
+		for _, e := range m.Entries {
+			restored[e.URL] = true
+		}
+		for _, url := range urls {
+			missing[url] = true
+		}
+		log.Printf("restored %d files of %s", count, name)
+	}
+	// entries removed after the base backup
+	current := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		current[e.URL] = true
+	}
+	for url := range restored {
+		if !current[url] {
+			delete(missing, url)
+			if err := d.Purge(url); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, url)
+			}
+		}
+	}
+	for url := range missing {
+		if d.IsCached(url) {
+			delete(missing, url)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	// restored jobs.db is opened after restore, so the queued downloads are kept
+	jobs, err := OpenJobQueue(filepath.Join(*stateDir, "jobs.db"), d.jobHandlers())
+	if err != nil {
+		return err
+	}
+	defer jobs.Close()
+	for url := range missing {
+		if _, err := jobs.Enqueue(JobDownload, url); err != nil {
+			return err
+		}
+	}
+	log.Printf("queued %d downloads of files not in backup, they are downloaded by serve", len(missing))
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	neturl "net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCircuitOpen is returned without contacting upstream host which failed too many times recently
+var ErrCircuitOpen = errors.New("circuit open, upstream is failing")
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	probing  bool // half open, a single request is trying upstream
+}
+
+// circuitBreaker fail fast for upstream hosts with consecutive failures,
+// after cooldown one request is let through, success closes the circuit
+type circuitBreaker struct {
+	threshold int // 0 to disable
+	cooldown  time.Duration
+	mu        sync.Mutex
+	circuits  map[string]*circuit
+}
+
+func hostOf(rawurl string) string {
+	if u, err := neturl.Parse(rawurl); err == nil {
+		return u.Host
+	}
+	return rawurl
+}
+
+// Allow return ErrCircuitOpen if requests to host of url should fail fast
+func (b *circuitBreaker) Allow(url string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	host := hostOf(url)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[host]
+	if c == nil || c.failures < b.threshold {
+		return nil
+	}
+	if time.Since(c.openedAt) < b.cooldown || c.probing {
+		return errors.Wrapf(ErrCircuitOpen, "%s failed %d times", host, c.failures)
+	}
+	c.probing = true
+	return nil
+}
+
+// Record update circuit of host of url with result of a request
+func (b *circuitBreaker) Record(url string, err error) {
+	if b.threshold <= 0 || errors.Cause(err) == ErrCircuitOpen {
+		return
+	}
+	host := hostOf(url)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[host]
+	switch {
+	case !isUpstreamFailure(err):
+		delete(b.circuits, host)
+	case errors.Cause(err) == ErrTooLarge || errors.Cause(err) == ErrInsufficientStorage:
+		// not caused by upstream
+		if c != nil {
+			c.probing = false
+		}
+	default:
+		if b.circuits == nil {
+			b.circuits = make(map[string]*circuit)
+		}
+		if c == nil {
+			c = &circuit{}
+			b.circuits[host] = c
+		}
+		c.failures++
+		c.probing = false
+		if c.failures >= b.threshold {
+			c.openedAt = time.Now()
+		}
+	}
+}
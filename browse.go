@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+const browseTableHeader = "<table><tr><th align=\"left\">Name</th><th align=\"right\">Size</th><th>Cached</th><th></th></tr>"
+
+// handleBrowse list cached files as html by upstream host/owner/repo, with sizes, dates and download links
+// path: /_browse/<host>/<path>, with ?q= search results are listed instead
+func (d *DownloadCache) handleBrowse(w http.ResponseWriter, r *http.Request) {
+	if q := r.FormValue("q"); q != "" {
+		d.browseSearch(w, r, q)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_browse/"), "/")
+	node, err := d.files.find(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if node.entry != nil {
+		http.Redirect(w, r, d.BasePath+"/_browse/"+path.Dir(name)+"/", http.StatusFound)
+		return
+	}
+	base := d.BasePath + "/_browse/"
+
+	output := "<html><head><title>Browse /" + html.EscapeString(name) + "</title></head><body><h2><a href=\"" + base + "\">cache</a>"
+	href := base
+	for _, part := range strings.Split(name, "/") {
+		if part == "" {
+			continue
+		}
+		href += url.PathEscape(part) + "/"
+		output += " / <a href=\"" + href + "\">" + html.EscapeString(part) + "</a>"
+	}
+	output += "</h2>" + d.searchForm("") + "<p>" + fmt.Sprintf("%d files, %s", node.files, datasize.ByteSize(node.size).HR()) + "</p>"
+	output += browseTableHeader
+
+	children := make([]*davNode, 0, len(node.children))
+	for _, child := range node.children {
+		children = append(children, child)
+	}
+	// directories first
+	sort.Slice(children, func(i, j int) bool {
+		if (children[i].entry == nil) != (children[j].entry == nil) {
+			return children[i].entry == nil
+		}
+		return children[i].name < children[j].name
+	})
+	for _, child := range children {
+		date := child.modTime.Local().Format("2006-01-02 15:04")
+		if child.entry == nil {
+			output += "<tr><td><a href=\"" + url.PathEscape(child.name) + "/\">" + html.EscapeString(child.name) + "/</a></td><td align=\"right\">" +
+				datasize.ByteSize(child.size).HR() + "</td><td>" + date + "</td><td>" + fmt.Sprintf("%d files", child.files) + "</td></tr>"
+			continue
+		}
+		output += d.browseFileRow(r, child.name, child.entry)
+	}
+	output += "</table></body></html>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, output)
+}
+
+// browseSearch list search results of q as html
+func (d *DownloadCache) browseSearch(w http.ResponseWriter, r *http.Request, q string) {
+	entries, err := d.Search(q, 500)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	output := "<html><head><title>Search " + html.EscapeString(q) + "</title></head><body><h2><a href=\"" + d.BasePath + "/_browse/\">cache</a> / search</h2>"
+	output += d.searchForm(q) + "<p>" + fmt.Sprintf("%d files found", len(entries)) + "</p>" + browseTableHeader
+	for i := range entries {
+		output += d.browseFileRow(r, entries[i].URL, &entries[i])
+	}
+	output += "</table></body></html>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, output)
+}
+
+func (d *DownloadCache) searchForm(q string) string {
+	return "<form action=\"" + d.BasePath + "/_browse/\"><input name=\"q\" value=\"" + html.EscapeString(q) +
+		"\" placeholder=\"filename or url, eg kubectl 1.31\" size=\"40\"> <input type=\"submit\" value=\"Search\"></form>"
+}
+
+// browseFileRow render a cached file, linked to mirror url or webdav if no rule serves it
+func (d *DownloadCache) browseFileRow(r *http.Request, name string, e *Entry) string {
+	link := d.mirrorURLOf(r, e.URL)
+	if link == "" {
+		if parts := davPath(e.URL); parts != nil {
+			for i := range parts {
+				parts[i] = url.PathEscape(parts[i])
+			}
+			link = d.BasePath + "/_dav/" + strings.Join(parts, "/")
+		}
+	}
+	return "<tr><td><a href=\"" + html.EscapeString(link) + "\">" + html.EscapeString(name) + "</a></td><td align=\"right\">" +
+		datasize.ByteSize(e.Size).HR() + "</td><td>" + time.Unix(e.Time, 0).Local().Format("2006-01-02 15:04") + "</td><td><a href=\"" +
+		html.EscapeString(e.URL) + "\">source</a> " +
+		fmt.Sprintf("%d hits, last access %s ago", e.Hits, time.Since(e.AccessTime).Round(time.Minute)) +
+		browseTags(e.Meta) + "</td></tr>"
+}
+
+func browseTags(m *Meta) string {
+	output := ""
+	for _, tag := range m.Tags {
+		output += " <b>" + html.EscapeString(tag) + "</b>"
+	}
+	if m.Note != "" {
+		output += " <i>" + html.EscapeString(m.Note) + "</i>"
+	}
+	return output
+}
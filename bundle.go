@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bundlePattern match /owner/repo/bundle?ref=main
+var bundlePattern = regexp.MustCompile(`^/[^/]+/[^/]+/bundle$`)
+
+var refPattern = regexp.MustCompile(`^[\w][\w./-]*$`)
+
+// bundleTimeout bound clone and bundle of a repo, a stuck git would hold the worker of key forever
+const bundleTimeout = 30 * time.Minute
+
+// gitCommand return git command whose http requests go through upstream proxy of url
+func gitCommand(ctx context.Context, url string, args ...string) *exec.Cmd {
+	if req, err := http.NewRequest("GET", url, nil); err == nil {
+		if proxy, err := upstreamTransport.Proxy(req); err == nil && proxy != nil {
+			args = append([]string{"-c", "http.proxy=" + proxy.String()}, args...)
+		}
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+// lsRemote return commit id of ref in remote repository
+func lsRemote(ctx context.Context, repoURL, ref string) (string, error) {
+	output, err := gitCommand(ctx, repoURL, "ls-remote", repoURL, ref).Output()
+	if err != nil {
+		return "", errors.Wrap(err, "git ls-remote")
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[1] == ref || fields[1] == "refs/heads/"+ref || fields[1] == "refs/tags/"+ref) {
+			return fields[0], nil
+		}
+	}
+	return "", errors.Errorf("ref %s not found", ref)
+}
+
+// serveBundle serve git bundle of ref, bundles are cached by commit id
+// so the repository can be cloned offline with: git clone repo.bundle
+func (d *DownloadCache) serveBundle(w http.ResponseWriter, r *http.Request, url string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		http.Error(w, "git bundle requires git installed on server", http.StatusNotImplemented)
+		return
+	}
+	repoURL := strings.TrimSuffix(strings.SplitN(url, "?", 2)[0], "/bundle")
+	if !strings.HasSuffix(repoURL, ".git") {
+		repoURL += ".git"
+	}
+	ref := r.FormValue("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if !refPattern.MatchString(ref) {
+		http.Error(w, "invalid ref", http.StatusBadRequest)
+		return
+	}
+	commit, err := lsRemote(r.Context(), repoURL, ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	key := repoURL + "#bundle=" + commit
+	filename := strings.TrimSuffix(filepath.Base(repoURL), ".git") + "-" + commit[:12] + ".bundle"
+	cacheStatus, err := d.generateOnce(key, func() error {
+		return d.createBundle(repoURL, ref, key, filename)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	countCacheStatus(cacheStatus)
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	d.ServeFile(w, r, key)
+}
+
+// createBundle clone single branch of ref and save its bundle as cache of key
+func (d *DownloadCache) createBundle(repoURL, ref, key, filename string) error {
+	tmpDir, err := ioutil.TempDir(d.CacheDir, "bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	gitDir := filepath.Join(tmpDir, "repo.git")
+	args := []string{"clone", "--quiet", "--bare", "--single-branch"}
+	if ref != "HEAD" {
+		args = append(args, "--branch", ref)
+	}
+	log.Println("bundle", repoURL, ref)
+	ctx, cancel := context.WithTimeout(context.Background(), bundleTimeout)
+	defer cancel()
+	if output, err := gitCommand(ctx, repoURL, append(args, repoURL, gitDir)...).CombinedOutput(); err != nil {
+		return errors.Errorf("git clone: %v %s", err, output)
+	}
+	bundleFile := filepath.Join(tmpDir, filename)
+	if output, err := exec.CommandContext(ctx, "git", "-C", gitDir, "bundle", "create", bundleFile, "--all").CombinedOutput(); err != nil {
+		return errors.Errorf("git bundle: %v %s", err, output)
+	}
+	f, err := os.Open(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = d.store(key, filename, f, nil, "")
+	return err
+}
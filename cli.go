@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/pkg/errors"
+)
+
+// cliFlags are flags shared by commands work on data dir or a running server
+type cliFlags struct {
+	dir    string
+	layout string
+	config string
+	server string
+	token  string
+}
+
+func (c *cliFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.dir, "d", "data", "cached data store path")
+	fs.StringVar(&c.layout, "layout", LayoutHash, "Cache directory layout, hash or url")
+	fs.StringVar(&c.config, "config", "", "Config file of server, needed when rules have own cache_dir")
+	fs.StringVar(&c.server, "server", "", "Use api of running server instead of data dir, eg http://localhost:8000")
+	fs.StringVar(&c.token, "token", os.Getenv("GITHUB_MIRROR_ADMIN_TOKEN"), "Admin token of -server")
+}
+
+func (c *cliFlags) cache() (*DownloadCache, error) {
+	d := NewDownloadCache(c.dir)
+	d.Layout = c.layout
+	if c.config != "" {
+		if err := d.applyConfig(c.config); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// api call server api, decode json response into v if v is not nil
+func (c *cliFlags) api(method, apiPath string, query url.Values, v interface{}) error {
+	u := strings.TrimSuffix(c.server, "/") + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("%s %s: %s", method, apiPath, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func newCommandFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-mirror "+name+" "+usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runClean(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("clean", "[--keep 30d] [--keep-tags tags] [--dry-run] [-d data | -server URL]")
+	c.register(fs)
+	keep := fs.String("keep", "7d", "Remove files not accessed for this duration")
+	dryRun := fs.Bool("dry-run", false, "Report files would be removed without deleting")
+	keepTags := fs.String("keep-tags", "", "Comma separated tags of files never removed, same as -keep-tags of serve, the server uses its own with -server")
+	fs.Parse(args)
+	var report CleanReport
+	if c.server != "" {
+		query := url.Values{"keep": {*keep}, "dry_run": {fmt.Sprint(*dryRun)}}
+		if err := c.api("POST", "/_api/clean", query, &report); err != nil {
+			return err
+		}
+	} else {
+		keepDuration, err := parseDuration(*keep)
+		if err != nil {
+			return err
+		}
+		d, err := c.cache()
+		if err != nil {
+			return err
+		}
+		d.KeepTags = splitComma(*keepTags)
+		report = d.Clean(keepDuration, *dryRun)
+	}
+	if report.DryRun {
+		for _, f := range report.Files {
+			fmt.Printf("%s\t%s idle\t%s\n", datasize.ByteSize(f.Size).HR(), f.Idle, f.URL)
+		}
+		fmt.Printf("would remove %d files, %s\n", report.Count, datasize.ByteSize(report.Size).HR())
+		return nil
+	}
+	fmt.Printf("removed %d files, %s\n", report.Count, datasize.ByteSize(report.Size).HR())
+	return nil
+}
+
+func runList(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("list", "[--sort hits|size|time|access] [--limit N] [-d data | -server URL]")
+	c.register(fs)
+	sortBy := fs.String("sort", "time", "Sort by hits, size, time or access")
+	limit := fs.Int("limit", 0, "Show at most N files, 0 for all")
+	fs.Parse(args)
+	var entries []Entry
+	if c.server != "" {
+		query := url.Values{"sort": {*sortBy}}
+		if *limit > 0 {
+			query.Set("limit", fmt.Sprint(*limit))
+		}
+		if err := c.api("GET", "/_api/cache", query, &entries); err != nil {
+			return err
+		}
+	} else {
+		d, err := c.cache()
+		if err != nil {
+			return err
+		}
+		if entries, err = d.Entries(); err != nil {
+			return err
+		}
+		sortEntries(entries, *sortBy)
+		if *limit > 0 && *limit < len(entries) {
+			entries = entries[:*limit]
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tHITS\tCACHED\tURL")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", datasize.ByteSize(e.Size).HR(), e.Hits,
+			time.Unix(e.Time, 0).Format("2006-01-02 15:04"), e.URL)
+	}
+	return w.Flush()
+}
+
+func runPurge(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("purge", "[-d data | -server URL] <url> ...")
+	c.register(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// -server never touches the local data dir
+	var d *DownloadCache
+	if c.server == "" {
+		var err error
+		if d, err = c.cache(); err != nil {
+			return err
+		}
+	}
+	for _, u := range fs.Args() {
+		var err error
+		if c.server != "" {
+			err = c.api("DELETE", "/_api/cache", url.Values{"url": {u}}, nil)
+		} else {
+			err = d.Purge(u)
+		}
+		if err != nil {
+			return errors.Wrap(err, u)
+		}
+		fmt.Println("purged", u)
+	}
+	return nil
+}
+
+func runPrefetch(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("prefetch", "[-d data | -server URL] <url> ...")
+	c.register(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var d *DownloadCache
+	if c.server == "" {
+		var err error
+		if d, err = c.cache(); err != nil {
+			return err
+		}
+	}
+	for _, u := range fs.Args() {
+		var err error
+		if c.server != "" {
+			err = c.api("POST", "/_api/prefetch", url.Values{"url": {u}}, nil)
+		} else {
+			_, err = d.DownloadAndWait(u, path.Base(strings.SplitN(u, "?", 2)[0]))
+		}
+		if err != nil {
+			return errors.Wrap(err, u)
+		}
+		fmt.Println("prefetched", u)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"expvar"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// clusterForwardedHeader mark requests forwarded by another node, they are always served locally
+const clusterForwardedHeader = "X-Mirror-Forwarded-By"
+
+// clusterVnodes is points of each node on the hash ring, more points spread urls more evenly
+const clusterVnodes = 128
+
+var metricClusterForwarded = expvar.NewInt("cluster_forwarded")
+
+// Cluster spread cached urls over nodes by consistent hashing, each url is cached by one node only
+// so the disk of N nodes acts as one cache. adding or removing a node only moves 1/N of urls
+type Cluster struct {
+	Self     string // url of this node, must be in Nodes
+	Nodes    []string
+	Redirect bool // redirect clients to owner instead of proxying
+
+	ring  []uint32
+	owner map[uint32]string
+}
+
+func NewCluster(self string, nodes []string, redirect bool) (*Cluster, error) {
+	c := &Cluster{Self: strings.TrimSuffix(self, "/"), Redirect: redirect, owner: make(map[uint32]string)}
+	for _, node := range nodes {
+		node = strings.TrimSuffix(node, "/")
+		c.Nodes = append(c.Nodes, node)
+		for i := 0; i < clusterVnodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			if _, exists := c.owner[point]; exists {
+				continue // collision, keep the first
+			}
+			c.owner[point] = node
+			c.ring = append(c.ring, point)
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+	found := false
+	for _, node := range c.Nodes {
+		found = found || node == c.Self
+	}
+	if !found {
+		return nil, errors.Errorf("cluster self %s is not in nodes %s", c.Self, strings.Join(c.Nodes, ","))
+	}
+	return c, nil
+}
+
+// TrustNodes add addresses of other nodes to TrustedProxies, so X-Forwarded-For of forwarded
+// requests is the client ip, and per ip limits apply to clients instead of the forwarding node
+func (c *Cluster) TrustNodes() {
+	for _, node := range c.Nodes {
+		if node == c.Self {
+			continue
+		}
+		u, err := url.Parse(node)
+		if err != nil || u.Hostname() == "" {
+			logWarnf("cluster node %s: invalid url", node)
+			continue
+		}
+		ips, err := net.LookupIP(u.Hostname())
+		if err != nil {
+			logWarnf("cluster node %s: %v", node, err)
+			continue
+		}
+		for _, ip := range ips {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			TrustedProxies = append(TrustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+}
+
+// Owner return node which caches url, the first point on ring clockwise from hash of url
+func (c *Cluster) Owner(url string) string {
+	h := crc32.ChecksumIEEE([]byte(url))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.owner[c.ring[i]]
+}
+
+// routeCluster send request to the owner of url, return false if it should be served locally
+// when the owner is unreachable, request is served locally so a down node does not fail its urls,
+// except requests with body (git-upload-pack) which can not be sent again
+func (d *DownloadCache) routeCluster(w http.ResponseWriter, r *http.Request, url string) bool {
+	if d.cluster == nil || r.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+	owner := d.cluster.Owner(url)
+	if owner == d.cluster.Self {
+		return false
+	}
+	// nodes run with the same -base-path, which ServeHTTP has stripped
+	target := owner + d.BasePath + r.URL.RequestURI()
+	if d.cluster.Redirect {
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		return true
+	}
+	hasBody := r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+	var body io.Reader
+	if hasBody {
+		body = r.Body
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, body)
+	if err != nil {
+		logWarnf("cluster forward %s: %v", url, err)
+		return false
+	}
+	req.ContentLength = r.ContentLength
+	for _, key := range append(passRequestHeaders, "Authorization", "X-API-Key", "User-Agent", "Content-Type", "Content-Encoding", "Git-Protocol") {
+		if v := r.Header.Get(key); v != "" {
+			req.Header.Set(key, v)
+		}
+	}
+	req.Header.Set(clusterForwardedHeader, d.cluster.Self)
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	res, err := peerClient.Do(req)
+	if err != nil && hasBody {
+		logWarnf("cluster forward %s to %s: %v", url, owner, err)
+		http.Error(w, "502 cluster node "+owner+" is unreachable", http.StatusBadGateway)
+		return true
+	}
+	if err != nil {
+		logWarnf("cluster forward %s to %s: %v, serve locally", url, owner, err)
+		return false
+	}
+	defer res.Body.Close()
+	metricClusterForwarded.Add(1)
+	for _, key := range append(passResponseHeaders, "Cache-Control", "Age", "Warning", "Retry-After", "X-Cache") {
+		if v := res.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.Header().Set("X-Mirror-Node", owner)
+	w.WriteHeader(res.StatusCode)
+	if _, err := io.Copy(w, res.Body); err != nil {
+		logWarnf("cluster forward %s: %v", url, err)
+	}
+	return true
+}
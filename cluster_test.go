@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// forwarded is a request received by the owner node
+type forwarded struct {
+	method, uri, body string
+	header            http.Header
+}
+
+// newClusterPair return a node whose cluster has one other node, the owner recording requests
+func newClusterPair(t *testing.T) (*DownloadCache, *httptest.Server, chan forwarded) {
+	received := make(chan forwarded, 1)
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- forwarded{r.Method, r.RequestURI, string(body), r.Header}
+		w.Write([]byte("from owner"))
+	}))
+	t.Cleanup(owner.Close)
+	d := NewDownloadCache(t.TempDir())
+	cluster, err := NewCluster("http://self.invalid", []string{"http://self.invalid", owner.URL}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.cluster = cluster
+	return d, owner, received
+}
+
+// ownedPath return a git-upload-pack path of github.com cached by node
+func ownedPath(t *testing.T, c *Cluster, node string) string {
+	for i := 0; i < 1000; i++ {
+		p := "/owner/repo" + strconv.Itoa(i) + ".git/git-upload-pack"
+		if c.Owner("https://github.com"+p) == node {
+			return p
+		}
+	}
+	t.Fatal("no path owned by " + node)
+	return ""
+}
+
+func TestClusterForwardPost(t *testing.T) {
+	d, owner, received := newClusterPair(t)
+	p := ownedPath(t, d.cluster, owner.URL)
+	req := httptest.NewRequest("POST", p, strings.NewReader("0032want 1111\n"))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, req)
+	if w.Body.String() != "from owner" {
+		t.Fatalf("response %d %q, want forwarded to owner", w.Code, w.Body.String())
+	}
+	f := <-received
+	if f.method != "POST" || f.uri != p || f.body != "0032want 1111\n" {
+		t.Errorf("owner got %s %s %q", f.method, f.uri, f.body)
+	}
+	if f.header.Get("Content-Type") != "application/x-git-upload-pack-request" || f.header.Get("Git-Protocol") != "version=2" {
+		t.Errorf("headers are not forwarded: %v", f.header)
+	}
+}
+
+func TestClusterBasePath(t *testing.T) {
+	d, owner, received := newClusterPair(t)
+	d.BasePath = "/ghmirror"
+	p := ownedPath(t, d.cluster, owner.URL)
+	d.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", d.BasePath+p+"?x=1", nil))
+	if f := <-received; f.uri != d.BasePath+p+"?x=1" {
+		t.Errorf("owner got %s, want %s", f.uri, d.BasePath+p+"?x=1")
+	}
+
+	d.cluster.Redirect = true
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", d.BasePath+p, nil))
+	if loc := w.Header().Get("Location"); loc != owner.URL+d.BasePath+p {
+		t.Errorf("redirect to %s, want %s", loc, owner.URL+d.BasePath+p)
+	}
+}
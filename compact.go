@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/pkg/errors"
+)
+
+// CompactReport is result of Compact, reclaimed is bytes freed (or would be freed with dry run)
+type CompactReport struct {
+	Scanned   int   `json:"scanned"`
+	Linked    int   `json:"linked"`  // duplicate payloads replaced with hardlinks
+	Orphans   int   `json:"orphans"` // directories without meta.json removed
+	Reclaimed int64 `json:"reclaimed"`
+	DryRun    bool  `json:"dry_run"`
+}
+
+// Compact replace identical payloads of different urls with hardlinks of one file,
+// and remove directories without meta.json not modified for minAge, eg left by a crash.
+// files are replaced by rename, so it is safe while the server is running
+func (d *DownloadCache) Compact(minAge time.Duration, dryRun bool) (report CompactReport, err error) {
+	report.DryRun = dryRun
+	entries, err := d.Entries()
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = len(entries)
+	groups := make(map[string][]Entry)
+	for _, e := range entries {
+		if e.SHA256 == "" || e.Size == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s %d", e.SHA256, e.Size)
+		groups[key] = append(groups[key], e)
+	}
+	for _, group := range groups {
+		if len(group) > 1 {
+			d.dedup(group, dryRun, &report)
+		}
+	}
+	if err := d.removeOrphans(minAge, dryRun, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// dedup link payloads of group to the first verified one, files are re-hashed before linking
+func (d *DownloadCache) dedup(group []Entry, dryRun bool, report *CompactReport) {
+	var source string
+	var sourceInfo os.FileInfo
+	// distinct files not yet linked to source, a file linked by several entries is reclaimed once
+	var replaced []os.FileInfo
+	for _, e := range group {
+		file := filepath.Join(e.Dir, "cached.file")
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if sourceInfo != nil && os.SameFile(fi, sourceInfo) {
+			continue // already linked
+		}
+		if _, err := verifyEntry(e.Dir, true); err != nil {
+			logErrorf("compact %s: %v", e.URL, err)
+			continue
+		}
+		if sourceInfo == nil {
+			source, sourceInfo = file, fi
+			continue
+		}
+		if !dryRun {
+			tmp := file + ".link"
+			os.Remove(tmp)
+			if err := os.Link(source, tmp); err != nil {
+				logWarnf("compact %s: %v", e.URL, err) // eg cache dirs on different disks
+				continue
+			}
+			if err := os.Rename(tmp, file); err != nil {
+				os.Remove(tmp)
+				logWarnf("compact %s: %v", e.URL, err)
+				continue
+			}
+		}
+		report.Linked++
+		seen := false
+		for _, r := range replaced {
+			seen = seen || os.SameFile(fi, r)
+		}
+		if !seen {
+			replaced = append(replaced, fi)
+			report.Reclaimed += fi.Size()
+		}
+		log.Printf("compact %s: linked to %s", e.URL, source)
+	}
+}
+
+// removeOrphans remove leaf directories of cache roots without meta.json, which only have
+// cached.file or temporary meta, empty parents are removed too
+func (d *DownloadCache) removeOrphans(minAge time.Duration, dryRun bool, report *CompactReport) error {
+	roots := d.cacheRoots()
+	var orphans []string
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() || path == root {
+				return nil
+			}
+			if info.Name() == quarantineDirName {
+				return filepath.SkipDir
+			}
+			for _, r := range roots {
+				if path == r {
+					return filepath.SkipDir // walked separately
+				}
+			}
+			files, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil
+			}
+			orphan := time.Since(info.ModTime()) > minAge
+			for _, f := range files {
+				switch {
+				case f.IsDir(), f.Name() != "cached.file" && f.Name() != "meta.json.tmp":
+					orphan = false // parent of other entries (url layout) or a live entry
+				case time.Since(f.ModTime()) <= minAge:
+					orphan = false // being stored
+				}
+			}
+			if orphan {
+				orphans = append(orphans, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range orphans {
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			report.Reclaimed += f.Size()
+			if !dryRun {
+				if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		report.Orphans++
+		log.Printf("compact: orphaned directory %s", dir)
+		if !dryRun {
+			d.pruneEmptyDirs(dir)
+		}
+	}
+	return nil
+}
+
+func runCompact(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("compact", "[--dry-run] [--min-age 1h] [-d data]")
+	c.register(fs)
+	dryRun := fs.Bool("dry-run", false, "Report space would be reclaimed without changing files")
+	minAge := fs.String("min-age", "1h", "Only remove orphaned directories not modified for this duration")
+	fs.Parse(args)
+	if c.server != "" {
+		return errors.New("compact works on data dir only, it is safe while the server is running")
+	}
+	age, err := parseDuration(*minAge)
+	if err != nil {
+		return err
+	}
+	d, err := c.cache()
+	if err != nil {
+		return err
+	}
+	report, err := d.Compact(age, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "reclaimed"
+	if report.DryRun {
+		verb = "would reclaim"
+	}
+	fmt.Printf("scanned %d entries, linked %d duplicates, removed %d orphaned directories, %s %s\n",
+		report.Scanned, report.Linked, report.Orphans, verb, datasize.ByteSize(report.Reclaimed).HR())
+	return nil
+}
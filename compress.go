@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+// compressibleTypes are content types compressed on the fly, matched by prefix
+var compressibleTypes = []string{
+	"text/plain", "text/html", "text/css", "text/csv", "text/markdown", "text/x-",
+	"application/json", "application/javascript", "application/xml", "application/x-sh",
+	"application/vnd.github", "image/svg+xml",
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return strings.Contains(contentType, "+json") || strings.Contains(contentType, "+xml")
+}
+
+// acceptEncoding return br or gzip if client accepts it, empty otherwise
+func acceptEncoding(r *http.Request) string {
+	accept := r.Header.Get("Accept-Encoding")
+	for _, enc := range []string{"br", "gzip"} {
+		for _, v := range strings.Split(accept, ",") {
+			v = strings.TrimSpace(v)
+			if v == enc || (strings.HasPrefix(v, enc+";") && !strings.HasSuffix(strings.Replace(v, " ", "", -1), "q=0")) {
+				return enc
+			}
+		}
+	}
+	return ""
+}
+
+// compressWriter compress response body if its content type is compressible and not smaller than minSize
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int64
+	method   string
+	enc      io.WriteCloser
+	decided  bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		return
+	}
+	c.decided = true
+	h := c.Header()
+	h.Add("Vary", "Accept-Encoding")
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if code == http.StatusOK && c.method != "HEAD" && h.Get("Content-Encoding") == "" &&
+		isCompressible(h.Get("Content-Type")) && (err != nil || size >= c.minSize) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", c.encoding)
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag) // compressed bytes differ from the strong etag
+		}
+		if c.encoding == "br" {
+			c.enc = brotli.NewWriterLevel(c.ResponseWriter, brotli.DefaultCompression)
+		} else {
+			c.enc, _ = gzip.NewWriterLevel(c.ResponseWriter, gzip.DefaultCompression)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Flush is required by server sent events
+func (c *compressWriter) Flush() {
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReadFrom keep sendfile of http.ServeContent for responses not compressed, eg cached binaries
+func (c *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok && c.decided && c.enc == nil {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c}, r) // hide ReadFrom of c from io.Copy
+}
+
+// Hijack is required by handlers taking over the connection
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := c.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijack is not supported")
+}
+
+func (c *compressWriter) Close() error {
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
+
+// decodeUpstream decompress body of upstream response, so cache always stores identity encoded
+// content and clients never get compressed bytes without Content-Encoding. downloads ask for
+// identity, but some servers compress anyway. length of decoded body is unknown
+func decodeUpstream(res *http.Response) error {
+	var body io.Reader
+	switch enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return errors.Wrap(err, "decode gzip")
+		}
+		body = gz
+	case "deflate":
+		zr, err := zlib.NewReader(res.Body)
+		if err != nil {
+			return errors.Wrap(err, "decode deflate")
+		}
+		body = zr
+	case "br":
+		body = brotli.NewReader(res.Body)
+	default:
+		return errors.Errorf("unsupported content encoding %s", strconv.Quote(enc))
+	}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	// strong etag is of the compressed bytes
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
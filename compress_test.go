@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFromRecorder is a ResponseWriter with ReadFrom, like the one of net/http doing sendfile
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func serveCompressed(contentType string, content []byte) *readFromRecorder {
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cw := &compressWriter{ResponseWriter: rec, encoding: "gzip", minSize: 1, method: "GET"}
+	w := http.ResponseWriter(cw)
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, httptest.NewRequest("GET", "/f", nil), "f", time.Time{}, bytes.NewReader(content))
+	cw.Close()
+	return rec
+}
+
+func TestCompressWriterReadFrom(t *testing.T) {
+	binary := bytes.Repeat([]byte{0, 1, 2}, 1000)
+	rec := serveCompressed("application/octet-stream", binary)
+	if !rec.readFrom || !bytes.Equal(rec.Body.Bytes(), binary) {
+		t.Errorf("binary response: ReadFrom %v, %d bytes", rec.readFrom, rec.Body.Len())
+	}
+
+	text := strings.Repeat("hello ", 1000)
+	rec = serveCompressed("text/plain", []byte(text))
+	if rec.readFrom || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("text response: ReadFrom %v, Content-Encoding %q", rec.readFrom, rec.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(gz); string(data) != text {
+		t.Errorf("decompressed %d bytes, want %d", len(data), len(text))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Config is loaded from file specified by -config, eg
+//
+//	{
+//	  "rules": [
+//	    {"pattern": "^/private-org/", "upstream": "https://github.com/", "forward_auth": true},
+//	    {"host": "raw.corp", "pattern": "^/", "upstream": "https://raw.githubusercontent.com/"},
+//	    {"pattern": "^/", "upstream": "https://github.com/"}
+//	  ],
+//	  "watch": [{"repo": "cli/cli", "assets": ["*_linux_amd64.tar.gz"]}]
+//	}
+type Config struct {
+	Rules    []RuleConfig      `json:"rules"`
+	Watch    []WatchConfig     `json:"watch"`    // repos whose new releases are cached automatically
+	Schedule map[string]string `json:"schedule"` // task -> cron expression, eg {"clean": "0 3 * * *"}
+	Eviction string            `json:"eviction"` // lru, lfu, size or age
+	LDAP     *LDAPConfig       `json:"ldap"`     // dashboard users log in with ldap accounts
+}
+
+type RuleConfig struct {
+	Host        string   `json:"host"`         // request Host, *.example.com for subdomains, empty for any host
+	Pattern     string   `json:"pattern"`      // regexp matched against request path
+	Upstream    string   `json:"upstream"`     // url prefix
+	Mirrors     []string `json:"mirrors"`      // alternative url prefixes of upstream, the fastest one is used
+	ForwardAuth bool     `json:"forward_auth"` // forward client Authorization header, such responses are not cached
+	TTL         string   `json:"ttl"`          // override -ttl, eg 10m, 7d
+	CacheDir    string   `json:"cache_dir"`    // store files of this rule in another dir, relative to -d if not absolute
+	Keep        string   `json:"keep"`         // override -keep, eg 30d
+	MaxSize     string   `json:"max_size"`     // override -max-size, eg 2GB
+	Query       string   `json:"query"`        // query string in cache key, keep (default) or strip
+	StripParams []string `json:"strip_params"` // query params not in cache key, eg X-Amz-Signature
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	return cfg, nil
+}
+
+// MirrorRules compile rules, return nil if no rules configured
+func (c *Config) MirrorRules() ([]MirrorRule, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	rules := make([]MirrorRule, 0, len(c.Rules))
+	for _, rc := range c.Rules {
+		pattern, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule pattern %s", rc.Pattern)
+		}
+		if rc.Upstream == "" {
+			return nil, errors.Errorf("rule %s: upstream is required", rc.Pattern)
+		}
+		rule := MirrorRule{
+			Host:        strings.ToLower(rc.Host),
+			Pattern:     pattern,
+			URLPrefix:   rc.Upstream,
+			Upstreams:   append([]string{rc.Upstream}, rc.Mirrors...),
+			ForwardAuth: rc.ForwardAuth,
+			CacheDir:    rc.CacheDir,
+			Query:       rc.Query,
+			StripParams: rc.StripParams,
+		}
+		if rc.Query != "" && rc.Query != QueryKeep && rc.Query != QueryStrip {
+			return nil, errors.Errorf("rule %s: query must be keep or strip", rc.Pattern)
+		}
+		if rc.TTL != "" {
+			if rule.TTL, err = parseDuration(rc.TTL); err != nil {
+				return nil, errors.Wrapf(err, "rule %s ttl", rc.Pattern)
+			}
+		}
+		if rc.Keep != "" {
+			if rule.Keep, err = parseDuration(rc.Keep); err != nil {
+				return nil, errors.Wrapf(err, "rule %s keep", rc.Pattern)
+			}
+		}
+		if rc.MaxSize != "" {
+			if rule.MaxSize, err = parseSize(rc.MaxSize); err != nil {
+				return nil, errors.Wrapf(err, "rule %s max_size", rc.Pattern)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// applyConfig load config file into d
+func (d *DownloadCache) applyConfig(filename string) error {
+	cfg, err := LoadConfig(filename)
+	if err != nil {
+		return err
+	}
+	return d.setConfig(cfg)
+}
+
+// liveConfig is the part of config applied without restart
+type liveConfig struct {
+	rules    []MirrorRule
+	eviction EvictionPolicy
+	watcher  *Watcher
+	ldap     *LDAP
+	schedule map[string]string
+}
+
+// setConfig apply cfg to d, rules of d.Presets are installed around rules of cfg.
+// nothing is changed if cfg is invalid
+func (d *DownloadCache) setConfig(cfg *Config) error {
+	lc, err := d.prepareConfig(cfg)
+	if err != nil {
+		return err
+	}
+	d.applyLive(lc)
+	return nil
+}
+
+// prepareConfig validate cfg and build what applyLive install, d is not changed
+func (d *DownloadCache) prepareConfig(cfg *Config) (*liveConfig, error) {
+	rules, err := cfg.MirrorRules()
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = DefaultMirrorRules()
+	}
+	if rules, err = withPresets(rules, d.Presets); err != nil {
+		return nil, err
+	}
+	eviction := d.eviction()
+	if cfg.Eviction != "" {
+		if eviction, err = ParseEvictionPolicy(cfg.Eviction); err != nil {
+			return nil, err
+		}
+	}
+	var watcher *Watcher
+	if len(cfg.Watch) > 0 {
+		if watcher, err = NewWatcher(cfg.Watch); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSchedule(cfg.Schedule); err != nil {
+		return nil, err
+	}
+	var l *LDAP
+	if cfg.LDAP != nil {
+		if l, err = NewLDAP(*cfg.LDAP); err != nil {
+			return nil, err
+		}
+	}
+	return &liveConfig{rules: rules, eviction: eviction, watcher: watcher, ldap: l, schedule: cfg.Schedule}, nil
+}
+
+// applyLive replace rules, eviction, watch list, ldap and schedule of d
+func (d *DownloadCache) applyLive(lc *liveConfig) {
+	d.liveMu.Lock()
+	d.Rules, d.Eviction, d.watcher, d.ldap = lc.rules, lc.eviction, lc.watcher, lc.ldap
+	d.schedule = lc.schedule
+	d.liveMu.Unlock()
+}
+
+// rules return current mirror rules, setConfig replace the slice and never modify it
+func (d *DownloadCache) rules() []MirrorRule {
+	d.liveMu.RLock()
+	defer d.liveMu.RUnlock()
+	return d.Rules
+}
+
+// eviction return current eviction policy
+func (d *DownloadCache) eviction() EvictionPolicy {
+	d.liveMu.RLock()
+	defer d.liveMu.RUnlock()
+	return d.Eviction
+}
+
+// currentWatcher return watcher of current config, nil if no repo is watched
+func (d *DownloadCache) currentWatcher() *Watcher {
+	d.liveMu.RLock()
+	defer d.liveMu.RUnlock()
+	return d.watcher
+}
+
+// currentLDAP return ldap of current config, nil if not configured
+func (d *DownloadCache) currentLDAP() *LDAP {
+	d.liveMu.RLock()
+	defer d.liveMu.RUnlock()
+	return d.ldap
+}
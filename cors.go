@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS config for file responses
+type CORS struct {
+	AllowOrigins []string // "*" to allow all
+	AllowMethods string
+	AllowHeaders string
+	MaxAge       string
+}
+
+func NewCORS(origins string) *CORS {
+	return &CORS{
+		AllowOrigins: splitComma(origins),
+		AllowMethods: "GET, HEAD, OPTIONS",
+		AllowHeaders: "Range, If-None-Match, If-Modified-Since",
+		MaxAge:       "86400",
+	}
+}
+
+func (c *CORS) allowOrigin(origin string) string {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// WriteHeaders set Access-Control-* headers, return false if origin not allowed
+func (c *CORS) WriteHeaders(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	allowed := c.allowOrigin(origin)
+	if allowed == "" {
+		return false
+	}
+	h := w.Header()
+	if allowed != "*" {
+		h.Add("Vary", "Origin")
+	}
+	h.Set("Access-Control-Allow-Origin", allowed)
+	h.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Content-Disposition, X-Cache, Age")
+	if r.Method == "OPTIONS" {
+		h.Set("Access-Control-Allow-Methods", c.AllowMethods)
+		h.Set("Access-Control-Allow-Headers", c.AllowHeaders)
+		h.Set("Access-Control-Max-Age", c.MaxAge)
+	}
+	return true
+}
+
+// Preflight handle OPTIONS request, return true if request is handled
+func (c *CORS) Preflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	if !c.WriteHeaders(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return true
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davTreeTTL is how long the tree of cached files is reused, webdav clients send many PROPFIND at once
+const davTreeTTL = 10 * time.Second
+
+// davNode is a directory or a cached file in webdav tree
+type davNode struct {
+	name     string
+	entry    *Entry // nil for directory
+	children map[string]*davNode
+	modTime  time.Time
+	size     int64 // total size of files in directory
+	files    int   // number of files in directory
+}
+
+// davPath return human readable path of url, like -layout url: host/path, query is appended as @hash
+func davPath(rawurl string) []string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	parts := []string{strings.Replace(u.Host, ":", "_", -1)}
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg != "" && seg != "." && seg != ".." {
+			parts = append(parts, seg)
+		}
+	}
+	if len(parts) < 2 {
+		return nil
+	}
+	if u.RawQuery != "" {
+		parts[len(parts)-1] += "@" + HashString(u.RawQuery)[:8]
+	}
+	return parts
+}
+
+func buildDavTree(entries []Entry) *davNode {
+	root := &davNode{children: make(map[string]*davNode)}
+	for i := range entries {
+		e := &entries[i]
+		parts := davPath(e.URL)
+		if parts == nil {
+			continue
+		}
+		node := root
+		for _, name := range parts {
+			child := node.children[name]
+			if child == nil {
+				child = &davNode{name: name, children: make(map[string]*davNode)}
+				node.children[name] = child
+			}
+			node = child
+		}
+		node.entry = e
+		node.modTime = time.Unix(e.Time, 0)
+		node.size, node.files = e.Size, 1
+	}
+	root.fixup()
+	return root
+}
+
+// fixup move files which are also a directory (eg /a and /a/b cached) to name~,
+// and sum up directories: mtime of the newest file, total size and number of files
+func (n *davNode) fixup() {
+	for name, child := range n.children {
+		if child.entry != nil && len(child.children) > 0 {
+			n.children[name+"~"] = &davNode{name: name + "~", entry: child.entry, modTime: child.modTime,
+				size: child.size, files: 1}
+			child.entry, child.size, child.files = nil, 0, 0
+		}
+	}
+	for _, child := range n.children {
+		if child.entry == nil {
+			child.fixup()
+		}
+		if child.modTime.After(n.modTime) {
+			n.modTime = child.modTime
+		}
+		n.size += child.size
+		n.files += child.files
+	}
+}
+
+// davFS is a read-only webdav.FileSystem of cached files
+type davFS struct {
+	d *DownloadCache
+
+	mu      sync.Mutex
+	root    *davNode
+	builtAt time.Time
+}
+
+func (fs *davFS) tree() (*davNode, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.root != nil && time.Since(fs.builtAt) < davTreeTTL {
+		return fs.root, nil
+	}
+	entries, err := fs.d.Entries()
+	if err != nil {
+		return nil, err
+	}
+	fs.root, fs.builtAt = buildDavTree(entries), time.Now()
+	return fs.root, nil
+}
+
+func (fs *davFS) find(name string) (*davNode, error) {
+	node, err := fs.tree()
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if node = node.children[part]; node == nil {
+			return nil, os.ErrNotExist
+		}
+	}
+	return node, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := fs.find(name)
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{node}, nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	node, err := fs.find(name)
+	if err != nil {
+		return nil, err
+	}
+	if node.entry == nil {
+		return &davDir{node: node}, nil
+	}
+	f, err := os.Open(filepath.Join(node.entry.Dir, "cached.file"))
+	if err != nil {
+		return nil, err
+	}
+	return davFile{File: f, node: node}, nil
+}
+
+// davInfo is os.FileInfo of davNode, content type and etag are taken from meta
+type davInfo struct {
+	node *davNode
+}
+
+func (i davInfo) Name() string       { return i.node.name }
+func (i davInfo) ModTime() time.Time { return i.node.modTime }
+func (i davInfo) IsDir() bool        { return i.node.entry == nil }
+func (i davInfo) Sys() interface{}   { return nil }
+
+func (i davInfo) Size() int64 {
+	if i.node.entry == nil {
+		return 0
+	}
+	return i.node.entry.Size
+}
+
+func (i davInfo) Mode() os.FileMode {
+	if i.node.entry == nil {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.node.entry != nil && i.node.entry.Header["Content-Type"] != "" {
+		return i.node.entry.Header["Content-Type"], nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+func (i davInfo) ETag(ctx context.Context) (string, error) {
+	if i.node.entry != nil && i.node.entry.SHA256 != "" {
+		return `"` + i.node.entry.SHA256 + `"`, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+// davFile is a cached file, opened read-only
+type davFile struct {
+	*os.File
+	node *davNode
+}
+
+func (f davFile) Stat() (os.FileInfo, error) {
+	return davInfo{f.node}, nil
+}
+
+// davDir is a directory of webdav tree
+type davDir struct {
+	node *davNode
+	pos  int
+}
+
+func (d *davDir) Close() error { return nil }
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		d.pos = 0
+		return 0, nil
+	}
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return davInfo{d.node}, nil
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	names := make([]string, 0, len(d.node.children))
+	for name := range d.node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if d.pos >= len(names) && count > 0 {
+		return nil, io.EOF
+	}
+	names = names[d.pos:]
+	if count > 0 && len(names) > count {
+		names = names[:count]
+	}
+	d.pos += len(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, davInfo{d.node.children[name]})
+	}
+	return infos, nil
+}
+
+// newDavHandler serve cache read-only over webdav under prefix, eg for mounting as a windows drive
+func (d *DownloadCache) newDavHandler(prefix string) http.HandlerFunc {
+	fs, ls := d.files, webdav.NewMemLS()
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS", "PROPFIND", "GET", "HEAD":
+			// hrefs in PROPFIND responses must include -base-path, which is stripped from request
+			h := &webdav.Handler{Prefix: d.BasePath + prefix, FileSystem: fs, LockSystem: ls}
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = d.BasePath + r.URL.Path
+			h.ServeHTTP(w, r2)
+		default:
+			w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+			http.Error(w, "read-only webdav", http.StatusMethodNotAllowed)
+		}
+	}
+}
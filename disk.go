@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/pkg/errors"
+)
+
+// ErrInsufficientStorage is returned when free disk space would drop below MinFree
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// ensureFreeSpace make sure root has MinFree bytes left after storing size bytes,
+// entries on the same root are evicted by Eviction policy if needed
+func (d *DownloadCache) ensureFreeSpace(root string, size int64) error {
+	if d.MinFree <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	free, err := diskFree(root)
+	if err != nil {
+		return errors.Wrap(err, "check free space")
+	}
+	need := d.MinFree + size - free
+	if need <= 0 {
+		return nil
+	}
+	if freed := d.evict(root, need); freed < need {
+		return errors.Wrapf(ErrInsufficientStorage, "%s free on %s, need %s more",
+			datasize.ByteSize(free+freed).HR(), root, datasize.ByteSize(need-freed).HR())
+	}
+	return nil
+}
+
+// evict remove entries under root in order of Eviction policy until size bytes freed, pinned entries are kept
+func (d *DownloadCache) evict(root string, size int64) (freed int64) {
+	entries, _ := d.Entries()
+	sortForEviction(entries, d.eviction())
+	d.pins.reloadIfChanged()
+	root = filepath.Clean(root)
+	for _, e := range entries {
+		if freed >= size {
+			break
+		}
+		if d.rootOf(e.Dir) != root || d.pins.Match(e.URL) || d.keptByTag(e.Meta) {
+			continue
+		}
+		d.mu.Lock()
+		busy := d.workers[d.entryHash(e.URL)]
+		d.mu.Unlock()
+		if busy {
+			continue // refreshing
+		}
+		log.Println("evict for space", e.URL)
+		if d.removeEntry(e.Dir) == nil {
+			freed += e.Size
+			d.events.Publish(Event{Type: EventEvict, Hash: d.entryHash(e.URL), URL: e.URL})
+		}
+	}
+	return freed
+}
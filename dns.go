@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upstreamResolver look up addresses of upstream hosts
+// order: static hosts, DNS-over-HTTPS, dns server (or system resolver)
+type upstreamResolver struct {
+	Hosts    map[string][]string // host -> ips
+	DoHURL   string              // eg https://1.1.1.1/dns-query, json api
+	resolver *net.Resolver
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohAnswer
+}
+
+type dohAnswer struct {
+	ips     []string
+	expires time.Time
+}
+
+// hostsFlag collect repeated -resolve host=ip[,ip] flags
+type hostsFlag map[string][]string
+
+func (h hostsFlag) String() string {
+	return ""
+}
+
+func (h hostsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid resolve %s, must be host=ip", strconv.Quote(s))
+	}
+	for _, ip := range splitComma(parts[1]) {
+		if net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid ip %s of %s", strconv.Quote(ip), parts[0])
+		}
+		h[strings.ToLower(parts[0])] = append(h[strings.ToLower(parts[0])], ip)
+	}
+	return nil
+}
+
+// SetUpstreamResolver make upstream connections resolve hosts with static hosts, DoH or dns server
+// dnsServer is host:port, port 53 is used if omitted
+func SetUpstreamResolver(hosts map[string][]string, dohURL, dnsServer string) error {
+	if len(hosts) == 0 && dohURL == "" && dnsServer == "" {
+		return nil
+	}
+	r := &upstreamResolver{Hosts: hosts, DoHURL: dohURL, cache: make(map[string]dohAnswer)}
+	if dohURL != "" {
+		u, err := url.Parse(dohURL)
+		if err != nil || u.Scheme != "https" {
+			return errors.Errorf("invalid dns-over-https url %s", strconv.Quote(dohURL))
+		}
+		// own transport, so resolving the DoH server does not go through ourself
+		r.client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) { return upstreamTransport.Proxy(req) },
+		}}
+	}
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return upstreamDialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+	upstreamTransport.DialContext = r.DialContext
+	return nil
+}
+
+// DialContext resolve host of addr and try its ips in order
+func (r *upstreamResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return upstreamDialer.DialContext(ctx, network, addr)
+	}
+	ips, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = upstreamDialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (r *upstreamResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := r.Hosts[host]; ok {
+		return ips, nil
+	}
+	if r.DoHURL != "" {
+		return r.lookupDoH(ctx, host)
+	}
+	if r.resolver != nil {
+		return r.resolver.LookupHost(ctx, host)
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// lookupDoH query A and AAAA records with the json api of DNS-over-HTTPS (cloudflare, google)
+// answers are cached by their ttl
+func (r *upstreamResolver) lookupDoH(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	ans, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(ans.expires) {
+		return ans.ips, nil
+	}
+
+	ans = dohAnswer{expires: time.Now().Add(time.Hour)}
+	for _, qtype := range []string{"A", "AAAA"} {
+		ips, ttl, err := r.queryDoH(ctx, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		ans.ips = append(ans.ips, ips...)
+		if len(ips) > 0 && time.Now().Add(ttl).Before(ans.expires) {
+			ans.expires = time.Now().Add(ttl)
+		}
+	}
+	if len(ans.ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.DoHURL, IsNotFound: true}
+	}
+	r.mu.Lock()
+	r.cache[host] = ans
+	r.mu.Unlock()
+	return ans.ips, nil
+}
+
+func (r *upstreamResolver) queryDoH(ctx context.Context, host, qtype string) ([]string, time.Duration, error) {
+	u, _ := url.Parse(r.DoHURL)
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", qtype)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "dns-over-https")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, errors.Errorf("dns-over-https: %s", resp.Status)
+	}
+	var result struct {
+		Answer []struct {
+			Type int    `json:"type"`
+			TTL  int    `json:"TTL"`
+			Data string `json:"data"`
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, errors.Wrap(err, "dns-over-https")
+	}
+	var ips []string
+	ttl := time.Hour
+	for _, a := range result.Answer {
+		if a.Type != 1 && a.Type != 28 { // A, AAAA, skip CNAME
+			continue
+		}
+		if net.ParseIP(a.Data) == nil {
+			continue
+		}
+		ips = append(ips, a.Data)
+		if d := time.Duration(a.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ips, ttl, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	EventStart    = "start"
+	EventProgress = "progress"
+	EventFinish   = "finish"
+	EventEvict    = "evict"
+)
+
+type Event struct {
+	Type     string `json:"type"`
+	Hash     string `json:"hash"`
+	URL      string `json:"url"`
+	Filename string `json:"filename,omitempty"`
+	Copied   int    `json:"copied,omitempty"`
+	Total    int    `json:"total,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+// eventHub broadcast events to subscribers, slow subscribers miss events instead of blocking
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]bool
+}
+
+func (h *eventHub) Subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan Event]bool)
+	}
+	ch := make(chan Event, 64)
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *eventHub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+func (h *eventHub) Publish(e Event) {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishProgress publish progress of st every interval until done closed
+func (h *eventHub) publishProgress(hash string, st *Status, interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			h.Publish(Event{Type: EventProgress, Hash: hash, URL: st.URL, Filename: st.Filename,
+				Copied: st.Copied, Total: st.Total})
+		}
+	}
+}
+
+// handleAPIEvents stream events as Server-Sent Events
+func (d *DownloadCache) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	ch := d.events.Subscribe()
+	defer d.events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// dashboardScript update download progress with events
+const dashboardScript = `<script>
+var es = new EventSource("_api/events");
+function fmt(n) {
+  var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(1) + " " + units[i];
+}
+es.addEventListener("progress", function(e) {
+  var ev = JSON.parse(e.data), li = document.getElementById(ev.hash);
+  if (!li) return;
+  var percent = ev.total > 0 ? (ev.copied * 100 / ev.total).toFixed(1) : "0.0";
+  li.querySelector("span").textContent = percent + "% - " + fmt(ev.copied) + " / " + fmt(ev.total || 0);
+});
+es.addEventListener("start", function() { location.reload(); });
+es.addEventListener("finish", function() { location.reload(); });
+</script>`
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EvictionPolicy decide which entries are evicted first when disk space is needed
+type EvictionPolicy interface {
+	// Before report whether a should be evicted before b
+	Before(a, b Entry) bool
+}
+
+// lruPolicy evict least recently accessed first, good for a general download proxy
+type lruPolicy struct{}
+
+func (lruPolicy) Before(a, b Entry) bool {
+	return a.AccessTime.Before(b.AccessTime)
+}
+
+// lfuPolicy evict least frequently downloaded first, good for CI mirrors downloading the same files again and again
+type lfuPolicy struct{}
+
+func (lfuPolicy) Before(a, b Entry) bool {
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.AccessTime.Before(b.AccessTime)
+}
+
+// sizePolicy evict large and idle entries first, a few big files make room for many small ones
+type sizePolicy struct{}
+
+func (sizePolicy) Before(a, b Entry) bool {
+	return sizeScore(a) > sizeScore(b)
+}
+
+// sizeScore is bytes times idle seconds, divided by hits
+func sizeScore(e Entry) float64 {
+	idle := time.Since(e.AccessTime).Seconds() + 1
+	return float64(e.Size) * idle / float64(1+e.Hits)
+}
+
+// agePolicy evict entries cached earliest first (FIFO), regardless of access
+type agePolicy struct{}
+
+func (agePolicy) Before(a, b Entry) bool {
+	return a.Time < b.Time
+}
+
+var evictionPolicies = map[string]EvictionPolicy{
+	"lru":  lruPolicy{},
+	"lfu":  lfuPolicy{},
+	"size": sizePolicy{},
+	"age":  agePolicy{},
+}
+
+// ParseEvictionPolicy return policy by name: lru, lfu, size or age
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	if name == "" {
+		return lruPolicy{}, nil
+	}
+	policy, ok := evictionPolicies[name]
+	if !ok {
+		return nil, errors.Errorf("invalid eviction policy %s, must be lru, lfu, size or age", strconv.Quote(name))
+	}
+	return policy, nil
+}
+
+// sortForEviction order entries by policy, the first is evicted first
+func sortForEviction(entries []Entry, policy EvictionPolicy) {
+	if policy == nil {
+		policy = lruPolicy{}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return policy.Before(entries[i], entries[j])
+	})
+}
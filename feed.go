@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// atom feed, only elements used by feed readers are included
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Link    []atomLink `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+// handleFeed serve atom feed of recently cached files, so teams can subscribe to new tool versions
+// query: limit=50
+func (d *DownloadCache) handleFeed(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v, err := strconv.Atoi(r.FormValue("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	entries, err := d.Entries()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sortEntries(entries, "time")
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	base := d.mirrorBaseURL(r)
+	feed := atomFeed{
+		ID:      base + "/_feed.atom",
+		Title:   "Github Mirror: recently cached files",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    []atomLink{{Href: base + "/_feed.atom", Rel: "self"}, {Href: base + "/"}},
+	}
+	if len(entries) > 0 {
+		feed.Updated = time.Unix(entries[0].Time, 0).UTC().Format(time.RFC3339)
+	}
+	for _, e := range entries {
+		entry := atomEntry{
+			ID:      fmt.Sprintf("urn:github-mirror:%s:%d", HashString(e.URL), e.Time), // new id when refreshed
+			Title:   e.Filename,
+			Updated: time.Unix(e.Time, 0).UTC().Format(time.RFC3339),
+			Summary: fmt.Sprintf("%s, %s, source %s", e.Filename, datasize.ByteSize(e.Size).HR(), e.URL),
+			Link:    []atomLink{{Href: e.URL, Rel: "via"}},
+		}
+		if link := d.mirrorURLOf(r, e.URL); link != "" {
+			entry.Link = append(entry.Link, atomLink{Href: link})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// gitPattern match git smart http requests, eg /owner/repo.git/info/refs?service=git-upload-pack
+var gitPattern = regexp.MustCompile(`^/[^/]+/[^/]+/(info/refs|git-upload-pack)$`)
+
+// maxPackRequest is the max size of git-upload-pack request body
+const maxPackRequest = 32 << 20
+
+// cacheablePackRequest report whether upload-pack request is a fresh clone,
+// which has wanted refs but nothing already in client, so the packfile only depends on request
+func cacheablePackRequest(body []byte) bool {
+	return bytes.Contains(body, []byte("want ")) && !bytes.Contains(body, []byte("have "))
+}
+
+// serveGit proxy git smart http, ref advertisement is never cached,
+// packfiles of fresh clones are cached keyed by the wanted refs
+func (d *DownloadCache) serveGit(w http.ResponseWriter, r *http.Request, rule *MirrorRule, url string) {
+	header := http.Header{}
+	if v := r.Header.Get("Git-Protocol"); v != "" {
+		header.Set("Git-Protocol", v)
+	}
+	private := false
+	if auth := r.Header.Get("Authorization"); rule.ForwardAuth && auth != "" {
+		header.Set("Authorization", auth)
+		private = true
+	}
+	if r.Method != "POST" {
+		d.passThrough(w, r, url, header)
+		return
+	}
+
+	var reader io.Reader = io.LimitReader(r.Body, maxPackRequest)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reader = gz
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if private || !cacheablePackRequest(body) {
+		res, err := uploadPack(r, url, body, header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Cache", CacheBypass)
+		w.WriteHeader(res.StatusCode)
+		if _, err := io.Copy(w, res.Body); err != nil {
+			logWarnf("git-upload-pack %s: %v", url, err)
+		}
+		return
+	}
+
+	sum := sha256.Sum256(append([]byte(header.Get("Git-Protocol")+"\n"), body...))
+	key := url + "#" + hex.EncodeToString(sum[:])
+	cacheStatus, err := d.generateOnce(key, func() error {
+		return d.fetchPack(r, url, key, body, header)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	countCacheStatus(cacheStatus)
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	d.ServeFile(w, r, key)
+}
+
+// generateOnce call generate if key is not cached, concurrent calls of the same key wait for the first one
+func (d *DownloadCache) generateOnce(key string, generate func() error) (string, error) {
+	if d.IsCached(key) {
+		return CacheHit, nil
+	}
+	hash := HashString(key)
+	d.mu.Lock()
+	if d.workers[hash] {
+		waitChan := d.unsafeAddWaiter(hash)
+		d.mu.Unlock()
+		return CacheWait, <-waitChan
+	}
+	d.workers[hash] = true
+	d.mu.Unlock()
+	err := generate()
+	d.unlockWorker(hash, err)
+	return CacheMiss, err
+}
+
+// fetchPack save packfile response of upload-pack request as cache of key
+func (d *DownloadCache) fetchPack(r *http.Request, url, key string, body []byte, header http.Header) error {
+	res, err := uploadPack(r, url, body, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &UpstreamError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	log.Println("cache packfile", url)
+	_, err = d.store(key, "git-upload-pack", res.Body, nil, "")
+	return errors.Wrap(err, "store packfile")
+}
+
+func uploadPack(r *http.Request, url string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := newUpstreamRequest(r.Context(), "POST", url)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	return upstreamClient.Do(req)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GitHubAPI is base url of github rest api
+var GitHubAPI = "https://api.github.com"
+
+// ReleaseCacheTTL is how long api responses of releases are cached in memory
+var ReleaseCacheTTL = 10 * time.Minute
+
+type Release struct {
+	TagName     string         `json:"tag_name"`
+	Name        string         `json:"name"`
+	Prerelease  bool           `json:"prerelease"`
+	PublishedAt time.Time      `json:"published_at"`
+	Assets      []ReleaseAsset `json:"assets"`
+}
+
+type ReleaseAsset struct {
+	Name               string `json:"name"`
+	Size               int64  `json:"size"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+	Cached             bool   `json:"cached"` // filled by mirror, whether asset is in cache
+}
+
+type apiCacheEntry struct {
+	time time.Time
+	data []byte
+}
+
+// apiCache keep github api responses in memory for ReleaseCacheTTL
+type apiCache struct {
+	mu      sync.Mutex
+	entries map[string]apiCacheEntry
+}
+
+var githubAPICache = &apiCache{entries: make(map[string]apiCacheEntry)}
+
+// githubGet decode json of github api path into v, responses are cached
+// expired responses are used when rate limit is reached
+func githubGet(ctx context.Context, apiPath string, v interface{}) error {
+	c := githubAPICache
+	c.mu.Lock()
+	e, ok := c.entries[apiPath]
+	c.mu.Unlock()
+	if !ok || time.Since(e.time) > ReleaseCacheTTL {
+		data, err := githubFetch(ctx, apiPath)
+		if errors.Is(err, ErrRateLimited) && ok {
+			logWarnf("%s: %v, use response of %s ago", apiPath, err, time.Since(e.time).Round(time.Second))
+			return errors.Wrap(json.Unmarshal(e.data, v), apiPath)
+		}
+		if err != nil {
+			return err
+		}
+		e = apiCacheEntry{time: time.Now(), data: data}
+		c.mu.Lock()
+		c.entries[apiPath] = e
+		c.mu.Unlock()
+	}
+	return errors.Wrap(json.Unmarshal(e.data, v), apiPath)
+}
+
+func githubFetch(ctx context.Context, apiPath string) ([]byte, error) {
+	if err := githubRateLimiter.Wait(ctx, "core"); err != nil {
+		return nil, err
+	}
+	req, err := newUpstreamRequest(ctx, "GET", GitHubAPI+apiPath)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	githubRateLimiter.Update("core", res)
+	if (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests) &&
+		(res.Header.Get("X-RateLimit-Remaining") == "0" || res.Header.Get("Retry-After") != "") {
+		return nil, errors.Wrap(ErrRateLimited, res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// latestRelease return latest release of owner/repo
+func latestRelease(ctx context.Context, repo string) (*Release, error) {
+	release := &Release{}
+	if err := githubGet(ctx, "/repos/"+repo+"/releases/latest", release); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// listReleases return recent releases of owner/repo, newest first
+func listReleases(ctx context.Context, repo string) ([]Release, error) {
+	releases := make([]Release, 0)
+	if err := githubGet(ctx, "/repos/"+repo+"/releases?per_page=100", &releases); err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+// findAsset return first asset whose name matches glob pattern
+func (r *Release) findAsset(pattern string) *ReleaseAsset {
+	for i, a := range r.Assets {
+		if ok, _ := path.Match(pattern, a.Name); ok {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+// latestAssetPattern match /owner/repo/latest/asset-name, asset name can be a glob pattern
+var latestAssetPattern = regexp.MustCompile(`^/([^/]+)/([^/]+)/latest/([^/]+)$`)
+
+// resolveLatestAsset rewrite /owner/repo/latest/asset to download path of latest release
+// eg /owner/repo/releases/download/v1.2.0/asset
+func resolveLatestAsset(ctx context.Context, p string) (string, error) {
+	m := latestAssetPattern.FindStringSubmatch(p)
+	release, err := latestRelease(ctx, m[1]+"/"+m[2])
+	if err != nil {
+		return "", err
+	}
+	asset := release.findAsset(m[3])
+	if asset == nil {
+		return "", &UpstreamError{StatusCode: http.StatusNotFound,
+			Status: "404 no asset matches " + m[3] + " in release " + release.TagName}
+	}
+	return "/" + m[1] + "/" + m[2] + "/releases/download/" + release.TagName + "/" + asset.Name, nil
+}
+
+// withPath return shallow copy of request with path replaced
+func withPath(r *http.Request, p string) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	r2.RequestURI = r2.URL.RequestURI()
+	return r2
+}
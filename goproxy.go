@@ -0,0 +1,19 @@
+package main
+
+import (
+	"regexp"
+)
+
+// GoProxyURL is the public go module proxy, it also proxies the checksum database at /sumdb/sum.golang.org/
+const GoProxyURL = "https://proxy.golang.org/"
+
+// GoProxyRules return rules mirroring go module proxy and checksum database, for GOPROXY=http://mirror:8000
+// paths of the go proxy protocol never collide with github, they contain /@v/, /@latest or start with /sumdb/
+func GoProxyRules() []MirrorRule {
+	return []MirrorRule{
+		{Pattern: regexp.MustCompile(`^/sumdb/sum\.golang\.org/(latest|supported)$`), URLPrefix: GoProxyURL, TTL: mutableTTL},
+		{Pattern: regexp.MustCompile(`^/sumdb/sum\.golang\.org/(lookup|tile)/`), URLPrefix: GoProxyURL, TTL: immutableTTL},
+		{Pattern: regexp.MustCompile(`^/.+/@(v/list|latest)$`), URLPrefix: GoProxyURL, TTL: mutableTTL},
+		{Pattern: regexp.MustCompile(`^/.+/@v/[^/]+\.(info|mod|zip)$`), URLPrefix: GoProxyURL, TTL: immutableTTL},
+	}
+}
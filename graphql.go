@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// GraphQLCacheTTL is how long graphql query responses are cached in memory, 0 to disable caching
+var GraphQLCacheTTL = time.Minute
+
+var graphqlCache = &apiCache{entries: make(map[string]apiCacheEntry)}
+
+type graphqlRequest struct {
+	Query         string          `json:"query"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	OperationName string          `json:"operationName,omitempty"`
+}
+
+// graphqlCacheKey hash query with variables, authorization is included so users never see
+// responses of each other
+func graphqlCacheKey(auth string, q graphqlRequest) string {
+	var variables bytes.Buffer
+	json.Compact(&variables, q.Variables)
+	h := sha256.New()
+	for _, s := range []string{auth, q.Query, variables.String(), q.OperationName} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// graphqlMutationPattern match a mutation operation, at start of document or after another operation
+var graphqlMutationPattern = regexp.MustCompile(`(^|\})\s*mutation\b`)
+
+// handleGraphQL proxy POST /graphql to github graphql api, successful query responses are cached
+// for GraphQLCacheTTL. client Authorization is forwarded, otherwise -header of mirror is used
+func (d *DownloadCache) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed, POST a graphql query", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.Offline {
+		http.Error(w, ErrOffline.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var q graphqlRequest
+	if err := json.Unmarshal(body, &q); err != nil || q.Query == "" {
+		http.Error(w, "invalid graphql request, expect json with query", http.StatusBadRequest)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	key := graphqlCacheKey(auth, q)
+	cacheable := GraphQLCacheTTL > 0 && !graphqlMutationPattern.MatchString(q.Query)
+	var cached apiCacheEntry
+	if cacheable {
+		graphqlCache.mu.Lock()
+		cached = graphqlCache.entries[key]
+		graphqlCache.mu.Unlock()
+		if cached.data != nil && time.Since(cached.time) < GraphQLCacheTTL {
+			writeGraphQLCached(w, cached, CacheHit)
+			return
+		}
+	}
+	// near rate limit, serve expired response if any. clients with own token have own limit
+	resource := "graphql"
+	if auth != "" {
+		resource += ":" + HashString(auth)[:12]
+	}
+	if err := githubRateLimiter.Wait(r.Context(), resource); err != nil {
+		if cached.data != nil {
+			writeGraphQLCached(w, cached, CacheStale)
+			return
+		}
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	req, err := newUpstreamRequest(r.Context(), "POST", GitHubAPI+"/graphql")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	githubRateLimiter.Update(resource, res)
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	// responses with errors (eg rate limited) are not cached
+	var result struct {
+		Errors json.RawMessage `json:"errors"`
+	}
+	if cacheable && res.StatusCode == http.StatusOK && json.Unmarshal(data, &result) == nil && result.Errors == nil {
+		graphqlCache.set(key, data, GraphQLCacheTTL)
+	}
+	for _, key := range []string{"Content-Type", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"} {
+		if v := res.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.Header().Set("X-Cache", CacheMiss)
+	w.WriteHeader(res.StatusCode)
+	w.Write(data)
+}
+
+func writeGraphQLCached(w http.ResponseWriter, e apiCacheEntry, cacheStatus string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Header().Set("Age", strconv.FormatInt(int64(time.Since(e.time).Seconds()), 10))
+	w.Write(e.data)
+}
+
+// set store data, entries older than ttl are dropped when cache grows
+func (c *apiCache) set(key string, data []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= 1000 {
+		for k, e := range c.entries {
+			if time.Since(e.time) > ttl {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = apiCacheEntry{time: time.Now(), data: data}
+}
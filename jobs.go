@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	jobsBucket    = []byte("jobs")
+	jobKeysBucket = []byte("job_keys") // kind and arg of active jobs -> id, so a job is queued only once
+)
+
+// kinds of jobs
+const (
+	JobDownload = "download" // arg: upstream url, waits for -off-peak
+	JobSidecars = "sidecars" // arg: url of release asset whose checksums and signatures are cached
+	JobSync     = "sync"     // arg: url of mirror to sync from, waits for -off-peak
+	JobScrub    = "scrub"    // arg: fraction of files to re-hash
+	JobWatch    = "watch"    // check releases of watched repos
+	JobClean    = "clean"    // arg: keep duration
+)
+
+// states of jobs
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// finished jobs are kept for job status api
+const jobRetention = 7 * 24 * time.Hour
+
+// Job is a background task stored in bbolt, queued jobs survive restarts and failures are retried with backoff
+type Job struct {
+	ID       uint64    `json:"id"`
+	Kind     string    `json:"kind"`
+	Arg      string    `json:"arg,omitempty"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created"`
+	NextTry  time.Time `json:"next_try"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type jobHandler func(arg string) error
+
+// permanentError is a failure which retry can not help, eg 404
+type permanentError struct{ error }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// deferredError postpone job without counting an attempt, eg until off-peak window
+type deferredError struct{ until time.Time }
+
+func (e deferredError) Error() string {
+	return "deferred to " + e.until.Format(time.RFC3339)
+}
+
+// JobQueue run jobs by Workers goroutines, a job of same kind and arg is queued only once
+type JobQueue struct {
+	db       *bolt.DB
+	Workers  int
+	handlers map[string]jobHandler
+
+	mu      sync.Mutex
+	running int
+	wake    chan struct{}
+}
+
+// OpenJobQueue open or create job db, jobs interrupted by restart are queued again
+func OpenJobQueue(filename string, handlers map[string]jobHandler) (*JobQueue, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "open job queue")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(jobKeysBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var job Job
+			if json.Unmarshal(v, &job) != nil || job.State != JobRunning {
+				return nil
+			}
+			job.State = JobQueued
+			return putJob(b, &job)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &JobQueue{db: db, Workers: 4, handlers: handlers, wake: make(chan struct{}, 1)}, nil
+}
+
+func (q *JobQueue) Close() error {
+	return q.db.Close()
+}
+
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func putJob(b *bolt.Bucket, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.Put(jobKey(job.ID), data)
+}
+
+// Enqueue add a job, the active job is returned if same kind and arg is queued or running
+func (q *JobQueue) Enqueue(kind, arg string) (Job, error) {
+	if q.handlers[kind] == nil {
+		return Job{}, errors.Errorf("unknown job kind %s", strconv.Quote(kind))
+	}
+	var job Job
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b, keys := tx.Bucket(jobsBucket), tx.Bucket(jobKeysBucket)
+		if id := keys.Get([]byte(kind + "\x00" + arg)); id != nil {
+			if data := b.Get(id); data != nil {
+				return json.Unmarshal(data, &job)
+			}
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		job = Job{ID: id, Kind: kind, Arg: arg, State: JobQueued, Created: now, NextTry: now}
+		if err := keys.Put([]byte(kind+"\x00"+arg), jobKey(id)); err != nil {
+			return err
+		}
+		return putJob(b, &job)
+	})
+	if err == nil {
+		q.Wake()
+	}
+	return job, err
+}
+
+// Active return queued or running job of kind and arg
+func (q *JobQueue) Active(kind, arg string) (Job, bool, error) {
+	var job Job
+	found := false
+	err := q.db.View(func(tx *bolt.Tx) error {
+		if id := tx.Bucket(jobKeysBucket).Get([]byte(kind + "\x00" + arg)); id != nil {
+			if data := tx.Bucket(jobsBucket).Get(id); data != nil {
+				found = true
+				return json.Unmarshal(data, &job)
+			}
+		}
+		return nil
+	})
+	return job, found, err
+}
+
+// Get return job by id
+func (q *JobQueue) Get(id uint64) (Job, bool, error) {
+	var job Job
+	found := false
+	err := q.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(jobsBucket).Get(jobKey(id)); data != nil {
+			found = true
+			return json.Unmarshal(data, &job)
+		}
+		return nil
+	})
+	return job, found, err
+}
+
+// List return jobs filtered by state and kind (empty for all), newest first
+func (q *JobQueue) List(state, kind string) ([]Job, error) {
+	jobs := make([]Job, 0)
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job Job
+			if json.Unmarshal(v, &job) != nil {
+				return nil
+			}
+			if (state == "" || job.State == state) && (kind == "" || job.Kind == kind) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	return jobs, err
+}
+
+// Cancel remove a queued job, running jobs can not be cancelled
+func (q *JobQueue) Cancel(id uint64) (bool, error) {
+	found := false
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		data := b.Get(jobKey(id))
+		if data == nil {
+			return nil
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return err
+		}
+		if job.State == JobRunning {
+			return errors.Errorf("job %d is running", id)
+		}
+		found = true
+		if job.State == JobQueued {
+			tx.Bucket(jobKeysBucket).Delete([]byte(job.Kind + "\x00" + job.Arg))
+		}
+		return b.Delete(jobKey(id))
+	})
+	return found, err
+}
+
+// Wake dispatch due jobs now
+func (q *JobQueue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start dispatch due jobs to workers until process exits, finished jobs are pruned after jobRetention
+func (q *JobQueue) Start() {
+	go func() {
+		lastPrune := time.Time{}
+		for {
+			if time.Since(lastPrune) > time.Hour {
+				if err := q.prune(); err != nil {
+					logErrorf("job queue: %v", err)
+				}
+				lastPrune = time.Now()
+			}
+			wait := time.Minute
+			next, err := q.dispatch()
+			if err != nil {
+				logErrorf("job queue: %v", err)
+			} else if !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			select {
+			case <-q.wake:
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// dispatch start due queued jobs while workers are free, return time of the next queued job
+func (q *JobQueue) dispatch() (next time.Time, err error) {
+	q.mu.Lock()
+	free := q.Workers - q.running
+	q.mu.Unlock()
+	var started []Job
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		return b.ForEach(func(k, v []byte) error {
+			var job Job
+			if json.Unmarshal(v, &job) != nil || job.State != JobQueued {
+				return nil
+			}
+			if free <= 0 || job.NextTry.After(time.Now()) {
+				if next.IsZero() || job.NextTry.Before(next) {
+					next = job.NextTry
+				}
+				return nil
+			}
+			free--
+			job.State, job.Started = JobRunning, time.Now()
+			started = append(started, job)
+			return putJob(b, &job)
+		})
+	})
+	for _, job := range started {
+		q.mu.Lock()
+		q.running++
+		q.mu.Unlock()
+		go q.run(job)
+	}
+	return next, err
+}
+
+func (q *JobQueue) run(job Job) {
+	var err error
+	if h := q.handlers[job.Kind]; h != nil {
+		err = h(job.Arg)
+	} else {
+		err = permanent(errors.Errorf("unknown job kind %s", strconv.Quote(job.Kind)))
+	}
+	if err := q.finish(job.ID, err); err != nil {
+		logErrorf("job queue: %v", err)
+	}
+	q.mu.Lock()
+	q.running--
+	q.mu.Unlock()
+	q.Wake()
+}
+
+// finish record result of job, failed attempts are retried with backoff up to retryMaxAttempts
+func (q *JobQueue) finish(id uint64, cause error) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		data := b.Get(jobKey(id))
+		if data == nil {
+			return nil
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return err
+		}
+		now := time.Now()
+		if d, ok := cause.(deferredError); ok {
+			job.State, job.NextTry = JobQueued, d.until
+			return putJob(b, &job)
+		}
+		job.Attempts++
+		job.Error = ""
+		switch {
+		case cause == nil:
+			job.State, job.Finished = JobDone, now
+		case isPermanent(cause) || job.Attempts >= retryMaxAttempts:
+			job.State, job.Finished, job.Error = JobFailed, now, cause.Error()
+			logErrorf("job %d %s %s failed after %d attempts: %v", job.ID, job.Kind, job.Arg, job.Attempts, cause)
+		default:
+			delay := retryMinDelay << uint(job.Attempts-1)
+			if delay > retryMaxDelay || delay <= 0 {
+				delay = retryMaxDelay
+			}
+			job.State, job.NextTry, job.Error = JobQueued, now.Add(delay), cause.Error()
+			logWarnf("job %d %s %s: %v, retry in %s", job.ID, job.Kind, job.Arg, cause, delay)
+		}
+		if job.State != JobQueued {
+			if err := tx.Bucket(jobKeysBucket).Delete([]byte(job.Kind + "\x00" + job.Arg)); err != nil {
+				return err
+			}
+		}
+		return putJob(b, &job)
+	})
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// prune remove jobs finished before jobRetention
+func (q *JobQueue) prune() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(jobsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var job Job
+			if json.Unmarshal(v, &job) != nil {
+				continue
+			}
+			if (job.State == JobDone || job.State == JobFailed) && time.Since(job.Finished) > jobRetention {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// jobHandlers run jobs of d, see JobDownload etc
+func (d *DownloadCache) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		JobDownload: d.downloadJob,
+		JobSidecars: func(url string) error {
+			d.downloadSidecars(url)
+			return nil
+		},
+		JobSync: d.syncJob,
+		JobScrub: func(arg string) error {
+			fraction, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return permanent(err)
+			}
+			log.Println("scrub", d.Scrub(fraction))
+			return nil
+		},
+		JobWatch: func(string) error {
+			d.checkWatched()
+			return nil
+		},
+		JobClean: func(arg string) error {
+			keep, err := parseDuration(arg)
+			if err != nil {
+				return permanent(err)
+			}
+			d.Clean(keep, false)
+			return nil
+		},
+	}
+}
+
+// enqueue add a job, without job queue (eg maintenance commands) the job is run in a goroutine
+func (d *DownloadCache) enqueue(kind, arg string) {
+	if d.jobs == nil {
+		go func() {
+			if err := d.jobHandlers()[kind](arg); err != nil {
+				logErrorf("%s %s: %v", kind, arg, err)
+			}
+		}()
+		return
+	}
+	if _, err := d.jobs.Enqueue(kind, arg); err != nil {
+		logErrorf("job queue: %v", err)
+	}
+}
+
+// handleAPIJobs GET list jobs (?state=, ?kind=, ?limit=) or one job (?id=),
+// POST add job (kind=download&arg=<url>), DELETE cancel queued job (?id=)
+func (d *DownloadCache) handleAPIJobs(w http.ResponseWriter, r *http.Request) {
+	if d.jobs == nil {
+		http.Error(w, "job queue not opened", http.StatusServiceUnavailable)
+		return
+	}
+	var id uint64
+	if v := r.FormValue("id"); v != "" {
+		var err error
+		if id, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+		if id > 0 {
+			job, ok, err := d.jobs.Get(id)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if !ok {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, job)
+			return
+		}
+		jobs, err := d.jobs.List(r.FormValue("state"), r.FormValue("kind"))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if limit, err := strconv.Atoi(r.FormValue("limit")); err == nil && limit >= 0 && limit < len(jobs) {
+			jobs = jobs[:limit]
+		}
+		writeJSON(w, jobs)
+	case "POST", "PUT":
+		job, err := d.jobs.Enqueue(r.FormValue("kind"), r.FormValue("arg"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, job)
+	case "DELETE":
+		ok, err := d.jobs.Cancel(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cache directory layouts
+const (
+	LayoutHash = "hash" // <sha256[:2]>/<sha256[2:]>
+	LayoutURL  = "url"  // <host>/<path>, eg github.com/owner/repo/releases/download/v1/asset
+)
+
+// urlLayoutDir convert rawurl to a relative directory which mirrors the url structure
+func urlLayoutDir(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		hash := HashString(rawurl)
+		return filepath.Join("_invalid", hash[:2], hash[2:])
+	}
+	parts := []string{safeSegment(strings.Replace(u.Host, ":", "_", -1))}
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			continue
+		}
+		parts = append(parts, safeSegment(seg))
+	}
+	last := len(parts) - 1
+	if u.RawQuery != "" {
+		parts[last] += "@" + HashString(u.RawQuery)[:8]
+	}
+	if u.Fragment != "" {
+		// variants of generated content, eg packs by wants and haves, bundles by commit
+		parts[last] += "@" + HashString("#" + u.EscapedFragment())[:16]
+	}
+	return filepath.Join(parts...)
+}
+
+// safeSegment avoid conflict with files stored in entry directory
+func safeSegment(seg string) string {
+	seg = strings.Map(func(r rune) rune {
+		if r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, seg)
+	if seg == "meta.json" || seg == "cached.file" || strings.HasSuffix(seg, ".tmp") {
+		return "_" + seg
+	}
+	return seg
+}
+
+// rootOf return cache root which contains dir, empty if not found
+func (d *DownloadCache) rootOf(dir string) string {
+	dir = filepath.Clean(dir)
+	root := ""
+	for _, r := range d.cacheRoots() {
+		if strings.HasPrefix(dir, r+string(filepath.Separator)) && len(r) > len(root) {
+			root = r
+		}
+	}
+	return root
+}
+
+// removeEntry delete files of an entry, empty parent directories are removed too
+func (d *DownloadCache) removeEntry(dir string) error {
+	os.Remove(filepath.Join(dir, "cached.file"))
+	if err := os.Remove(filepath.Join(dir, "meta.json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.pruneEmptyDirs(dir)
+	return nil
+}
+
+// pruneEmptyDirs remove dir and its parents until cache root or a non-empty directory
+func (d *DownloadCache) pruneEmptyDirs(dir string) {
+	dir = filepath.Clean(dir)
+	root := d.rootOf(dir)
+	if root == "" {
+		return
+	}
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+}
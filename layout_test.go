@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// packs of the same repo differ only in fragment of cache key, see handleGit
+func TestURLLayoutPackVariants(t *testing.T) {
+	d := NewDownloadCache(t.TempDir())
+	d.Layout = LayoutURL
+	repo := "https://github.com/owner/repo.git/git-upload-pack"
+	packs := map[string]string{
+		repo + "#" + HashString("want a"): "pack a",
+		repo + "#" + HashString("want b"): "pack b",
+	}
+	for key, content := range packs {
+		if _, err := d.store(key, "pack", strings.NewReader(content), nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, content := range packs {
+		data, err := ioutil.ReadFile(filepath.Join(d.downloadDir(key), "cached.file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %q, want %q", key, data, content)
+		}
+	}
+	bundles := "https://github.com/owner/repo.git#bundle="
+	if d.downloadDir(bundles+"1111") == d.downloadDir(bundles+"2222") {
+		t.Error("bundles of different commits share a directory")
+	}
+	if d.downloadDir(repo+"#a") == d.downloadDir(repo) {
+		t.Error("fragment is not part of url layout directory")
+	}
+}
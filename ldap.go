@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+// result of logins is reused, browsers send basic auth with every request
+const (
+	ldapCacheTTL = 5 * time.Minute
+	ldapFailTTL  = 10 * time.Second
+)
+
+// LDAPConfig authenticate dashboard users against ldap or active directory with basic auth, eg
+//
+//	{"url": "ldaps://ad.corp:636", "bind_dn": "CN=svc-mirror,OU=Service,DC=corp,DC=com",
+//	 "base_dn": "DC=corp,DC=com", "user_filter": "(sAMAccountName=%s)",
+//	 "roles": {"CN=mirror-admins,OU=Groups,DC=corp,DC=com": "admin", "CN=developers,OU=Groups,DC=corp,DC=com": "viewer"}}
+type LDAPConfig struct {
+	URL            string            `json:"url"`             // ldap:// or ldaps://
+	StartTLS       bool              `json:"start_tls"`       // upgrade ldap:// connection with StartTLS
+	BindDN         string            `json:"bind_dn"`         // service account to search users, anonymous if empty
+	BindPassword   string            `json:"bind_password"`   // default env GITHUB_MIRROR_LDAP_PASSWORD
+	BaseDN         string            `json:"base_dn"`         // where users are searched
+	UserFilter     string            `json:"user_filter"`     // %s is the user name, default (uid=%s)
+	GroupAttribute string            `json:"group_attribute"` // groups of user entry, default memberOf
+	Roles          map[string]string `json:"roles"`           // group dn -> viewer or admin, users in no group can not log in
+}
+
+// LDAP check user name and password of basic auth, roles are cached for ldapCacheTTL
+type LDAP struct {
+	LDAPConfig
+	roles map[string]string // lower case group dn -> role
+
+	mu    sync.Mutex
+	cache map[[32]byte]ldapLogin // sha256 of user and password
+}
+
+type ldapLogin struct {
+	role    string
+	err     error
+	expires time.Time
+}
+
+func NewLDAP(c LDAPConfig) (*LDAP, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return nil, errors.Errorf("ldap url %s, must be ldap:// or ldaps://", c.URL)
+	}
+	if c.BaseDN == "" {
+		return nil, errors.New("ldap base_dn is required")
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if strings.Count(c.UserFilter, "%s") != 1 {
+		return nil, errors.Errorf("ldap user_filter %s, must contain one %%s", c.UserFilter)
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "memberOf"
+	}
+	if c.BindPassword == "" {
+		c.BindPassword = os.Getenv("GITHUB_MIRROR_LDAP_PASSWORD")
+	}
+	l := &LDAP{LDAPConfig: c, roles: make(map[string]string), cache: make(map[[32]byte]ldapLogin)}
+	for group, role := range c.Roles {
+		if role != RoleViewer && role != RoleAdmin {
+			return nil, errors.Errorf("ldap role of %s must be viewer or admin", group)
+		}
+		l.roles[strings.ToLower(group)] = role
+	}
+	if len(l.roles) == 0 {
+		return nil, errors.New("ldap roles is required, no one could log in")
+	}
+	return l, nil
+}
+
+// Login return role of user, admin if in any admin group
+func (l *LDAP) Login(user, password string) (string, error) {
+	if user == "" || password == "" {
+		return "", errors.New("empty user or password") // empty password is an unauthenticated bind
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	l.mu.Lock()
+	cached, ok := l.cache[key]
+	l.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.role, cached.err
+	}
+	role, err := l.login(user, password)
+	result := ldapLogin{role: role, err: err, expires: time.Now().Add(ldapCacheTTL)}
+	if err != nil {
+		logWarnf("ldap login %s: %v", user, err)
+		result.expires = time.Now().Add(ldapFailTTL)
+	}
+	l.mu.Lock()
+	for k, v := range l.cache {
+		if time.Now().After(v.expires) {
+			delete(l.cache, k)
+		}
+	}
+	l.cache[key] = result
+	l.mu.Unlock()
+	return role, err
+}
+
+func (l *LDAP) login(user, password string) (string, error) {
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}))
+	if err != nil {
+		return "", errors.Wrap(err, "ldap dial")
+	}
+	defer conn.Close()
+	conn.SetTimeout(10 * time.Second)
+	if l.StartTLS {
+		u, _ := url.Parse(l.URL)
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return "", errors.Wrap(err, "ldap starttls")
+		}
+	}
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return "", errors.Wrap(err, "ldap bind service account")
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(user)), []string{l.GroupAttribute}, nil))
+	if err != nil {
+		return "", errors.Wrap(err, "ldap search")
+	}
+	if len(res.Entries) != 1 {
+		return "", errors.Errorf("ldap user %s not found", user)
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return "", errors.Errorf("ldap user %s: invalid credentials", user)
+	}
+	role := ""
+	for _, group := range entry.GetAttributeValues(l.GroupAttribute) {
+		switch l.roles[strings.ToLower(group)] {
+		case RoleAdmin:
+			role = RoleAdmin
+		case RoleViewer:
+			if role == "" {
+				role = RoleViewer
+			}
+		}
+	}
+	if role == "" {
+		return "", errors.Errorf("ldap user %s is in no group of roles", user)
+	}
+	return role, nil
+}
+
+// ldapUser return user and role of basic auth checked against ldap, ok is false if not configured or failed
+func (d *DownloadCache) ldapUser(r *http.Request) (user, role string, ok bool) {
+	l := d.currentLDAP()
+	if l == nil {
+		return "", "", false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", "", false
+	}
+	role, err := l.Login(user, password)
+	if err != nil {
+		return "", "", false
+	}
+	return user, role, true
+}
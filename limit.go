@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/pkg/errors"
+)
+
+// parseSize parse human readable size, eg 2GB, 500MB
+func parseSize(s string) (int64, error) {
+	var size datasize.ByteSize
+	if err := size.UnmarshalText([]byte(s)); err != nil {
+		return 0, errors.Errorf("invalid size %s", strconv.Quote(s))
+	}
+	return int64(size.Bytes()), nil
+}
+
+// maxSizeReader return ErrTooLarge once more than remaining bytes are read
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// concurrencyLimiter cap in-flight requests per key
+type concurrencyLimiter struct {
+	max    int // 0 means unlimited
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (l *concurrencyLimiter) Acquire(key string) bool {
+	if l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts == nil {
+		l.counts = make(map[string]int)
+	}
+	if l.counts[key] >= l.max {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+func (l *concurrencyLimiter) Release(key string) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+	} else {
+		l.counts[key]--
+	}
+}
+
+// speedLimitReader slow down reading to limit bytes per second, so one large download does not
+// take all of the uplink from other downloads
+type speedLimitReader struct {
+	r     io.Reader
+	limit int64
+	start time.Time
+	read  int64
+}
+
+func newSpeedLimitReader(r io.Reader, limit int64) *speedLimitReader {
+	return &speedLimitReader{r: r, limit: limit, start: time.Now()}
+}
+
+func (s *speedLimitReader) Read(p []byte) (int, error) {
+	// at most one second of data, so sleeps are short and idle timeout is not triggered
+	if int64(len(p)) > s.limit {
+		p = p[:s.limit]
+	}
+	n, err := s.r.Read(p)
+	s.read += int64(n)
+	if wait := time.Duration(float64(s.read)/float64(s.limit)*float64(time.Second)) - time.Since(s.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// splitComma split comma separated values, empty values are dropped
+// eg: 0.0.0.0:8000,[::1]:8001,unix:///run/github-mirror.sock
+func splitComma(s string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// UnixSocketMode is the permission of unix socket created by listen
+var UnixSocketMode os.FileMode = 0660
+
+// ServerLimits protect a public mirror from slowloris-style clients
+// WriteTimeout covers the whole response, so it must be longer than the slowest download, 0 to disable
+var ServerLimits = struct {
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	WriteTimeout      time.Duration
+	MaxHeaderBytes    int
+	MaxConns          int // per listener, 0 for unlimited
+}{
+	ReadHeaderTimeout: 10 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+	MaxHeaderBytes:    64 << 10,
+}
+
+// limitListener block Accept while max connections are open
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// listen support tcp address and unix:///path/to/file.sock
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix://")
+	// remove socket left by previous process
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, UnixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// shutdownTimeout bound graceful shutdown, long downloads are cut off after it
+const shutdownTimeout = 10 * time.Second
+
+var (
+	stopC    = make(chan struct{})
+	stopOnce sync.Once
+)
+
+// StopServe shut down ListenAndServe gracefully, like SIGTERM does
+func StopServe() {
+	stopOnce.Do(func() { close(stopC) })
+}
+
+// ListenAndServe listen on all addrs, return when any of the server exits
+// or nil after graceful shutdown on SIGINT, SIGTERM or StopServe
+func ListenAndServe(addrs []string, handler http.Handler) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if ServerLimits.MaxConns > 0 {
+			ln = &limitListener{Listener: ln, sem: make(chan struct{}, ServerLimits.MaxConns)}
+		}
+		if ServerTLSConfig != nil {
+			ln = tls.NewListener(ln, ServerTLSConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	errC := make(chan error, len(listeners))
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, ln := range listeners {
+		log.Printf("github-mirror listen on %s", ln.Addr())
+		srv := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: ServerLimits.ReadHeaderTimeout,
+			IdleTimeout:       ServerLimits.IdleTimeout,
+			WriteTimeout:      ServerLimits.WriteTimeout,
+			MaxHeaderBytes:    ServerLimits.MaxHeaderBytes,
+		}
+		servers = append(servers, srv)
+		go func(ln net.Listener) {
+			errC <- srv.Serve(ln)
+		}(ln)
+	}
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigC)
+	select {
+	case err := <-errC:
+		return err
+	case sig := <-sigC:
+		log.Printf("received %v, shutting down", sig)
+	case <-stopC:
+		log.Printf("shutting down")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logWarnf("shutdown %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// levels of log lines, lines of log.Printf are info. syslog, journald and windows event log
+// map them to priorities, stderr shows the prefix as is
+const (
+	levelError   = "ERROR"
+	levelWarning = "WARNING"
+	levelInfo    = "INFO"
+)
+
+// logErrorf log a failure which needs attention of operators
+func logErrorf(format string, v ...interface{}) {
+	log.Output(2, levelError+": "+fmt.Sprintf(format, v...))
+}
+
+// logWarnf log a failure which is handled, eg retried or served from elsewhere
+func logWarnf(format string, v ...interface{}) {
+	log.Output(2, levelWarning+": "+fmt.Sprintf(format, v...))
+}
+
+// levelPrefix match level written by logErrorf and logWarnf, after file and line of log.Lshortfile
+var levelPrefix = regexp.MustCompile(`^((?:[\w.-]+\.go:\d+: )?)(ERROR|WARNING): `)
+
+// logLevel return level of a log line and the line without level prefix
+func logLevel(line string) (level, msg string) {
+	m := levelPrefix.FindStringSubmatch(line)
+	if m == nil {
+		return levelInfo, line
+	}
+	return m[2], m[1] + line[len(m[0]):]
+}
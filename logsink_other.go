@@ -0,0 +1,128 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"log/syslog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// journalSocket is the native protocol socket of systemd-journald
+const journalSocket = "/run/systemd/journal/socket"
+
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// setLogOutput send log to stderr, syslog (local), syslog://host:514 (udp), syslog+tcp://host:601 or journald
+func setLogOutput(output, tag, facility string) error {
+	switch {
+	case output == "" || output == "stderr":
+		return nil
+	case output == "journald":
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			return errors.Wrap(err, "connect journald")
+		}
+		log.SetOutput(&journalWriter{conn: conn, tag: tag})
+	case output == "syslog" || strings.HasPrefix(output, "syslog://") || strings.HasPrefix(output, "syslog+tcp://"):
+		priority, ok := syslogFacilities[facility]
+		if !ok {
+			return errors.Errorf("invalid -syslog-facility %s, must be user, daemon or local0-7", strconv.Quote(facility))
+		}
+		network, addr := "", ""
+		if strings.HasPrefix(output, "syslog://") {
+			network, addr = "udp", strings.TrimPrefix(output, "syslog://")
+		} else if strings.HasPrefix(output, "syslog+tcp://") {
+			network, addr = "tcp", strings.TrimPrefix(output, "syslog+tcp://")
+		}
+		w, err := syslog.Dial(network, addr, priority|syslog.LOG_INFO, tag)
+		if err != nil {
+			return errors.Wrap(err, "connect syslog")
+		}
+		log.SetOutput(&syslogWriter{w})
+	default:
+		return errors.Errorf("invalid -log-output %s, must be stderr, syslog, syslog://host:port, syslog+tcp://host:port or journald", strconv.Quote(output))
+	}
+	log.SetFlags(log.Lshortfile) // syslog and journald add time
+	return nil
+}
+
+// syslogWriter send log output to syslog with priority of logErrorf, logWarnf or info
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	level, msg := logLevel(strings.TrimSpace(string(p)))
+	var err error
+	switch level {
+	case levelError:
+		err = w.w.Err(msg)
+	case levelWarning:
+		err = w.w.Warning(msg)
+	default:
+		err = w.w.Info(msg)
+	}
+	return len(p), err
+}
+
+// journalWriter send log output to journald by native protocol, source file and line
+// of log.Lshortfile are sent as CODE_FILE and CODE_LINE
+type journalWriter struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+var shortfilePrefix = regexp.MustCompile(`^([\w.-]+\.go):(\d+): `)
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	level, msg := logLevel(strings.TrimSpace(string(p)))
+	priority := "6"
+	switch level {
+	case levelError:
+		priority = "3"
+	case levelWarning:
+		priority = "4"
+	}
+	var buf bytes.Buffer
+	if m := shortfilePrefix.FindStringSubmatch(msg); m != nil {
+		journalField(&buf, "CODE_FILE", m[1])
+		journalField(&buf, "CODE_LINE", m[2])
+		msg = msg[len(m[0]):]
+	}
+	journalField(&buf, "PRIORITY", priority)
+	journalField(&buf, "SYSLOG_IDENTIFIER", w.tag)
+	journalField(&buf, "MESSAGE", msg)
+	_, err := w.conn.Write(buf.Bytes())
+	return len(p), err
+}
+
+// journalField append a field, values with newline use the binary form of length and data
+func journalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
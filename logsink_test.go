@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestLogLevel(t *testing.T) {
+	cases := []struct{ line, level, msg string }{
+		{"main.go:12: ERROR: quarantine x: denied", levelError, "main.go:12: quarantine x: denied"},
+		{"WARNING: p2p x: timeout", levelWarning, "p2p x: timeout"},
+		{"main.go:826: download error-codes.txt", levelInfo, "main.go:826: download error-codes.txt"},
+		{"finished f.txt remote: 404 failed", levelInfo, "finished f.txt remote: 404 failed"},
+	}
+	for _, c := range cases {
+		level, msg := logLevel(c.line)
+		if level != c.level || msg != c.msg {
+			t.Errorf("%q: got %s %q, want %s %q", c.line, level, msg, c.level, c.msg)
+		}
+	}
+}
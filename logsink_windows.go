@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// setLogOutput only supports stderr on windows, the service logs to windows event log
+func setLogOutput(output, tag, facility string) error {
+	if output == "" || output == "stderr" {
+		return nil
+	}
+	return errors.Errorf("-log-output %s is not supported on windows, run as service to log to event log", strconv.Quote(output))
+}
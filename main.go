@@ -1,16 +1,18 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/json"
-	"flag"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
 	"fmt"
+	"html"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -20,23 +22,46 @@ import (
 
 	"github.com/DeanThompson/syncmap"
 	"github.com/c2h5oh/datasize"
-	"github.com/franela/goreq"
 	"github.com/pkg/errors"
-)
-
-var (
-	port    int
-	dataDir string
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func init() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 }
 
+// HashString return hex sha256 of s, used as cache directory key
+// entries created by older versions with md5 keys can be moved with: github-mirror migrate
 func HashString(s string) string {
-	m := md5.New()
-	m.Write([]byte(s))
-	return fmt.Sprintf("%x", m.Sum(nil))
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrTooLarge is returned when file is larger than max size, such files are passed through without caching
+var ErrTooLarge = errors.New("file too large to cache")
+
+// UpstreamError is returned when upstream response status is not 200
+type UpstreamError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *UpstreamError) Error() string {
+	return "remote: " + e.Status
+}
+
+// isUpstreamFailure report whether err means upstream unreachable or 5xx
+func isUpstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := errors.Cause(err).(*UpstreamError); ok {
+		return e.StatusCode >= 500
+	}
+	return true
 }
 
 type Status struct {
@@ -53,13 +78,70 @@ func (s *Status) Write(p []byte) (int, error) {
 }
 
 type DownloadCache struct {
-	CacheDir  string
-	GetProxy  func() string
-	mu        sync.Mutex
-	dashboard *syncmap.SyncMap
-	workers   map[string]bool
-	waiters   map[string][]chan error
-	serverMux *http.ServeMux
+	CacheDir        string
+	Rules           []MirrorRule
+	Layout          string         // LayoutHash or LayoutURL
+	IdleTimeout     time.Duration  // abort download when no bytes received for this duration
+	CORS            *CORS          // nil to disable CORS headers
+	AdminToken      string         // required by admin api, empty to allow loopback clients only
+	BasePath        string         // url path prefix when running under a sub-path, e.g. /ghmirror
+	IPPrivacy       string         // anonymize client ip in audit log and usage stats, see PrivacyTruncate
+	MaxFileSize     int64          // larger files are passed through without caching, 0 for unlimited
+	DownloadSpeed   int64          // bytes per second of each upstream download, 0 for unlimited
+	MinFree         int64          // keep at least this many bytes free on cache disks, 0 to disable
+	CompressMinSize int64          // compress text responses not smaller than this, 0 to disable
+	VerifyChecksum  bool           // re-hash cached file before serving, file size is always checked
+	TTL             time.Duration  // expired cache is refreshed, 0 to never expire
+	Eviction        EvictionPolicy // order of evicting entries when disk is full, lru if nil
+	AccelRedirect   string         // nginx internal location of CacheDir, cached files are sent by nginx
+	Sendfile        bool           // cached files are sent by front proxy with X-Sendfile
+	RedirectHits    *RedirectHits  // nil to serve cache hits by mirror
+	KeepTags        []string       // entries with any of these tags are never evicted or cleaned
+	Sidecars        []string       // suffixes of files fetched with release assets, eg .sha256
+	OffPeak         TimeWindows    // background prefetch, retry and sync wait for these windows, nil for any time
+	Presets         string         // comma separated rule presets installed with rules of config, see presets
+	// dashboard, stats and listings of cache need a viewer or admin api key, public if false
+	PrivateDashboard bool
+	OAuth            *OAuth // github login for dashboard, nil to disable
+	// serve cached files only, expired files are served as is, misses get 503
+	Offline bool
+	// serve expired cache immediately and refresh in background,
+	// otherwise wait for refresh, expired cache is served only if upstream fails
+	StaleWhileRevalidate bool
+	mu                   sync.Mutex
+	metaMu               sync.Mutex
+	dashboard            *syncmap.SyncMap
+	workers              map[string]bool
+	waiters              map[string][]chan error
+	serverMux            *http.ServeMux
+	scrubber             scrubber
+	pins                 *Pins
+	apiKeys              *APIKeys
+	aliases              *Aliases
+	refreshLimiter       refreshLimiter
+	events               eventHub
+	perIPLimiter         concurrencyLimiter
+	negative             negativeCache
+	share                shareSecret
+	notifier             Notifier
+	jobs                 *JobQueue   // nil if not opened
+	usage                *UsageLog   // nil if not opened
+	auditLog             *AuditLog   // nil if not opened
+	replicator           *Replicator // nil if no standby
+	cluster              *Cluster    // nil if not clustered
+	peers                *Peers      // nil if no p2p peers
+	watcher              *Watcher    // nil if no repo is watched, read by currentWatcher
+	ldap                 *LDAP       // nil if no ldap in config, read by currentLDAP
+	stateDir             string      // directory of jobs.db and usage.db
+	files                *davFS      // tree of cached files by upstream path, for webdav and browse
+	sharedLock           SharedLock  // nil if cache dir is not shared
+	scheduler            Scheduler
+	schedule             map[string]string // maintenance task -> cron expression of config file
+	configFile           string            // empty if started without -config, settings can not be saved
+	configMu             sync.Mutex        // serialize saving settings
+	liveMu               sync.RWMutex      // guard Rules, Eviction, watcher, ldap and schedule replaced by settings
+	breaker              circuitBreaker
+	prober               upstreamProber
 }
 
 func NewDownloadCache(cacheDir string) *DownloadCache {
@@ -68,10 +150,15 @@ func NewDownloadCache(cacheDir string) *DownloadCache {
 	}
 	dc := &DownloadCache{
 		CacheDir:  cacheDir,
+		Rules:     DefaultMirrorRules(),
 		workers:   make(map[string]bool),
 		waiters:   make(map[string][]chan error),
 		dashboard: syncmap.New(),
+		pins:      NewPins(filepath.Join(cacheDir, "pins.json")),
+		apiKeys:   NewAPIKeys(filepath.Join(cacheDir, "apikeys.json")),
+		aliases:   NewAliases(filepath.Join(cacheDir, "aliases.json")),
 	}
+	dc.files = &davFS{d: dc}
 	dc.initServeMux()
 	return dc
 }
@@ -79,13 +166,7 @@ func NewDownloadCache(cacheDir string) *DownloadCache {
 func (d *DownloadCache) initServeMux() {
 	m := http.NewServeMux()
 
-	mirrors := make([]MirrorRule, 0)
-	mirrors = append(mirrors, MirrorRule{
-		regexp.MustCompile(`^/`),
-		"https://github.com/",
-	})
-
-	m.HandleFunc("/_dashboard", func(w http.ResponseWriter, r *http.Request) {
+	m.HandleFunc("/_dashboard", d.requireViewer(func(w http.ResponseWriter, r *http.Request) {
 		output := "<html><body><h2>Dashboard</h2><ul>"
 		for item := range d.dashboard.IterItems() {
 			st := item.Value.(*Status)
@@ -93,43 +174,302 @@ func (d *DownloadCache) initServeMux() {
 			if st.Total > 0 {
 				percent = float64(st.Copied) * 100 / float64(st.Total)
 			}
-			output += "<li>" + st.URL + "&nbsp;&nbsp;" +
+			output += "<li id=\"" + item.Key + "\">" + st.URL + "&nbsp;&nbsp;<span>" +
 				fmt.Sprintf("%.1f%% - %s / %s", percent,
-					datasize.ByteSize(st.Copied).HR(), datasize.ByteSize(st.Total).HR()) + "</li>"
+					datasize.ByteSize(st.Copied).HR(), datasize.ByteSize(st.Total).HR()) + "</span></li>"
 		}
-		output += "</ul></body></html>"
+		output += "</ul>" + d.searchForm("") + d.probeHTML() + d.usageHTML() + "<p>Last scrub: " + d.scrubber.Report().String() + "</p>"
+		output += "<a href=\"_dashboard/top\">Top downloads</a> | <a href=\"_browse/\">Browse cached files</a> | <a href=\"_dashboard/repos\">Repositories</a> | <a href=\"_dashboard/settings\">Settings</a>" + d.loginHTML(r) + dashboardScript + "</body></html>"
 		io.WriteString(w, output)
-	})
+	}))
 
-	m.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
-		url := req.URL.Path
-		matches := regexp.MustCompile(`.*/([^/?]+)`).FindStringSubmatch(url)
-		downloadName := "cached.file"
-		if matches != nil {
-			downloadName = matches[1]
-		}
-		urlPrefix := ""
-		for _, mirror := range mirrors {
-			if mirror.Pattern.MatchString(url) {
-				urlPrefix = mirror.URLPrefix
+	m.HandleFunc("/_dashboard/top", d.requireViewer(func(w http.ResponseWriter, r *http.Request) {
+		entries, _ := d.Entries()
+		sortEntries(entries, "hits")
+		output := "<html><body><h2>Top downloads</h2><ol>"
+		for i, e := range entries {
+			if i >= 100 {
+				break
 			}
+			output += "<li>" + html.EscapeString(e.URL) + "&nbsp;&nbsp;" +
+				fmt.Sprintf("%d hits - %s", e.Hits, datasize.ByteSize(e.Size).HR()) + "</li>"
 		}
-		if urlPrefix == "" {
-			io.WriteString(rw, "Github Mirror")
+		output += "</ol></body></html>"
+		io.WriteString(w, output)
+	}))
+
+	m.HandleFunc("/debug/vars", d.requireViewer(expvar.Handler().ServeHTTP))
+	m.HandleFunc("/_api/pins", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			d.requireViewer(d.handleAPIPins)(w, r)
 			return
 		}
-		mirrorURL := strings.TrimSuffix(urlPrefix, "/") + req.RequestURI
-		log.Println("mirror url:", mirrorURL)
-		err := d.DownloadAndWait(mirrorURL, downloadName)
-		if err != nil {
-			http.Error(rw, err.Error(), 500)
+		d.requireAdmin(d.audited("pin", d.handleAPIPins))(w, r)
+	})
+	m.HandleFunc("/_api/aliases", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			d.requireViewer(d.handleAPIAliases)(w, r)
 			return
 		}
-		downcache.ServeFile(rw, req, mirrorURL)
+		d.requireAdmin(d.audited("alias", d.handleAPIAliases))(w, r)
 	})
+	m.HandleFunc("/_api/events", d.requireViewer(d.handleAPIEvents))
+	m.HandleFunc("/_api/cache/file", d.requirePeer(d.handleAPICacheFile))
+	m.HandleFunc("/_api/cache/hashes", d.requirePeer(d.handleAPICacheHashes))
+	m.HandleFunc("/_api/cache", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			d.requireAdmin(d.audited("upload", d.handleAPICacheUpload))(w, r)
+		case "DELETE":
+			d.requireAdmin(d.audited("purge", d.handleAPICachePurge))(w, r)
+		default:
+			d.requirePeer(d.handleAPICache)(w, r)
+		}
+	})
+	m.HandleFunc("/_api/stats", d.requireViewer(d.handleAPIStats))
+	m.HandleFunc("/_api/match", d.requireViewer(d.handleAPIMatch))
+	m.HandleFunc("/_api/releases/", d.handleAPIReleases)
+	m.HandleFunc("/_api/prefetch", d.requireAdmin(d.audited("prefetch", d.handleAPIPrefetch)))
+	m.HandleFunc("/_api/retry", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			d.requireViewer(d.handleAPIRetry)(w, r)
+			return
+		}
+		d.requireAdmin(d.audited("cancel", d.handleAPIRetry))(w, r)
+	})
+	m.HandleFunc("/_api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			d.requireViewer(d.handleAPIJobs)(w, r)
+		case "DELETE":
+			d.requireAdmin(d.audited("cancel", d.handleAPIJobs))(w, r)
+		default:
+			d.requireAdmin(d.audited("job", d.handleAPIJobs))(w, r)
+		}
+	})
+	m.HandleFunc("/_api/clean", d.requireAdmin(d.audited("clean", d.handleAPIClean)))
+	m.HandleFunc("/_api/backup", d.requireAdmin(d.audited("backup", d.handleAPIBackup)))
+	m.HandleFunc("/_api/sign", d.requireAdmin(d.audited("sign", d.handleAPISign)))
+	m.HandleFunc("/_api/keys", d.requireAdmin(d.audited("key", d.handleAPIKeys)))
+	m.HandleFunc("/_api/usage", d.requireViewer(d.handleAPIUsage))
+	m.HandleFunc("/_api/audit", d.requireAdmin(d.handleAPIAudit))
+	m.HandleFunc("/_api/schedule", d.requireViewer(d.handleAPISchedule))
+	m.HandleFunc("/_share", d.handleShare)
+	m.HandleFunc("/_feed.atom", d.requireViewer(d.handleFeed))
+	m.HandleFunc("/_dav/", d.requireViewer(d.newDavHandler("/_dav")))
+	m.HandleFunc("/_browse/", d.requireViewer(d.handleBrowse))
+	m.HandleFunc("/_api/search", d.requireViewer(d.handleAPISearch))
+	m.HandleFunc("/_api/repos", d.requireViewer(d.handleAPIRepos))
+	m.HandleFunc("/_api/watch", d.requireViewer(d.handleAPIWatch))
+	m.HandleFunc("/_sha256sums/", d.handleSHA256Sums)
+	m.HandleFunc("/_dashboard/repos", d.requireViewer(d.handleDashboardRepos))
+	m.HandleFunc("/_dashboard/settings", d.handleSettings)
+	m.HandleFunc("/_api/config", d.requireAdmin(d.audited("config", d.handleAPIConfig)))
+	m.HandleFunc("/_oauth/login", d.handleOAuthLogin)
+	m.HandleFunc("/_oauth/callback", d.handleOAuthCallback)
+	m.HandleFunc("/_oauth/logout", d.handleOAuthLogout)
+	m.HandleFunc("/_api/tags", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			d.requireViewer(d.handleAPITags)(w, r)
+			return
+		}
+		d.requireAdmin(d.audited("tag", d.handleAPITags))(w, r)
+	})
+	m.HandleFunc("/graphql", d.requireViewer(d.handleGraphQL))
+
+	m.HandleFunc("/", d.handleMirror)
 	d.serverMux = m
 }
 
+// handleMirror serve file of upstream matched by mirror rules
+func (d *DownloadCache) handleMirror(rw http.ResponseWriter, req *http.Request) {
+	req, span := startServerSpan(req, "mirror")
+	defer span.End()
+	if d.CORS != nil {
+		if d.CORS.Preflight(rw, req) {
+			return
+		}
+		d.CORS.WriteHeaders(rw, req)
+	}
+	var rule *MirrorRule
+	if target, ok := d.aliases.Lookup(req.URL.Path); ok {
+		var p string
+		var err error
+		if rule, p, err = d.resolveAlias(target); err != nil {
+			http.Error(rw, "alias "+req.URL.Path+": "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		req = withPath(req, p)
+	}
+	if latestAssetPattern.MatchString(req.URL.Path) {
+		p, err := resolveLatestAsset(req.Context(), req.URL.Path)
+		if err != nil {
+			status := http.StatusBadGateway
+			if ue, ok := err.(*UpstreamError); ok && ue.StatusCode == http.StatusNotFound {
+				status = http.StatusNotFound
+			} else if errors.Is(err, ErrOffline) {
+				status = http.StatusServiceUnavailable
+			} else if errors.Is(err, ErrRateLimited) {
+				status = http.StatusTooManyRequests
+			}
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		req = withPath(req, p)
+	}
+	url := req.URL.Path
+	matches := regexp.MustCompile(`.*/([^/?]+)`).FindStringSubmatch(url)
+	downloadName := "cached.file"
+	if matches != nil {
+		downloadName = matches[1]
+	}
+	_, matchSpan := tracer.Start(req.Context(), "rule match")
+	if rule == nil {
+		rule = d.matchRule(req.Host, url)
+	}
+	if rule != nil {
+		matchSpan.SetAttributes(attrRule.String(rule.Pattern.String()))
+	}
+	matchSpan.End()
+	if rule == nil {
+		io.WriteString(rw, "Github Mirror")
+		return
+	}
+	if d.routeCluster(rw, req, strings.TrimSuffix(rule.URLPrefix, "/")+req.URL.Path) {
+		return
+	}
+	key, ok := d.checkAPIKey(rw, req)
+	if !ok {
+		return
+	}
+	if rawQuery, ok := removeQueryParam(req.URL.RawQuery, metaQueryParam); ok {
+		// not counted as download in usage and audit log
+		mirrorURL := strings.TrimSuffix(rule.URLPrefix, "/") + req.URL.EscapedPath()
+		if rawQuery != "" {
+			mirrorURL += "?" + rawQuery
+		}
+		d.serveMirrorMeta(rw, mirrorURL)
+		return
+	}
+	client := clientKey(req)
+	if key.Name != "" {
+		client = "key:" + key.Name
+	}
+	cw := &countingWriter{ResponseWriter: rw}
+	defer func() {
+		if key.Name != "" {
+			d.apiKeys.AddBytes(key.Name, cw.n)
+		}
+		if d.usage != nil {
+			d.usage.Add(d.anonymizeIP(client), cw.n)
+			if cw.status < 400 {
+				d.usage.AddRepo(repoOf(strings.TrimSuffix(rule.URLPrefix, "/")+req.URL.Path), cw.n)
+			}
+		}
+	}()
+	rw = cw
+	if !d.perIPLimiter.Acquire(client) {
+		rw.Header().Set("Retry-After", "5")
+		http.Error(rw, "429 Too Many Requests, too many concurrent downloads from "+client, http.StatusTooManyRequests)
+		return
+	}
+	defer d.perIPLimiter.Release(client)
+
+	requestURI := req.RequestURI
+	rawQuery, forceRefresh := removeQueryParam(req.URL.RawQuery, refreshQueryParam)
+	if forceRefresh {
+		requestURI = req.URL.EscapedPath()
+		if rawQuery != "" {
+			requestURI += "?" + rawQuery
+		}
+	}
+	mirrorURL := strings.TrimSuffix(rule.URLPrefix, "/") + requestURI
+	if id := clientIdentity(req); id != "" {
+		log.Printf("mirror url: %s (client %s)", mirrorURL, id)
+	} else {
+		log.Println("mirror url:", mirrorURL)
+	}
+	defer func() {
+		d.audit(req, AuditEntry{Action: "download", URL: mirrorURL, Status: cw.status, Bytes: cw.n, Detail: cw.Header().Get("X-Cache")})
+	}()
+	if bundlePattern.MatchString(url) {
+		if d.Offline {
+			http.Error(rw, ErrOffline.Error()+", git bundles need upstream to resolve ref", http.StatusServiceUnavailable)
+			return
+		}
+		d.serveBundle(rw, req, mirrorURL)
+		return
+	}
+	if gitPattern.MatchString(url) {
+		d.serveGit(rw, req, rule, mirrorURL)
+		return
+	}
+	if auth := req.Header.Get("Authorization"); rule.ForwardAuth && auth != "" {
+		d.passThrough(rw, req, mirrorURL, http.Header{"Authorization": {auth}})
+		return
+	}
+	if releasePagePattern.MatchString(url) {
+		d.serveReleasePage(rw, req, rule, mirrorURL)
+		return
+	}
+	var cacheStatus string
+	var err error
+	if forceRefresh {
+		if !d.canForceRefresh(req, mirrorURL) {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(d.refreshLimiter.interval.Seconds())))
+			http.Error(rw, "429 Too Many Requests, refresh is rate limited", http.StatusTooManyRequests)
+			return
+		}
+		cacheStatus, err = CacheMiss, d.refresh(mirrorURL, downloadName, false)
+	} else {
+		cacheStatus, err = d.downloadAndWait(req.Context(), rule, mirrorURL, downloadName)
+	}
+	span.SetAttributes(attrURL.String(mirrorURL), attrCache.String(cacheStatus))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	rw.Header().Set("X-Cache", cacheStatus)
+	countCacheStatus(cacheStatus)
+	switch cacheStatus {
+	case CacheStale:
+		rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	case CacheStaleIfError:
+		rw.Header().Set("Warning", `111 - "Revalidation Failed"`)
+	}
+	if errors.Cause(err) == ErrTooLarge {
+		log.Printf("pass through %s: %v", mirrorURL, err)
+		d.passThrough(rw, req, mirrorURL, nil)
+		return
+	}
+	if errors.Cause(err) == ErrCircuitOpen {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(d.breaker.cooldown.Seconds())))
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Cause(err) == ErrInsufficientStorage {
+		http.Error(rw, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Cause(err) == ErrOffline {
+		http.Error(rw, "503 Service Unavailable, "+err.Error()+", seed it with import or PUT /_api/cache", http.StatusServiceUnavailable)
+		return
+	}
+	if ue, ok := errors.Cause(err).(*UpstreamError); ok && ue.StatusCode >= 400 && ue.StatusCode < 500 {
+		http.Error(rw, err.Error(), ue.StatusCode)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if manifestPattern.MatchString(url) {
+		if mediaType := manifestMediaType(d.downloadDir(mirrorURL)); mediaType != "" {
+			rw.Header().Set("Content-Type", mediaType)
+		}
+	}
+	d.ServeFile(rw, req, mirrorURL)
+}
+
 func (d *DownloadCache) unsafeAddWaiter(hash string) chan error {
 	if _, exists := d.waiters[hash]; !exists {
 		d.waiters[hash] = make([]chan error, 0)
@@ -139,6 +479,24 @@ func (d *DownloadCache) unsafeAddWaiter(hash string) chan error {
 	return ch
 }
 
+// lockWorker mark hash as downloading, return false if already downloading
+func (d *DownloadCache) lockWorker(hash string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.workers[hash] {
+		return false
+	}
+	d.workers[hash] = true
+	return true
+}
+
+// unlockWorker notify waiters of hash with err
+func (d *DownloadCache) unlockWorker(hash string, err error) {
+	d.mu.Lock()
+	d.unsafeNotifyWaiters(hash, err)
+	d.mu.Unlock()
+}
+
 func (d *DownloadCache) unsafeNotifyWaiters(hash string, err error) {
 	for _, ch := range d.waiters[hash] {
 		ch <- err
@@ -147,52 +505,74 @@ func (d *DownloadCache) unsafeNotifyWaiters(hash string, err error) {
 	delete(d.workers, hash)
 }
 
-func (d *DownloadCache) download(url string, filename string) (err error) {
-	req := goreq.Request{
-		Method:          "GET",
-		Uri:             url,
-		MaxRedirects:    10,
-		RedirectHeaders: true,
+// download url into cache, if conditional and an intact entry exists, upstream is asked with its
+// validators (ETag, Last-Modified) and the entry is renewed without transfer when not modified
+func (d *DownloadCache) download(ctx context.Context, url string, filename string, conditional bool) (err error) {
+	hash := d.entryHash(url)
+	fetchURL := d.fetchURL(url)
+	ctx, span := tracer.Start(ctx, "upstream fetch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrURL.String(fetchURL)))
+	defer func() { endSpan(span, err) }()
+	d.events.Publish(Event{Type: EventStart, Hash: hash, URL: url, Filename: filename})
+	defer func() {
+		e := Event{Type: EventFinish, Hash: hash, URL: url, Filename: filename}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		d.events.Publish(e)
+		d.notifier.downloadResult(url, err)
+		d.breaker.Record(fetchURL, err)
+	}()
+	if err := d.breaker.Allow(fetchURL); err != nil {
+		return err
 	}
-	if d.GetProxy != nil {
-		proxy := d.GetProxy()
-		if !strings.HasPrefix(proxy, "http://") {
-			log.Printf("Invalid proxy %s, must startswith http://", strconv.Quote(proxy))
-		} else {
-			req.Proxy = proxy
+
+	req, err := newUpstreamRequest(ctx, "GET", fetchURL)
+	if err != nil {
+		return err
+	}
+	// go transport only decompresses when it asks for gzip itself, -header may ask for other encodings
+	req.Header.Set("Accept-Encoding", "identity")
+	validated := false
+	if conditional {
+		if old, err := verifyEntry(d.downloadDir(url), false); err == nil && old.Header != nil {
+			if etag := old.Header["ETag"]; etag != "" {
+				req.Header.Set("If-None-Match", etag)
+				validated = true
+			}
+			if lastModified := old.Header["Last-Modified"]; lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+				validated = true
+			}
 		}
 	}
-	hash := HashString(url)
 
-	res, err := req.Do()
+	res, err := doUpstream(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 	log.Println(res.StatusCode)
 
+	if res.StatusCode == http.StatusNotModified && validated {
+		return d.renew(url, res)
+	}
 	if res.StatusCode != 200 {
-		return errors.New("remote: " + res.Status)
+		return &UpstreamError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	if err := decodeUpstream(res); err != nil {
+		return err
 	}
 	fileLength, err := strconv.Atoi(res.Header.Get("Content-Length"))
 	if err != nil {
-		log.Printf("WARNING: %s content-length unknown", url)
+		logWarnf("%s content-length unknown", url)
 	}
-
-	tmpFilename := filepath.Join(d.CacheDir, HashString(url)+".tmp")
-	targetDir := d.downloadDir(url)
-
-	defer func() {
-		if err != nil {
-			os.Remove(tmpFilename)
-			os.RemoveAll(targetDir)
-		}
-	}()
-
-	var f *os.File
-	f, err = os.Create(tmpFilename)
-	if err != nil {
-		return errors.Wrap(err, "create file")
+	maxSize := d.maxSize(url)
+	if maxSize > 0 && int64(fileLength) > maxSize {
+		return errors.Wrapf(ErrTooLarge, "%s > %s", datasize.ByteSize(fileLength).HR(), datasize.ByteSize(maxSize).HR())
+	}
+	if err := d.ensureFreeSpace(d.cacheRoot(url), int64(fileLength)); err != nil {
+		return err
 	}
 
 	st := &Status{
@@ -203,174 +583,626 @@ func (d *DownloadCache) download(url string, filename string) (err error) {
 
 	d.dashboard.Set(hash, st)
 	defer d.dashboard.Delete(hash)
+	done := make(chan bool)
+	defer close(done)
+	go d.events.publishProgress(hash, st, time.Second, done)
 
-	var size int64
-	size, err = io.Copy(io.MultiWriter(st, f), res.Body)
+	var body io.ReadCloser = res.Body
+	if d.IdleTimeout > 0 {
+		body = newIdleTimeoutReader(res.Body, d.IdleTimeout)
+		defer body.Close()
+	}
+	var reader io.Reader = body
+	if d.DownloadSpeed > 0 {
+		reader = newSpeedLimitReader(reader, d.DownloadSpeed)
+	}
+	if maxSize > 0 {
+		reader = &maxSizeReader{r: reader, remaining: maxSize}
+	}
+	m := &Meta{
+		URL:      url,
+		Filename: filename,
+		Status:   res.StatusCode,
+		FinalURL: res.Request.URL.String(),
+		Header:   make(map[string]string),
+	}
+	if res.ContentLength > 0 {
+		m.ContentLength = res.ContentLength
+	}
+	for _, key := range metaHeaders {
+		if v := res.Header.Get(key); v != "" {
+			m.Header[key] = v
+		}
+	}
+	var progress io.Writer = st
+	if journal := d.writeJournal(m, fetchURL, res); journal != nil {
+		defer os.Remove(journal.filename)
+		progress = io.MultiWriter(st, journal)
+	}
+	_, err = d.storeMeta(m, reader, progress, "")
+	return err
+}
+
+// maxSize return max file size of url, 0 means unlimited
+func (d *DownloadCache) maxSize(url string) int64 {
+	if rule := d.ruleOfURL(url); rule != nil && rule.MaxSize > 0 {
+		return rule.MaxSize
+	}
+	return d.MaxFileSize
+}
+
+// store save content read from body as the cache entry of url
+// sha256 of content is verified if expectSHA256 is not empty
+func (d *DownloadCache) store(url, filename string, body io.Reader, progress io.Writer, expectSHA256 string) (m *Meta, err error) {
+	return d.storeMeta(&Meta{URL: url, Filename: filename}, body, progress, expectSHA256)
+}
+
+// storeMeta is store with upstream response info filled in m
+func (d *DownloadCache) storeMeta(m *Meta, body io.Reader, progress io.Writer, expectSHA256 string) (_ *Meta, err error) {
+	start := time.Now()
+	url := m.URL
+	root := d.cacheRoot(url)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	tmpFilename := filepath.Join(root, HashString(url)+".tmp")
+	f, err := os.Create(tmpFilename)
 	if err != nil {
-		f.Close()
-		os.Remove(tmpFilename)
-		return err
+		return nil, errors.Wrap(err, "create file")
 	}
-	if err = f.Close(); err != nil {
-		return
+	defer func() {
+		if err != nil {
+			os.Remove(tmpFilename)
+		}
+	}()
+
+	hasher := sha256.New()
+	writers := []io.Writer{f, hasher}
+	if progress != nil {
+		writers = append(writers, progress)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if expectSHA256 != "" && !strings.EqualFold(checksum, expectSHA256) {
+		return nil, errors.Wrapf(ErrChecksumMismatch, "expect sha256 %s, got %s", expectSHA256, checksum)
 	}
 
+	targetDir := d.downloadDir(url)
 	if err = os.MkdirAll(targetDir, 0755); err != nil {
-		return err
+		return nil, err
 	}
-	targetPath := filepath.Join(targetDir, "cached.file")
-	if err = os.Rename(tmpFilename, targetPath); err != nil {
-		return err
+	if err = os.Rename(tmpFilename, filepath.Join(targetDir, "cached.file")); err != nil {
+		return nil, err
 	}
-	// time, url, size, filename
-	metaData, _ := json.Marshal(map[string]interface{}{
-		"filename": filename,
-		"size":     size,
-		"url":      url,
-		"time":     time.Now().Unix(), // seconds elapsed
-	})
-	err = ioutil.WriteFile(filepath.Join(targetDir, "meta.json"), metaData, 0644)
-	return err
+	m.Size = size
+	m.Time = time.Now().Unix()
+	m.SHA256 = checksum
+	m.DurationMillis = time.Since(start).Milliseconds()
+	if old, err := readMeta(targetDir); err == nil {
+		m.Hits, m.Tags, m.Note = old.Hits, old.Tags, old.Note // refreshed
+	}
+	if err = writeMeta(targetDir, m); err != nil {
+		d.removeEntry(targetDir)
+		return nil, err
+	}
+	d.replicated(m)
+	return m, nil
 }
 
 func (d *DownloadCache) downloadDir(url string) string {
+	url = d.cacheKey(url)
+	root := d.cacheRoot(url)
+	if d.Layout == LayoutURL {
+		return filepath.Join(root, urlLayoutDir(url))
+	}
 	hash := HashString(url)
-	return filepath.Join(d.CacheDir, hash[:2], hash[2:])
+	return filepath.Join(root, hash[:2], hash[2:])
+}
+
+// cacheRoot return cache dir of rule which url belongs to, default is CacheDir
+func (d *DownloadCache) cacheRoot(url string) string {
+	if rule := d.ruleOfURL(url); rule != nil && rule.CacheDir != "" {
+		return d.ruleCacheDir(rule)
+	}
+	return d.CacheDir
+}
+
+func (d *DownloadCache) ruleCacheDir(rule *MirrorRule) string {
+	if filepath.IsAbs(rule.CacheDir) {
+		return rule.CacheDir
+	}
+	return filepath.Join(d.CacheDir, rule.CacheDir)
+}
+
+// cacheRoots return CacheDir and cache dirs of rules
+func (d *DownloadCache) cacheRoots() []string {
+	roots := []string{filepath.Clean(d.CacheDir)}
+	rules := d.rules()
+	for i := range rules {
+		if rules[i].CacheDir == "" {
+			continue
+		}
+		dir := filepath.Clean(d.ruleCacheDir(&rules[i]))
+		exists := false
+		for _, root := range roots {
+			exists = exists || root == dir
+		}
+		if !exists {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
 }
 
 func (d *DownloadCache) IsCached(url string) bool {
-	_, err := os.Stat(d.downloadDir(url))
+	_, err := os.Stat(filepath.Join(d.downloadDir(url), "meta.json"))
 	return err == nil
 }
 
-func (d *DownloadCache) DownloadAndWait(url string, filename string) error {
+// cache status reported in X-Cache header
+const (
+	CacheHit   = "HIT"   // served from cache
+	CacheMiss  = "MISS"  // downloaded by this request
+	CacheWait  = "WAIT"  // waited for download started by another request
+	CacheStale = "STALE" // expired cache served, refreshing in background
+	// expired cache served because upstream failed
+	CacheStaleIfError = "STALE-IF-ERROR"
+	// upstream failed recently, error is returned without contacting upstream
+	CacheNegative = "NEGATIVE"
+)
+
+func (d *DownloadCache) DownloadAndWait(url string, filename string) (cacheStatus string, err error) {
+	return d.downloadAndWait(context.Background(), nil, url, filename)
+}
+
+// downloadAndWait is DownloadAndWait with settings of rule, rule can be nil
+func (d *DownloadCache) downloadAndWait(ctx context.Context, rule *MirrorRule, url string, filename string) (cacheStatus string, err error) {
 	if filename == "" {
 		filename = "cached.file"
 	}
 	dir := d.downloadDir(url)
+	hash := d.entryHash(url)
 	d.mu.Lock()
 	// check if file exists
 	if _, err := os.Stat(dir + "/meta.json"); err == nil {
 		d.mu.Unlock()
-		return nil
+		_, lookupSpan := tracer.Start(ctx, "cache lookup")
+		meta, err := verifyEntry(dir, d.VerifyChecksum)
+		endSpan(lookupSpan, err)
+		if err == nil {
+			if d.Offline || !d.isExpired(rule, meta) {
+				return CacheHit, nil
+			}
+			if d.StaleWhileRevalidate {
+				go d.refresh(url, filename, true)
+				return CacheStale, nil
+			}
+			err := d.refresh(url, filename, true)
+			if isUpstreamFailure(err) {
+				logWarnf("serve stale %s: %v", url, err)
+				return CacheStaleIfError, nil
+			}
+			return CacheMiss, err
+		}
+		logWarnf("%s %v, download again", url, err)
+		d.mu.Lock()
+		// make sure entry is not replaced by another request
+		if errors.Cause(err) == ErrCorrupt && !d.workers[hash] {
+			if m, err := readMeta(dir); err == nil && m.Time == meta.Time {
+				if err := d.quarantineLocked(dir); err != nil {
+					logErrorf("quarantine %s: %v", dir, err)
+					d.removeEntry(dir)
+				}
+			}
+		}
 	}
 
-	hash := HashString(url)
 	// check if downloading
 	if d.workers[hash] {
 		waitChan := d.unsafeAddWaiter(hash)
 		d.mu.Unlock()
 		log.Println("join wait", filename)
-		return <-waitChan // wait until finished
+		_, waitSpan := tracer.Start(ctx, "wait for worker")
+		err := <-waitChan // wait until finished
+		endSpan(waitSpan, err)
+		return CacheWait, err
+	}
+	if d.Offline {
+		d.mu.Unlock()
+		return CacheMiss, errors.Wrap(ErrOffline, url)
+	}
+	if err := d.negative.Get(url); err != nil {
+		d.mu.Unlock()
+		return CacheNegative, err
 	}
 	// start downloading
 	d.workers[hash] = true
 	d.mu.Unlock()
 
 	log.Println("download", filename)
-	err := d.download(url, filename)
+	err = d.downloadShared(detachContext(ctx), url, filename, time.Time{}, false)
+	d.negative.Put(url, err)
 
 	d.mu.Lock()
 	d.unsafeNotifyWaiters(hash, err)
 	d.mu.Unlock()
 	log.Println("finished", filename, err)
+	if err == nil {
+		d.fetchSidecars(url)
+	}
+	return CacheMiss, err
+}
+
+func (d *DownloadCache) isExpired(rule *MirrorRule, m *Meta) bool {
+	ttl := d.TTL
+	if rule != nil && rule.TTL > 0 {
+		ttl = rule.TTL
+	}
+	return ttl > 0 && time.Since(time.Unix(m.Time, 0)) > ttl
+}
+
+// refresh download url again, existing cache is replaced only when download succeeded
+// if revalidate, cache not modified upstream is renewed without download, see download
+func (d *DownloadCache) refresh(url string, filename string, revalidate bool) error {
+	if d.Offline {
+		return errors.Wrap(ErrOffline, url)
+	}
+	start := time.Now()
+	hash := d.entryHash(url)
+	d.mu.Lock()
+	if d.workers[hash] {
+		waitChan := d.unsafeAddWaiter(hash)
+		d.mu.Unlock()
+		return <-waitChan
+	}
+	d.workers[hash] = true
+	d.mu.Unlock()
+
+	log.Println("refresh", filename)
+	err := d.downloadShared(context.Background(), url, filename, start, revalidate)
+	d.negative.Put(url, err)
+	d.unlockWorker(hash, err)
+	log.Println("refreshed", filename, err)
 	return err
 }
 
+// renew mark entry as just downloaded after upstream answered 304, headers sent with 304 are updated
+func (d *DownloadCache) renew(url string, res *http.Response) error {
+	dir := d.downloadDir(url)
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	m, err := readMeta(dir)
+	if err != nil {
+		return err
+	}
+	for _, key := range metaHeaders {
+		if v := res.Header.Get(key); v != "" {
+			// etag was made weak if upstream sent the entry compressed
+			if key == "ETag" && strings.HasPrefix(m.Header[key], "W/") && !strings.HasPrefix(v, "W/") {
+				v = "W/" + v
+			}
+			m.Header[key] = v
+		}
+	}
+	m.Time = time.Now().Unix()
+	metricCacheRevalidated.Add(1)
+	log.Printf("%s not modified, renewed", url)
+	return writeMeta(dir, m)
+}
+
+// touchMeta increase hit counter, meta.json mtime is updated as well
+func (d *DownloadCache) touchMeta(dir string) (*Meta, error) {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	m, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	m.Hits++
+	return m, writeMeta(dir, m)
+}
+
 // ServeFile serve static file
 func (d *DownloadCache) ServeFile(w http.ResponseWriter, req *http.Request, url string) {
+	_, span := tracer.Start(req.Context(), "serve")
+	defer span.End()
 	dir := d.downloadDir(url)
-	metaPath := filepath.Join(dir, "meta.json")
-	metaData, err := ioutil.ReadFile(metaPath)
+	info, err := d.touchMeta(dir)
 	if err != nil {
-		http.Error(w, "404 Not Found", 404)
+		if os.IsNotExist(err) {
+			http.Error(w, "404 Not Found", 404)
+		} else {
+			http.Error(w, err.Error(), 500)
+		}
 		return
 	}
-	var info struct {
-		Filename string `json:"filename"`
-		Size     int    `json:"size"`
-		URL      string `json:"url"`
-		Time     int64  `json:"time"`
+
+	modtime := time.Unix(info.Time, 0)
+	age := int64(time.Since(modtime).Seconds())
+	if age < 0 {
+		age = 0
 	}
-	if err = json.Unmarshal(metaData, &info); err != nil {
-		http.Error(w, err.Error(), 500)
+	w.Header().Set("Age", strconv.FormatInt(age, 10))
+	if info.SHA256 != "" {
+		// strong etag, ServeContent answers If-None-Match with 304
+		w.Header().Set("ETag", `"`+info.SHA256+`"`)
+	}
+	if d.serveOffloaded(w, req, dir, info) {
 		return
 	}
-	mtime := time.Now()
-	os.Chtimes(metaPath, mtime, mtime)
-
 	f, err := os.Open(filepath.Join(dir, "cached.file"))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	defer f.Close()
-	modtime := time.Unix(info.Time, 0)
 	http.ServeContent(w, req, info.Filename, modtime, f)
 }
 
 type MirrorRule struct {
-	Pattern   *regexp.Regexp
-	URLPrefix string
+	Host        string // match request Host, *.example.com for subdomains, empty matches any host
+	Pattern     *regexp.Regexp
+	URLPrefix   string
+	ForwardAuth bool          // forward client Authorization header and skip caching
+	TTL         time.Duration // override DownloadCache.TTL if > 0
+	Upstreams   []string      // URLPrefix and its alternatives, the fastest is used for downloading
+	CacheDir    string        // store files in this dir instead of DownloadCache.CacheDir, relative to it if not absolute
+	Keep        time.Duration // override keep duration of Clean if > 0
+	MaxSize     int64         // override DownloadCache.MaxFileSize if > 0
+	Query       string        // query string in cache key, QueryKeep (default) or QueryStrip
+	StripParams []string      // query params removed from cache key, eg signatures which expire
 }
 
-// Clean remove file which not accessed to long
-// Note: every request will update meta.json mtime
-func (d *DownloadCache) Clean(keepDuration time.Duration) {
-	filepath.Walk(d.CacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", d.CacheDir, err)
-			return err
+// query string handling of cache keys
+const (
+	QueryKeep  = "keep"  // urls with different query are cached separately
+	QueryStrip = "strip" // query is ignored, but still sent to upstream
+)
+
+// cacheKey return url used as cache key, query is stripped as configured, url is returned if no query
+func (r *MirrorRule) cacheKey(url string) string {
+	i := strings.Index(url, "?")
+	if i < 0 || (r.Query != QueryStrip && len(r.StripParams) == 0) {
+		return url
+	}
+	if r.Query == QueryStrip {
+		return url[:i]
+	}
+	query := url[i+1:]
+	for _, name := range r.StripParams {
+		query, _ = removeQueryParam(query, name)
+	}
+	if query == "" {
+		return url[:i]
+	}
+	return url[:i+1] + query
+}
+
+// cacheKey return cache key of upstream url by its rule
+func (d *DownloadCache) cacheKey(url string) string {
+	if rule := d.ruleOfURL(url); rule != nil {
+		return rule.cacheKey(url)
+	}
+	return url
+}
+
+// entryHash identify cache entry of url in worker locks and events, urls of the same cache key share it
+func (d *DownloadCache) entryHash(url string) string {
+	return HashString(d.cacheKey(url))
+}
+
+func DefaultMirrorRules() []MirrorRule {
+	return []MirrorRule{
+		// gist raw url: /<user>/<gist-id>/raw/[<revision>/]<file>
+		{Pattern: regexp.MustCompile(`^/[^/]+/[0-9a-f]{20,32}/raw/`), URLPrefix: "https://gist.githubusercontent.com/"},
+		// blobs and manifests of ghcr.io, eg homebrew bottles
+		{Pattern: registryPattern, URLPrefix: "https://ghcr.io/"},
+		{Pattern: regexp.MustCompile(`^/`), URLPrefix: "https://github.com/"},
+	}
+}
+
+// ruleOfURL return first rule whose upstream contains url, nil if not found
+func (d *DownloadCache) ruleOfURL(url string) *MirrorRule {
+	rules := d.rules()
+	if i := ruleIndexOfURL(rules, url); i >= 0 {
+		return &rules[i]
+	}
+	return nil
+}
+
+// ruleIndexOfURL return index of first rule whose upstream contains url, -1 if not found
+func ruleIndexOfURL(rules []MirrorRule, url string) int {
+	for i := range rules {
+		prefix := strings.TrimSuffix(rules[i].URLPrefix, "/")
+		if strings.HasPrefix(url, prefix+"/") && rules[i].Pattern.MatchString(strings.TrimPrefix(url, prefix)) {
+			return i
 		}
-		if info.Name() != "meta.json" {
-			return nil
+	}
+	return -1
+}
+
+// matchHost report whether request host matches rule host
+func (r *MirrorRule) matchHost(host string) bool {
+	if r.Host == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return host == r.Host
+}
+
+// matchRule return first rule matches host and path, nil if not found
+func (d *DownloadCache) matchRule(host, path string) *MirrorRule {
+	rules := d.rules()
+	if i := matchRuleIndex(rules, host, path); i >= 0 {
+		return &rules[i]
+	}
+	return nil
+}
+
+// matchRuleIndex return index of first rule matches host and path, -1 if not found
+func matchRuleIndex(rules []MirrorRule, host, path string) int {
+	for i := range rules {
+		if rules[i].matchHost(host) && rules[i].Pattern.MatchString(path) {
+			return i
 		}
+	}
+	return -1
+}
+
+// CleanReport is number and total size of removed files
+type CleanReport struct {
+	Count  int           `json:"count"`
+	Size   int64         `json:"size"`
+	DryRun bool          `json:"dry_run"`
+	Files  []CleanedFile `json:"files"`
+}
+
+type CleanedFile struct {
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+	Idle string `json:"idle"` // time since last access
+}
 
+// Clean remove file which not accessed to long, popular files are kept longer
+// pinned files are never removed, if dryRun is true, only report what would be removed
+// Note: every request will update meta.json mtime
+func (d *DownloadCache) Clean(keepDuration time.Duration, dryRun bool) (report CleanReport) {
+	report.DryRun = dryRun
+	report.Files = make([]CleanedFile, 0)
+	d.pins.reloadIfChanged()
+	d.walkMeta(func(path string, info os.FileInfo) {
+		var hits, size int64
+		var url string
+		keep := keepDuration
+		if m, err := readMeta(filepath.Dir(path)); err == nil {
+			if d.pins.Match(m.URL) || d.keptByTag(m) {
+				return
+			}
+			hits, size, url = m.Hits, m.Size, m.URL
+			if rule := d.ruleOfURL(url); rule != nil && rule.Keep > 0 {
+				keep = rule.Keep
+			}
+		}
 		existsDuration := time.Since(info.ModTime())
-		if existsDuration > keepDuration {
+		if existsDuration > popularKeepDuration(keep, hits) {
+			report.Count++
+			report.Size += size
+			report.Files = append(report.Files, CleanedFile{URL: url, Size: size, Idle: existsDuration.Round(time.Second).String()})
+			if dryRun {
+				return
+			}
 			log.Println("clean", path, existsDuration)
-			os.RemoveAll(filepath.Dir(path))
+			d.removeEntry(filepath.Dir(path))
+			d.events.Publish(Event{Type: EventEvict, Hash: d.entryHash(url), URL: url})
 		}
-		return nil
 	})
+	return report
+}
+
+// Purge remove cached file of url
+func (d *DownloadCache) Purge(url string) error {
+	dir := d.downloadDir(url)
+	if !d.IsCached(url) {
+		return os.ErrNotExist
+	}
+	if err := d.removeEntry(dir); err != nil {
+		return err
+	}
+	log.Println("purge", url)
+	d.events.Publish(Event{Type: EventEvict, Hash: d.entryHash(url), URL: url})
+	return nil
 }
 
 func (d *DownloadCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.BasePath != "" {
+		if r.URL.Path == d.BasePath {
+			http.Redirect(w, r, d.BasePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, d.BasePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, d.BasePath)
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, d.BasePath)
+		r2.RequestURI = strings.TrimPrefix(r.RequestURI, d.BasePath)
+		r = r2
+	}
+	if d.CompressMinSize > 0 {
+		if encoding := acceptEncoding(r); encoding != "" {
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: d.CompressMinSize, method: r.Method}
+			defer cw.Close()
+			w = cw
+		}
+	}
 	d.serverMux.ServeHTTP(w, r)
 }
 
-var downcache *DownloadCache
+// commands are sub commands of github-mirror, serve is the default
+var commands = map[string]func(args []string) error{
+	"serve":    runServe,
+	"export":   runExport,
+	"import":   runImport,
+	"backup":   runBackup,
+	"restore":  runRestore,
+	"pin":      runPin,
+	"clean":    runClean,
+	"list":     runList,
+	"purge":    runPurge,
+	"prefetch": runPrefetch,
+	"stats":    runStats,
+	"service":  runService,
+	"migrate":  runMigrate,
+	"compact":  runCompact,
+}
 
-func main() {
-	var proxy string
-	flag.IntVar(&port, "p", 8000, "Listen port")
-	flag.StringVar(&proxy, "proxy", "", "Proxy addr or command to get proxy")
-	flag.StringVar(&dataDir, "d", "data", "cached data store path")
-	flag.Parse()
-
-	downcache = NewDownloadCache(dataDir)
-	go func() {
-		for {
-			downcache.Clean(time.Hour * 24 * 7)
-			time.Sleep(1 * time.Hour)
-		}
-	}()
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: github-mirror [command] [flags]\n\nCommands:")
+	fmt.Fprintln(os.Stderr, "  serve     run mirror server (default)")
+	fmt.Fprintln(os.Stderr, "  list      list cached files")
+	fmt.Fprintln(os.Stderr, "  stats     show cache statistics")
+	fmt.Fprintln(os.Stderr, "  clean     remove files not accessed for a duration")
+	fmt.Fprintln(os.Stderr, "  purge     remove cached files of urls")
+	fmt.Fprintln(os.Stderr, "  prefetch  download urls into cache")
+	fmt.Fprintln(os.Stderr, "  pin       pin urls never to be evicted")
+	fmt.Fprintln(os.Stderr, "  export    export cached files as tar archive")
+	fmt.Fprintln(os.Stderr, "  import    import tar archive created by export")
+	fmt.Fprintln(os.Stderr, "  backup    back up meta, state and optionally cached files")
+	fmt.Fprintln(os.Stderr, "  restore   rebuild data dir from backups")
+	fmt.Fprintln(os.Stderr, "  migrate   move cache entries to directories of current hash and layout")
+	fmt.Fprintln(os.Stderr, "  compact   hardlink duplicate files and remove orphaned directories")
+	fmt.Fprintln(os.Stderr, "  service   install, uninstall or run as windows service")
+	fmt.Fprintln(os.Stderr, "\nRun github-mirror <command> -h for help of command")
+}
 
-	if strings.HasPrefix(proxy, "http://") {
-		downcache.GetProxy = func() string {
-			return proxy
-		}
-	} else if proxy != "" {
-		downcache.GetProxy = func() string {
-			output, err := exec.Command("bash", "-c", proxy).Output()
-			if err != nil {
-				log.Printf("command: %s error %v", proxy, err)
-				return ""
-			} else {
-				return strings.TrimSpace(string(output))
-			}
-		}
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd(args); err != nil {
+		log.Fatal(err)
 	}
-	log.Printf("github-mirror listen on :%d", port)
-	http.ListenAndServe(":"+strconv.Itoa(port), downcache)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// MetaVersion is schema version of meta.json
+// 1: filename, size, url, time, hits, sha256
+// 2: add upstream status, headers, final url and download duration
+// 3: add content length announced by upstream
+const MetaVersion = 3
+
+// Meta is stored as meta.json beside cached.file
+type Meta struct {
+	Version  int    `json:"version"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+	Time     int64  `json:"time"` // seconds elapsed
+	Hits     int64  `json:"hits"` // times served
+	SHA256   string `json:"sha256,omitempty"`
+
+	Status         int               `json:"status,omitempty"`    // upstream response status
+	Header         map[string]string `json:"header,omitempty"`    // upstream response headers listed in metaHeaders
+	FinalURL       string            `json:"final_url,omitempty"` // url after redirects
+	DurationMillis int64             `json:"duration_ms,omitempty"`
+	ContentLength  int64             `json:"content_length,omitempty"` // 0 if upstream did not send it
+	Tags           []string          `json:"tags,omitempty"`           // set by admin, eg approved-v1.28
+	Note           string            `json:"note,omitempty"`
+
+	replica bool // received from replication, see Replicator
+}
+
+// metaHeaders are upstream response headers saved in meta
+var metaHeaders = []string{"Content-Type", "Content-Disposition", "ETag", "Last-Modified", "Cache-Control", "Expires"}
+
+// upgradeMeta convert meta of older schema to MetaVersion
+func upgradeMeta(m *Meta) {
+	// version 1 has no version field, fields added in 2 and 3 are optional and stay empty
+	m.Version = MetaVersion
+}
+
+func readMeta(dir string) (*Meta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	m := &Meta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Version < MetaVersion {
+		upgradeMeta(m)
+	}
+	return m, nil
+}
+
+// writeMeta write to a temp file first, so readers never see a partial meta.json
+func writeMeta(dir string, m *Meta) error {
+	m.Version = MetaVersion
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, "meta.json.tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, "meta.json"))
+}
+
+// Entry is a cached file
+type Entry struct {
+	*Meta
+	Dir        string    `json:"-"`
+	AccessTime time.Time `json:"access_time"` // meta.json mtime, updated on every request
+}
+
+// walkMeta call fn with every meta.json in cache dirs, quarantined entries are skipped
+func (d *DownloadCache) walkMeta(fn func(path string, info os.FileInfo)) {
+	roots := d.cacheRoots()
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if !os.IsNotExist(err) {
+					logErrorf("walk %s: %v", path, err)
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if info.Name() == quarantineDirName {
+					return filepath.SkipDir
+				}
+				for _, r := range roots {
+					if path != root && path == r {
+						return filepath.SkipDir // walked separately
+					}
+				}
+				return nil
+			}
+			if info.Name() == "meta.json" {
+				fn(path, info)
+			}
+			return nil
+		})
+	}
+}
+
+// Entries walk through cache dirs and return all cached files
+func (d *DownloadCache) Entries() ([]Entry, error) {
+	entries := make([]Entry, 0)
+	d.walkMeta(func(path string, info os.FileInfo) {
+		dir := filepath.Dir(path)
+		m, err := readMeta(dir)
+		if err != nil {
+			return
+		}
+		entries = append(entries, Entry{Meta: m, Dir: dir, AccessTime: info.ModTime()})
+	})
+	return entries, nil
+}
+
+// sortEntries sort by hits, size, time or access, descending
+func sortEntries(entries []Entry, by string) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch by {
+		case "size":
+			return a.Size > b.Size
+		case "time":
+			return a.Time > b.Time
+		case "access":
+			return a.AccessTime.After(b.AccessTime)
+		default:
+			return a.Hits > b.Hits
+		}
+	})
+}
+
+// popularKeepDuration extend keep duration for popular entries
+// 9 hits keeps twice as long, 99 hits three times
+func popularKeepDuration(keepDuration time.Duration, hits int64) time.Duration {
+	return time.Duration(float64(keepDuration) * (1 + math.Log10(float64(1+hits))))
+}
@@ -0,0 +1,36 @@
+package main
+
+import "expvar"
+
+// metrics exported at /debug/vars
+var (
+	metricCacheHit      = expvar.NewInt("cache_hit")
+	metricCacheMiss     = expvar.NewInt("cache_miss")
+	metricCacheWait     = expvar.NewInt("cache_wait")
+	metricCacheStale    = expvar.NewInt("cache_stale")
+	metricCacheNegative = expvar.NewInt("cache_negative")
+	// expired entries renewed by 304 of upstream
+	metricCacheRevalidated = expvar.NewInt("cache_revalidated")
+	// misses downloaded from p2p peers instead of upstream
+	metricPeerHits = expvar.NewInt("cache_peer_hits")
+
+	metricScrubChecked = expvar.NewInt("scrub_checked")
+	metricScrubCorrupt = expvar.NewInt("scrub_corrupt")
+	metricScrubLastRun = expvar.NewInt("scrub_last_run") // unix timestamp
+)
+
+// countCacheStatus increase counter of X-Cache status
+func countCacheStatus(status string) {
+	switch status {
+	case CacheHit:
+		metricCacheHit.Add(1)
+	case CacheMiss:
+		metricCacheMiss.Add(1)
+	case CacheWait:
+		metricCacheWait.Add(1)
+	case CacheStale, CacheStaleIfError:
+		metricCacheStale.Add(1)
+	case CacheNegative:
+		metricCacheNegative.Add(1)
+	}
+}
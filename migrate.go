@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Migrate move entries not stored in the directory computed from their url,
+// eg entries keyed by md5 of older versions, or cached with another layout
+func (d *DownloadCache) Migrate(dryRun bool) (moved int, err error) {
+	entries, err := d.Entries()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		target := d.downloadDir(e.URL)
+		if filepath.Clean(e.Dir) == filepath.Clean(target) {
+			continue
+		}
+		moved++
+		if dryRun {
+			fmt.Printf("%s -> %s\n", e.Dir, target)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(target, "meta.json")); err == nil {
+			// already cached again with new key
+			d.removeEntry(e.Dir)
+			continue
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return moved, err
+		}
+		for _, name := range []string{"cached.file", "meta.json"} {
+			if err := os.Rename(filepath.Join(e.Dir, name), filepath.Join(target, name)); err != nil {
+				return moved, err
+			}
+		}
+		d.pruneEmptyDirs(e.Dir)
+		log.Println("migrate", e.URL, target)
+	}
+	return moved, nil
+}
+
+func runMigrate(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("migrate", "[-d data] [-layout hash|url] [--dry-run]")
+	c.register(fs)
+	dryRun := fs.Bool("dry-run", false, "Only print entries to be moved")
+	fs.Parse(args)
+	if c.server != "" {
+		return errors.New("migrate works on data dir only, stop the server first")
+	}
+	d, err := c.cache()
+	if err != nil {
+		return err
+	}
+	moved, err := d.Migrate(*dryRun)
+	if *dryRun {
+		fmt.Printf("would move %d entries\n", moved)
+	} else {
+		fmt.Printf("moved %d entries\n", moved)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// metaQueryParam return stored metadata of a mirror url instead of the file, eg ?mirror-meta=1
+const metaQueryParam = "mirror-meta"
+
+// MirrorMeta is response of ?mirror-meta=1, scripts check size and checksum before downloading
+type MirrorMeta struct {
+	URL          string    `json:"url"` // upstream url
+	FinalURL     string    `json:"final_url,omitempty"`
+	Filename     string    `json:"filename"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	CachedAt     time.Time `json:"cached_at"`
+	Hits         int64     `json:"hits"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+}
+
+// serveMirrorMeta write metadata of cached url as json, 404 if not cached. nothing is downloaded
+func (d *DownloadCache) serveMirrorMeta(w http.ResponseWriter, url string) {
+	m, err := readMeta(d.downloadDir(url))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"url": url, "error": "not cached"})
+		return
+	}
+	writeJSON(w, MirrorMeta{
+		URL:          m.URL,
+		FinalURL:     m.FinalURL,
+		Filename:     m.Filename,
+		Size:         m.Size,
+		SHA256:       m.SHA256,
+		CachedAt:     time.Unix(m.Time, 0).UTC(),
+		Hits:         m.Hits,
+		ContentType:  m.Header["Content-Type"],
+		ETag:         m.Header["ETag"],
+		LastModified: m.Header["Last-Modified"],
+		Tags:         m.Tags,
+	})
+}
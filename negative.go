@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultNegativeTTL is how long upstream failures are remembered, keyed by status code or class
+const DefaultNegativeTTL = "404=1m,403=5m,429=5m,5xx=10s"
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+// negativeCache remember failed urls, so known-bad urls are not requested again before ttl
+type negativeCache struct {
+	ttls    map[string]time.Duration // eg 404, 4xx
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+// parseNegativeTTL parse list like 404=1m,5xx=10s
+func parseNegativeTTL(s string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for _, item := range splitComma(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid negative ttl %s, expect <status>=<duration>", strconv.Quote(item))
+		}
+		ttl, err := parseDuration(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		ttls[strings.ToLower(kv[0])] = ttl
+	}
+	return ttls, nil
+}
+
+func (n *negativeCache) ttl(statusCode int) time.Duration {
+	if ttl, ok := n.ttls[strconv.Itoa(statusCode)]; ok {
+		return ttl
+	}
+	return n.ttls[strconv.Itoa(statusCode/100)+"xx"]
+}
+
+// Get return remembered error of url, nil if not failed recently
+func (n *negativeCache) Get(url string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.entries[url]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(n.entries, url)
+		return nil
+	}
+	return e.err
+}
+
+// Put remember err of url if it is an upstream error with ttl configured, nil err forgets url
+func (n *negativeCache) Put(url string, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err == nil {
+		delete(n.entries, url)
+		return
+	}
+	ue, ok := errors.Cause(err).(*UpstreamError)
+	if !ok {
+		return
+	}
+	ttl := n.ttl(ue.StatusCode)
+	if ttl <= 0 {
+		return
+	}
+	if n.entries == nil {
+		n.entries = make(map[string]negativeEntry)
+	}
+	now := time.Now()
+	if len(n.entries) > 10000 {
+		for key, e := range n.entries {
+			if now.After(e.expires) {
+				delete(n.entries, key)
+			}
+		}
+	}
+	n.entries[url] = negativeEntry{err: err, expires: now.Add(ttl)}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// notifyInterval is the min interval between notifications of the same problem
+const notifyInterval = 30 * time.Minute
+
+// Notifier post alerts to a webhook in slack compatible format: {"text": "..."}
+type Notifier struct {
+	WebhookURL    string
+	FailThreshold int // alert after this many consecutive failures of an url or upstream host
+
+	mu           sync.Mutex
+	failures     map[string]int // by url
+	hostFailures map[string]int // by upstream host
+	sent         map[string]time.Time
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// Send post text in background, the same key is sent at most once per notifyInterval
+func (n *Notifier) Send(key, text string) {
+	if n.WebhookURL == "" {
+		return
+	}
+	n.mu.Lock()
+	if n.sent == nil {
+		n.sent = make(map[string]time.Time)
+	}
+	if last, ok := n.sent[key]; ok && time.Since(last) < notifyInterval {
+		n.mu.Unlock()
+		return
+	}
+	n.sent[key] = time.Now()
+	n.mu.Unlock()
+
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(map[string]string{"text": "[github-mirror " + hostname + "] " + text})
+	go func() {
+		res, err := notifyClient.Post(n.WebhookURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			logErrorf("notify: %v", err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			logErrorf("notify: webhook returns %s", res.Status)
+		}
+	}()
+}
+
+// downloadResult track download failures, alert on repeated failures, disk full and upstream outage
+func (n *Notifier) downloadResult(url string, err error) {
+	if n.WebhookURL == "" {
+		return
+	}
+	if ue, ok := errors.Cause(err).(*UpstreamError); ok && ue.StatusCode < 500 {
+		return // missing or forbidden files are not operator problems
+	}
+	host := url
+	if u, perr := neturl.Parse(url); perr == nil {
+		host = u.Host
+	}
+	n.mu.Lock()
+	if n.failures == nil {
+		n.failures = make(map[string]int)
+		n.hostFailures = make(map[string]int)
+	}
+	if err == nil {
+		delete(n.failures, url)
+		delete(n.hostFailures, host)
+		n.mu.Unlock()
+		return
+	}
+	n.failures[url]++
+	urlFailures := n.failures[url]
+	hostFailures := 0
+	if isUpstreamFailure(err) {
+		n.hostFailures[host]++
+		hostFailures = n.hostFailures[host]
+	}
+	n.mu.Unlock()
+
+	switch {
+	case errors.Cause(err) == ErrInsufficientStorage:
+		n.Send("disk", "disk space emergency: "+err.Error())
+	case hostFailures >= n.FailThreshold:
+		n.Send("outage "+host, "upstream "+host+" seems down, last error: "+err.Error())
+	case urlFailures >= n.FailThreshold:
+		n.Send("fail "+url, "download failed repeatedly: "+url+": "+err.Error())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GitHubOAuthURL is base url of github oauth authorize and access_token endpoints
+var GitHubOAuthURL = "https://github.com/login/oauth"
+
+const (
+	sessionCookie    = "github_mirror_session"
+	oauthStateCookie = "github_mirror_oauth"
+	sessionTTL       = 12 * time.Hour
+)
+
+// OAuth log in dashboard users with github, active members of Org are viewers, Admins are admins
+type OAuth struct {
+	ClientID     string
+	ClientSecret string
+	Org          string   // required org membership
+	Admins       []string // github logins with admin role
+	RedirectURL  string   // callback url registered in oauth app, default /_oauth/callback of request host
+}
+
+func (o *OAuth) role(login string) string {
+	for _, admin := range o.Admins {
+		if strings.EqualFold(admin, login) {
+			return RoleAdmin
+		}
+	}
+	return RoleViewer
+}
+
+// sessionSignature sign cookie value, key is shared with share links but the message differs
+func sessionSignature(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("session\n" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// session return login and role of oauth session cookie, ok is false if not logged in or expired
+func (d *DownloadCache) session(r *http.Request) (login, role string, ok bool) {
+	if d.OAuth == nil {
+		return "", "", false
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", "", false
+	}
+	// login|role|expires|signature
+	parts := strings.Split(c.Value, "|")
+	if len(parts) != 4 {
+		return "", "", false
+	}
+	key, err := d.shareKey()
+	if err != nil {
+		return "", "", false
+	}
+	value := strings.Join(parts[:3], "|")
+	if !hmac.Equal([]byte(parts[3]), []byte(sessionSignature(key, value))) {
+		return "", "", false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (d *DownloadCache) oauthRedirectURL(r *http.Request) string {
+	if d.OAuth.RedirectURL != "" {
+		return d.OAuth.RedirectURL
+	}
+	return d.mirrorBaseURL(r) + "/_oauth/callback"
+}
+
+// handleOAuthLogin redirect to github, ?next= is the page shown after login
+func (d *DownloadCache) handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	if d.OAuth == nil {
+		http.NotFound(w, r)
+		return
+	}
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = d.BasePath + "/_dashboard"
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	state := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Value: state + "|" + next, Path: d.BasePath + "/_oauth/",
+		MaxAge: 600, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	query := url.Values{
+		"client_id":    {d.OAuth.ClientID},
+		"redirect_uri": {d.oauthRedirectURL(r)},
+		"scope":        {"read:org"},
+		"state":        {state},
+	}
+	http.Redirect(w, r, GitHubOAuthURL+"/authorize?"+query.Encode(), http.StatusFound)
+}
+
+// handleOAuthCallback exchange code for token, check org membership and set session cookie
+func (d *DownloadCache) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if d.OAuth == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(oauthStateCookie)
+	parts := []string{""}
+	if err == nil {
+		parts = strings.SplitN(c.Value, "|", 2)
+	}
+	if len(parts) != 2 || parts[0] == "" || r.FormValue("state") != parts[0] {
+		http.Error(w, "400 invalid oauth state, login again", http.StatusBadRequest)
+		return
+	}
+	next := parts[1]
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: d.BasePath + "/_oauth/", MaxAge: -1})
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	login, err := d.OAuth.authenticate(ctx, r.FormValue("code"), d.oauthRedirectURL(r))
+	if err != nil {
+		http.Error(w, "403 Forbidden, "+err.Error(), http.StatusForbidden)
+		return
+	}
+	key, err := d.shareKey()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	role := d.OAuth.role(login)
+	value := login + "|" + role + "|" + strconv.FormatInt(time.Now().Add(sessionTTL).Unix(), 10)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: value + "|" + sessionSignature(key, value),
+		Path: d.BasePath + "/", MaxAge: int(sessionTTL.Seconds()), HttpOnly: true, Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode})
+	d.audit(r, AuditEntry{Action: "login", Status: http.StatusFound, Detail: "login=" + login + ", role=" + role})
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// loginHTML return login or logout link of dashboard, empty without oauth
+func (d *DownloadCache) loginHTML(r *http.Request) string {
+	if d.OAuth == nil {
+		return ""
+	}
+	if login, role, ok := d.session(r); ok {
+		return " | " + html.EscapeString(login) + " (" + role + ") <a href=\"" + d.BasePath + "/_oauth/logout\">logout</a>"
+	}
+	return " | <a href=\"" + d.BasePath + "/_oauth/login\">login with github</a>"
+}
+
+func (d *DownloadCache) handleOAuthLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: d.BasePath + "/", MaxAge: -1})
+	http.Redirect(w, r, d.BasePath+"/_dashboard", http.StatusFound)
+}
+
+// authenticate exchange code for user token, return login of user who is an active member of Org
+func (o *OAuth) authenticate(ctx context.Context, code, redirectURL string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+	form := url.Values{
+		"client_id":     {o.ClientID},
+		"client_secret": {o.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", GitHubOAuthURL+"/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error_description"`
+	}
+	if err := oauthDo(req, &token); err != nil {
+		return "", errors.Wrap(err, "access token")
+	}
+	if token.AccessToken == "" {
+		return "", errors.Errorf("access token: %s", token.Error)
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := oauthGet(ctx, token.AccessToken, "/user", &user); err != nil {
+		return "", errors.Wrap(err, "get user")
+	}
+	var membership struct {
+		State string `json:"state"`
+	}
+	if err := oauthGet(ctx, token.AccessToken, "/user/memberships/orgs/"+url.PathEscape(o.Org), &membership); err != nil || membership.State != "active" {
+		return "", errors.Errorf("%s is not a member of %s", user.Login, o.Org)
+	}
+	return user.Login, nil
+}
+
+// oauthGet call github api as the user
+func oauthGet(ctx context.Context, token, apiPath string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", GitHubAPI+apiPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return oauthDo(req, v)
+}
+
+func oauthDo(req *http.Request, v interface{}) error {
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &UpstreamError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOffline is returned for files not cached when running with -offline
+var ErrOffline = errors.New("mirror is offline, only cached files are served")
+
+// SetUpstreamOffline make every upstream connection fail with ErrOffline, nothing is dialed
+func SetUpstreamOffline() {
+	upstreamTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, ErrOffline
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedirectHits answer cache hits with 302 to a cdn or static file server whose origin is CacheDir,
+// so large files do not go through the mirror
+type RedirectHits struct {
+	BaseURL string        // eg https://cdn.corp/github-mirror
+	Secret  string        // sign urls like nginx secure_link, empty for unsigned urls
+	TTL     time.Duration // lifetime of signed urls
+}
+
+// URL return location of file, rel is slash separated path in CacheDir
+// signed urls have query md5 and expires, checked by nginx with
+// secure_link $arg_md5,$arg_expires; secure_link_md5 "$secure_link_expires$uri <secret>";
+func (rh *RedirectHits) URL(rel string) string {
+	location := strings.TrimSuffix(rh.BaseURL, "/") + "/" + rel
+	u, err := url.Parse(location)
+	if err != nil || rh.Secret == "" {
+		return location
+	}
+	expires := strconv.FormatInt(time.Now().Add(rh.TTL).Unix(), 10)
+	sum := md5.Sum([]byte(expires + u.EscapedPath() + " " + rh.Secret))
+	u.RawQuery = url.Values{"md5": {base64.RawURLEncoding.EncodeToString(sum[:])}, "expires": {expires}}.Encode()
+	return u.String()
+}
+
+// serveOffloaded let front proxy send cached file by X-Accel-Redirect (nginx) or X-Sendfile (apache, lighttpd),
+// or redirect client to a cdn. return false if not configured or file is outside CacheDir, then it is served by Go
+func (d *DownloadCache) serveOffloaded(w http.ResponseWriter, r *http.Request, dir string, m *Meta) bool {
+	file := filepath.Join(dir, "cached.file")
+	switch {
+	case d.RedirectHits != nil:
+		rel, err := filepath.Rel(d.CacheDir, file)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		w.Header().Set("Cache-Control", "private, no-store") // signed location expires
+		http.Redirect(w, r, d.RedirectHits.URL(filepath.ToSlash(rel)), http.StatusFound)
+		return true
+	case d.AccelRedirect != "":
+		rel, err := filepath.Rel(d.CacheDir, file)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		w.Header().Set("X-Accel-Redirect", path.Join(d.AccelRedirect, filepath.ToSlash(rel)))
+	case d.Sendfile:
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return false
+		}
+		w.Header().Set("X-Sendfile", abs)
+	default:
+		return false
+	}
+	// front proxy keeps Content-Type of response, the file name it sees is cached.file
+	contentType := mime.TypeByExtension(filepath.Ext(m.Filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	return true
+}
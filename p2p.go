@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Peers exchange cached files between mirror instances, eg one per office. each instance
+// advertises hashes of its cached urls at /_api/cache/hashes, misses are fetched from a peer
+// which has the url before falling back to upstream
+type Peers struct {
+	URLs     []string
+	Interval time.Duration // how often hashes of peers are fetched
+
+	mu     sync.Mutex
+	hashes map[string]map[string]string // peer -> url hash -> sha256 of content
+}
+
+// NewPeers create peers of mirror urls, eg http://office2:8000
+func NewPeers(urls []string, interval time.Duration) *Peers {
+	p := &Peers{Interval: interval, hashes: make(map[string]map[string]string)}
+	for _, u := range urls {
+		p.URLs = append(p.URLs, strings.TrimSuffix(u, "/"))
+	}
+	return p
+}
+
+// Start fetch hashes of all peers every Interval
+func (p *Peers) Start() {
+	go func() {
+		for {
+			for _, peer := range p.URLs {
+				if err := p.update(peer); err != nil {
+					logWarnf("p2p %s: %v", peer, err)
+				}
+			}
+			time.Sleep(p.Interval)
+		}
+	}()
+}
+
+func (p *Peers) update(peer string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	res, err := peerGet(ctx, peer+"/_api/cache/hashes")
+	if err != nil {
+		p.set(peer, nil) // unreachable peer has nothing
+		return err
+	}
+	defer res.Body.Close()
+	hashes := make(map[string]string)
+	if err := json.NewDecoder(res.Body).Decode(&hashes); err != nil {
+		p.set(peer, nil)
+		return errors.Wrap(err, "decode hashes")
+	}
+	p.set(peer, hashes)
+	return nil
+}
+
+func (p *Peers) set(peer string, hashes map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hashes[peer] = hashes
+}
+
+// peerFile is a cached file advertised by peer
+type peerFile struct {
+	Peer   string
+	SHA256 string
+}
+
+// Lookup return peers which have the url hash, in configured order
+func (p *Peers) Lookup(hash string) []peerFile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var files []peerFile
+	for _, peer := range p.URLs {
+		if sum, ok := p.hashes[peer][hash]; ok {
+			files = append(files, peerFile{Peer: peer, SHA256: sum})
+		}
+	}
+	return files
+}
+
+// Forget remove url hash of peer, eg the peer evicted it since last update
+func (p *Peers) Forget(peer, hash string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.hashes[peer], hash)
+}
+
+// handleAPICacheHashes advertise cached urls to peers, as url hash to sha256 of content
+func (d *DownloadCache) handleAPICacheHashes(w http.ResponseWriter, r *http.Request) {
+	entries, err := d.Entries()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	hashes := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if !d.privateURL(e.URL) {
+			hashes[d.entryHash(e.URL)] = e.SHA256
+		}
+	}
+	writeJSON(w, hashes)
+}
+
+// fetch download url from a peer which has it, or from upstream
+// peers are only asked for urls not cached yet, refreshes always go to upstream
+func (d *DownloadCache) fetch(ctx context.Context, url, filename string, conditional bool) error {
+	if d.peers != nil && !conditional && !d.IsCached(url) {
+		if err := d.downloadFromPeer(ctx, url); err == nil {
+			return nil
+		} else if err != errNoPeer {
+			logWarnf("p2p %s: %v, download from upstream", url, err)
+		}
+	}
+	return d.download(ctx, url, filename, conditional)
+}
+
+var errNoPeer = errors.New("no peer has the url")
+
+func (d *DownloadCache) downloadFromPeer(ctx context.Context, rawurl string) error {
+	hash := d.entryHash(rawurl)
+	files := d.peers.Lookup(hash)
+	if len(files) == 0 {
+		return errNoPeer
+	}
+	var err error
+	for _, f := range files {
+		if err = d.storeFromPeer(ctx, f.Peer, rawurl, f.SHA256); err == nil {
+			log.Printf("p2p %s from %s", rawurl, f.Peer)
+			metricPeerHits.Add(1)
+			return nil
+		}
+		d.peers.Forget(f.Peer, hash)
+	}
+	return err
+}
+
+// storeFromPeer download cached file of peer with its meta, content must match advertised checksum
+func (d *DownloadCache) storeFromPeer(ctx context.Context, peer, rawurl, checksum string) error {
+	res, err := peerGet(ctx, peer+"/_api/cache/file?url="+url.QueryEscape(rawurl))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	m := &Meta{}
+	if v := res.Header.Get("X-Mirror-Meta"); v != "" {
+		if err := json.Unmarshal([]byte(v), m); err != nil {
+			return errors.Wrap(err, "invalid X-Mirror-Meta")
+		}
+	}
+	m.URL, m.Hits = rawurl, 0
+	if m.Filename == "" {
+		m.Filename = path.Base(strings.SplitN(rawurl, "?", 2)[0])
+	}
+	_, err = d.storeMeta(m, res.Body, nil, checksum)
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pins is a list of url patterns never evicted, stored in <CacheDir>/pins.json
+// pattern is an url, * matches any characters, eg https://github.com/kubernetes/kubectl/*
+type Pins struct {
+	filename string
+	mu       sync.RWMutex
+	patterns []string
+	regexps  []*regexp.Regexp
+	modTime  time.Time
+}
+
+func NewPins(filename string) *Pins {
+	p := &Pins{filename: filename}
+	p.reloadIfChanged()
+	return p
+}
+
+// globRegexp compile url pattern, only * is a wildcard, ? is literal as it starts the query of urls
+func globRegexp(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// reloadIfChanged load pins.json again if it is modified by other process, eg: pin command
+func (p *Pins) reloadIfChanged() error {
+	fi, err := os.Stat(p.filename)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fi.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(p.filename)
+	if err != nil {
+		return err
+	}
+	var patterns []string
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return err
+	}
+	p.setPatterns(patterns)
+	p.modTime = fi.ModTime()
+	return nil
+}
+
+func (p *Pins) setPatterns(patterns []string) {
+	p.patterns = patterns
+	p.regexps = make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		p.regexps[i] = globRegexp(pattern)
+	}
+}
+
+func (p *Pins) save() error {
+	data, _ := json.MarshalIndent(p.patterns, "", "  ")
+	if err := ioutil.WriteFile(p.filename, data, 0644); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(p.filename); err == nil {
+		p.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+func (p *Pins) Add(pattern string) error {
+	p.reloadIfChanged()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.patterns {
+		if v == pattern {
+			return nil
+		}
+	}
+	p.setPatterns(append(p.patterns, pattern))
+	return p.save()
+}
+
+// Remove return false if pattern not exists
+func (p *Pins) Remove(pattern string) (bool, error) {
+	p.reloadIfChanged()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.patterns {
+		if v == pattern {
+			patterns := append(p.patterns[:i:i], p.patterns[i+1:]...)
+			p.setPatterns(patterns)
+			return true, p.save()
+		}
+	}
+	return false, nil
+}
+
+func (p *Pins) List() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string{}, p.patterns...)
+}
+
+func (p *Pins) Match(url string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, re := range p.regexps {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAPIPins GET list pins, POST add pin, DELETE remove pin
+// query: pattern=<url or glob>
+func (d *DownloadCache) handleAPIPins(w http.ResponseWriter, r *http.Request) {
+	pattern := r.FormValue("pattern")
+	switch r.Method {
+	case "GET":
+		d.pins.reloadIfChanged()
+		writeJSON(w, d.pins.List())
+		return
+	case "POST", "PUT":
+		if pattern == "" {
+			http.Error(w, "pattern is required", http.StatusBadRequest)
+			return
+		}
+		if err := d.pins.Add(pattern); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	case "DELETE":
+		ok, err := d.pins.Remove(pattern)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "pattern not pinned", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, d.pins.List())
+}
+
+func runPin(args []string) error {
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	dir := fs.String("d", "data", "cached data store path")
+	remove := fs.Bool("rm", false, "unpin patterns")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-mirror pin [-d data] [-rm] [pattern ...]\nList pins if no pattern given, * in pattern matches any characters")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	d := NewDownloadCache(*dir)
+	for _, pattern := range fs.Args() {
+		if *remove {
+			if ok, err := d.pins.Remove(pattern); err != nil {
+				return err
+			} else if !ok {
+				fmt.Fprintln(os.Stderr, "not pinned:", pattern)
+			}
+		} else if err := d.pins.Add(pattern); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range d.pins.List() {
+		fmt.Println(pattern)
+	}
+	return nil
+}
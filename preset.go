@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ttl of preset rules
+const (
+	immutableTTL = 10 * 365 * 24 * time.Hour // released versions never change
+	mutableTTL   = 10 * time.Minute          // version lists, channels and latest
+)
+
+// presets are named rule bundles for well known download sites, installed with -preset
+var presets = map[string]func() []MirrorRule{
+	"actions": ActionsRules,
+	"github":  DefaultMirrorRules,
+	"go":      GoToolchainRules,
+	"golang":  func() []MirrorRule { return append(GoToolchainRules(), GoProxyRules()...) },
+	"goproxy": GoProxyRules,
+	"nodejs":  NodejsRules,
+	"rust":    RustRules,
+}
+
+// GoToolchainRules return rules mirroring go release downloads, eg /dl/go1.21.0.linux-amd64.tar.gz.
+// go.dev/dl/ redirects to dl.google.com/go/, both paths are cached
+func GoToolchainRules() []MirrorRule {
+	return []MirrorRule{
+		{Pattern: regexp.MustCompile(`^/dl/$`), URLPrefix: "https://go.dev/", TTL: mutableTTL}, // ?mode=json
+		{Pattern: regexp.MustCompile(`^/dl/go[0-9][^/]*\.(tar\.gz|zip|msi|pkg)(\.sha256)?$`), URLPrefix: "https://go.dev/", TTL: immutableTTL},
+		{Pattern: regexp.MustCompile(`^/go/go[0-9][^/]*\.(tar\.gz|zip|msi|pkg)(\.sha256|\.asc)?$`), URLPrefix: "https://dl.google.com/", TTL: immutableTTL},
+	}
+}
+
+// NodejsRules return rules mirroring nodejs.org/dist, for NVM_NODEJS_ORG_MIRROR=http://mirror:8000/dist
+func NodejsRules() []MirrorRule {
+	return []MirrorRule{
+		{Pattern: regexp.MustCompile(`^/dist/index\.(json|tab)$`), URLPrefix: "https://nodejs.org/", TTL: mutableTTL},
+		{Pattern: regexp.MustCompile(`^/dist/(latest[^/]*|node-latest\.tar\.gz)(/|$)`), URLPrefix: "https://nodejs.org/", TTL: mutableTTL},
+		{Pattern: regexp.MustCompile(`^/dist/v[0-9][^/]*/`), URLPrefix: "https://nodejs.org/", TTL: immutableTTL},
+	}
+}
+
+// RustRules return rules mirroring static.rust-lang.org, for RUSTUP_DIST_SERVER=http://mirror:8000
+// and RUSTUP_UPDATE_ROOT=http://mirror:8000/rustup
+func RustRules() []MirrorRule {
+	return []MirrorRule{
+		{Pattern: regexp.MustCompile(`^/dist/channel-rust-[^/]+\.toml(\.sha256|\.asc)?$`), URLPrefix: "https://static.rust-lang.org/", TTL: mutableTTL},
+		{Pattern: regexp.MustCompile(`^/dist/[0-9]{4}-[0-9]{2}-[0-9]{2}/`), URLPrefix: "https://static.rust-lang.org/", TTL: immutableTTL},
+		{Pattern: regexp.MustCompile(`^/dist/[a-z][a-z0-9-]*-[0-9][^/]*$`), URLPrefix: "https://static.rust-lang.org/", TTL: immutableTTL},
+		{Pattern: regexp.MustCompile(`^/rustup/archive/`), URLPrefix: "https://static.rust-lang.org/", TTL: immutableTTL},
+		{Pattern: regexp.MustCompile(`^/rustup/(release-stable\.toml|dist/)`), URLPrefix: "https://static.rust-lang.org/", TTL: mutableTTL},
+	}
+}
+
+// ActionsRules return rules for self-hosted github actions runners: runner releases, tool cache
+// (actions/python-versions etc) and their versions-manifest.json used by actions/setup-*.
+// release assets redirect to objects.githubusercontent.com or *.blob.core.windows.net,
+// redirects are followed by the mirror, so runners never reach blob storage
+func ActionsRules() []MirrorRule {
+	return []MirrorRule{
+		{Pattern: regexp.MustCompile(`^/actions/[^/]+/releases/download/`), URLPrefix: "https://github.com/", TTL: immutableTTL},
+		{Pattern: regexp.MustCompile(`^/actions/[^/]+-versions/[^/]+/versions-manifest\.json$`), URLPrefix: "https://raw.githubusercontent.com/", TTL: mutableTTL},
+		{Pattern: regexp.MustCompile(`^/repos/actions/[^/]+/releases/latest$`), URLPrefix: "https://api.github.com/", TTL: mutableTTL},
+	}
+}
+
+// isCatchAll report whether rule matches any path of any host, eg ^/ of github
+func (r *MirrorRule) isCatchAll() bool {
+	return r.Host == "" && r.Pattern.String() == "^/"
+}
+
+// withPresets add rules of comma separated preset names before configured rules,
+// catch-all rules of presets are added after them, so they do not hide configured rules
+func withPresets(configured []MirrorRule, names string) ([]MirrorRule, error) {
+	var rules, fallback []MirrorRule
+	for _, name := range splitComma(names) {
+		preset, ok := presets[strings.ToLower(name)]
+		if !ok {
+			return nil, errors.Errorf("unknown preset %q, available: %s", name, strings.Join(presetNames(), ","))
+		}
+		for _, rule := range preset() {
+			if rule.isCatchAll() {
+				fallback = append(fallback, rule)
+			} else {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return append(append(rules, configured...), fallback...), nil
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ip privacy modes of audit log and usage stats
+const (
+	PrivacyNone     = ""         // full ip
+	PrivacyTruncate = "truncate" // ipv4 /24, ipv6 /48, eg 10.1.2.0
+	PrivacyHash     = "hash"     // keyed hash, same ip always maps to the same value
+)
+
+func checkPrivacyMode(mode string) error {
+	switch mode {
+	case PrivacyNone, PrivacyTruncate, PrivacyHash:
+		return nil
+	}
+	return errors.Errorf("invalid ip privacy mode %s, must be truncate or hash", strconv.Quote(mode))
+}
+
+// anonymizeIP apply IPPrivacy to client, non ip clients (eg key:<name>) are returned as is
+func (d *DownloadCache) anonymizeIP(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return client
+	}
+	switch d.IPPrivacy {
+	case PrivacyTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case PrivacyHash:
+		// share key is secret and persistent, so hashes can not be reversed by brute force
+		// and stay comparable across restarts
+		key, err := d.shareKey()
+		if err != nil {
+			return "anon"
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(ip)
+		return "anon-" + hex.EncodeToString(mac.Sum(nil))[:12]
+	}
+	return client
+}
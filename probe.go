@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeBytes is read from upstream to measure throughput
+const probeBytes = 256 << 10
+
+// ProbeResult is latency and throughput of an upstream prefix
+type ProbeResult struct {
+	Upstream   string        `json:"upstream"`
+	Healthy    bool          `json:"healthy"`
+	Latency    time.Duration `json:"latency"`    // time to response header
+	Throughput float64       `json:"throughput"` // bytes per second
+	Error      string        `json:"error,omitempty"`
+	Time       time.Time     `json:"time"`
+}
+
+// upstreamProber keep latest probe results of rules with multiple upstreams
+type upstreamProber struct {
+	mu      sync.Mutex
+	results map[string]ProbeResult
+}
+
+func probeUpstream(prefix string) ProbeResult {
+	result := ProbeResult{Upstream: prefix, Time: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := newUpstreamRequest(ctx, "GET", prefix)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	start := time.Now()
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer res.Body.Close()
+	result.Latency = time.Since(start)
+	if res.StatusCode >= 500 {
+		result.Error = res.Status
+		return result
+	}
+	n, _ := io.Copy(io.Discard, io.LimitReader(res.Body, probeBytes))
+	if elapsed := time.Since(start); elapsed > 0 {
+		result.Throughput = float64(n) / elapsed.Seconds()
+	}
+	result.Healthy = true
+	return result
+}
+
+// ProbeLoop probe upstreams of rules with alternatives every interval
+func (d *DownloadCache) ProbeLoop(interval time.Duration) {
+	for {
+		for _, rule := range d.rules() {
+			if len(rule.Upstreams) < 2 {
+				continue
+			}
+			for _, prefix := range rule.Upstreams {
+				result := probeUpstream(prefix)
+				if !result.Healthy {
+					logWarnf("probe %s: %s", prefix, result.Error)
+				}
+				d.prober.mu.Lock()
+				if d.prober.results == nil {
+					d.prober.results = make(map[string]ProbeResult)
+				}
+				d.prober.results[prefix] = result
+				d.prober.mu.Unlock()
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// fastestUpstream return healthy upstream with lowest latency, URLPrefix if none probed
+func (d *DownloadCache) fastestUpstream(rule *MirrorRule) string {
+	best := rule.URLPrefix
+	var bestLatency time.Duration
+	d.prober.mu.Lock()
+	defer d.prober.mu.Unlock()
+	for _, prefix := range rule.Upstreams {
+		r, ok := d.prober.results[prefix]
+		if ok && r.Healthy && (bestLatency == 0 || r.Latency < bestLatency) {
+			best, bestLatency = prefix, r.Latency
+		}
+	}
+	return best
+}
+
+// fetchURL return url to download from, url is rewritten to fastest upstream of its rule
+// cache is always keyed by url of the first upstream
+func (d *DownloadCache) fetchURL(url string) string {
+	rule := d.ruleOfURL(url)
+	if rule == nil || len(rule.Upstreams) < 2 {
+		return url
+	}
+	prefix := d.fastestUpstream(rule)
+	if prefix == rule.URLPrefix {
+		return url
+	}
+	return strings.TrimSuffix(prefix, "/") + strings.TrimPrefix(url, strings.TrimSuffix(rule.URLPrefix, "/"))
+}
+
+// ProbeResults return latest probe results sorted by upstream
+func (d *DownloadCache) ProbeResults() []ProbeResult {
+	d.prober.mu.Lock()
+	defer d.prober.mu.Unlock()
+	results := make([]ProbeResult, 0, len(d.prober.results))
+	for _, r := range d.prober.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Upstream < results[j].Upstream
+	})
+	return results
+}
+
+// probeHTML render probe results for dashboard, empty if no rule has alternatives
+func (d *DownloadCache) probeHTML() string {
+	results := d.ProbeResults()
+	if len(results) == 0 {
+		return ""
+	}
+	output := "<h3>Upstreams</h3><ul>"
+	for _, r := range results {
+		state := fmt.Sprintf("%v, %.1f KB/s", r.Latency.Round(time.Millisecond), r.Throughput/1024)
+		if !r.Healthy {
+			state = "unhealthy: " + r.Error
+		}
+		output += "<li>" + html.EscapeString(r.Upstream) + "&nbsp;&nbsp;" + html.EscapeString(state) + "</li>"
+	}
+	return output + "</ul>"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// CacheBypass is reported in X-Cache header when response is not cached
+const CacheBypass = "BYPASS"
+
+// headers copied between client and upstream in passThrough
+var (
+	passRequestHeaders  = []string{"Accept", "Range", "If-None-Match", "If-Modified-Since"}
+	passResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Content-Disposition",
+		"Accept-Ranges", "Last-Modified", "ETag", "Content-Encoding", "Vary"}
+)
+
+// passThrough stream upstream response to client without caching
+func (d *DownloadCache) passThrough(w http.ResponseWriter, r *http.Request, url string, header http.Header) {
+	req, err := newUpstreamRequest(r.Context(), r.Method, url)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for _, key := range passRequestHeaders {
+		if v := r.Header.Get(key); v != "" {
+			req.Header.Set(key, v)
+		}
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for _, key := range passResponseHeaders {
+		if v := res.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("X-Cache", CacheBypass)
+	w.WriteHeader(res.StatusCode)
+	if _, err := io.Copy(w, res.Body); err != nil {
+		logWarnf("pass through %s: %v", url, err)
+	}
+}
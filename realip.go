@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TrustedProxies is the networks of reverse proxies whose X-Forwarded-For and X-Real-IP are honored
+var TrustedProxies []*net.IPNet
+
+// TrustUnixSocket honor forwarded headers of unix socket peers, eg nginx in front of -listen unix://
+var TrustUnixSocket bool
+
+// SetTrustedProxies parse CIDR list, plain ip is treated as a single host network, unix for unix socket peers
+func SetTrustedProxies(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	unix := false
+	for _, s := range cidrs {
+		if s == "unix" {
+			unix = true
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return errors.Wrap(err, "trusted proxy")
+		}
+		nets = append(nets, ipnet)
+	}
+	TrustedProxies, TrustUnixSocket = nets, unix
+	return nil
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP return ip address of the client
+// forwarded headers are only used when the peer is a trusted proxy
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// unix socket
+		if !TrustUnixSocket {
+			return r.RemoteAddr
+		}
+		host = r.RemoteAddr
+	} else if !isTrustedProxy(host) {
+		return host
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// rightmost address not belong to trusted proxies is the real client
+		hops := splitComma(xff)
+		for i := len(hops) - 1; i >= 0; i-- {
+			if net.ParseIP(hops[i]) == nil {
+				break
+			}
+			host = hops[i]
+			if !isTrustedProxy(host) {
+				break
+			}
+		}
+		return host
+	}
+	if xrip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xrip) != nil {
+		return xrip
+	}
+	return host
+}
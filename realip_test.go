@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPUnixSocket(t *testing.T) {
+	defer SetTrustedProxies(nil)
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	if err := SetTrustedProxies(nil); err != nil {
+		t.Fatal(err)
+	}
+	if ip := clientIP(r); ip != "@" {
+		t.Errorf("untrusted unix socket: got %s, want @", ip)
+	}
+	if isLoopback(r) {
+		t.Error("unix socket peer is loopback")
+	}
+
+	if err := SetTrustedProxies([]string{"unix"}); err != nil {
+		t.Fatal(err)
+	}
+	if ip := clientIP(r); ip != "203.0.113.7" {
+		t.Errorf("trusted unix socket: got %s, want 203.0.113.7", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "")
+	r.Header.Set("X-Real-IP", "198.51.100.2")
+	if ip := clientIP(r); ip != "198.51.100.2" {
+		t.Errorf("trusted unix socket with X-Real-IP: got %s, want 198.51.100.2", ip)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// downloadJournal is written as <root>/<hash>.journal while <hash>.tmp is being downloaded,
+// so a download interrupted by crash can be resumed with a range request on next start
+type downloadJournal struct {
+	Meta     *Meta  `json:"meta"`
+	FetchURL string `json:"fetch_url"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"` // bytes of .tmp synced to disk, 0 if not synced yet
+}
+
+func journalFilename(root, url string) string {
+	return filepath.Join(root, HashString(url)+".journal")
+}
+
+// journalSyncInterval is how often download progress is synced to disk and recorded in journal
+var journalSyncInterval = 5 * time.Second
+
+// journalProgress is a progress writer of storeMeta, it periodically syncs .tmp and records
+// the offset in journal, so after a power loss the download resumes from data on disk
+type journalProgress struct {
+	filename string
+	tmp      string
+	j        downloadJournal
+	written  int64
+	synced   time.Time
+}
+
+func newJournalProgress(filename, tmp string, j downloadJournal) *journalProgress {
+	return &journalProgress{filename: filename, tmp: tmp, j: j, synced: time.Now()}
+}
+
+func (p *journalProgress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.synced) >= journalSyncInterval {
+		p.synced = time.Now()
+		p.save()
+	}
+	return len(b), nil
+}
+
+// save sync .tmp and record offset, fsync through another descriptor flushes the file as well
+func (p *journalProgress) save() {
+	f, err := os.OpenFile(p.tmp, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		logErrorf("sync %s: %v", p.tmp, err)
+		return
+	}
+	p.j.Offset = p.written
+	data, _ := json.Marshal(p.j)
+	if err := ioutil.WriteFile(p.filename, data, 0644); err != nil {
+		logErrorf("write journal: %v", err)
+	}
+}
+
+// writeJournal record a download which can be resumed, the caller removes the journal when download ends
+// return nil if upstream does not support range requests or has no validator
+func (d *DownloadCache) writeJournal(m *Meta, fetchURL string, res *http.Response) *journalProgress {
+	validator := res.Header.Get("ETag")
+	if validator == "" {
+		validator = res.Header.Get("Last-Modified")
+	}
+	if res.Header.Get("Accept-Ranges") != "bytes" || validator == "" || res.ContentLength <= 0 {
+		return nil
+	}
+	j := downloadJournal{Meta: m, FetchURL: fetchURL, Size: res.ContentLength}
+	data, _ := json.Marshal(j)
+	root := d.cacheRoot(m.URL)
+	filename := journalFilename(root, m.URL)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		logErrorf("write journal: %v", err)
+		return nil
+	}
+	return newJournalProgress(filename, filepath.Join(root, HashString(m.URL)+".tmp"), j)
+}
+
+// stalePartialAge is how long partial files without journal are kept in a shared cache dir,
+// they may be written by a running download of another instance
+const stalePartialAge = time.Hour
+
+// RecoverPartial handle .tmp files left by a crash, resumable ones are continued in background
+// and others are removed. it must be called before serving, so new downloads do not overwrite them
+func (d *DownloadCache) RecoverPartial() {
+	for _, root := range d.cacheRoots() {
+		bases := make(map[string]bool)
+		for _, ext := range []string{".tmp", ".resume", ".journal"} {
+			names, _ := filepath.Glob(filepath.Join(root, "*"+ext))
+			for _, name := range names {
+				bases[strings.TrimSuffix(name, ext)] = true
+			}
+		}
+		for base := range bases {
+			d.recoverPartial(base)
+		}
+	}
+}
+
+// recoverPartial resume or remove <base>.tmp, .resume and .journal of one interrupted download.
+// in a shared cache dir the shared lock of the download is taken first, other instances hold it
+// while downloading, and it is held until the resume ends
+func (d *DownloadCache) recoverPartial(base string) {
+	tmp, resume, journal := base+".tmp", base+".resume", base+".journal"
+	var j downloadJournal
+	data, err := ioutil.ReadFile(journal)
+	if err == nil {
+		err = json.Unmarshal(data, &j)
+	}
+	if err == nil && (j.Meta == nil || j.Size <= 0) {
+		err = errors.New("invalid journal")
+	}
+	unlock := func() {}
+	if d.sharedLock != nil {
+		if err != nil {
+			if !partialStale(tmp, resume, journal) {
+				return
+			}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			u, lerr := d.sharedLock.Lock(ctx, d.entryHash(j.Meta.URL))
+			cancel()
+			if lerr != nil {
+				log.Printf("skip partial download %s: %v", tmp, lerr) // being downloaded by another instance
+				return
+			}
+			unlock = u
+		}
+	}
+	// resume interrupted by crash, try again from the longer one of partial files
+	if old, serr := os.Stat(resume); serr == nil {
+		if fi, serr := os.Stat(tmp); serr == nil && fi.Size() >= old.Size() {
+			os.Remove(resume)
+		} else {
+			os.Rename(resume, tmp)
+		}
+	}
+	if _, serr := os.Stat(tmp); os.IsNotExist(serr) {
+		os.Remove(journal)
+		unlock()
+		return
+	}
+	if err != nil || d.Offline || !d.lockWorker(d.entryHash(j.Meta.URL)) {
+		log.Printf("remove partial download %s", tmp)
+		os.Remove(tmp)
+		os.Remove(journal)
+		unlock()
+		return
+	}
+	if err := os.Rename(tmp, resume); err != nil {
+		d.unlockWorker(d.entryHash(j.Meta.URL), err)
+		os.Remove(journal)
+		unlock()
+		return
+	}
+	go func() {
+		defer unlock()
+		err := d.resumeDownload(j, resume)
+		log.Printf("resume %s: %v", j.Meta.URL, err)
+		d.negative.Put(j.Meta.URL, err)
+		d.unlockWorker(d.entryHash(j.Meta.URL), err)
+		os.Remove(resume)
+		os.Remove(journal)
+	}()
+}
+
+// partialStale report whether none of files is modified in stalePartialAge
+func partialStale(names ...string) bool {
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) < stalePartialAge {
+			return false
+		}
+	}
+	return true
+}
+
+// resumeDownload request the rest of partial file, whole file is stored again to compute its checksum
+// bytes after the synced offset of journal may not have survived a power loss, they are dropped
+func (d *DownloadCache) resumeDownload(j downloadJournal, partial string) error {
+	if fi, err := os.Stat(partial); err == nil && j.Offset > 0 && fi.Size() > j.Offset {
+		if err := os.Truncate(partial, j.Offset); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 || fi.Size() >= j.Size {
+		return errors.Errorf("partial file has %d of %d bytes", fi.Size(), j.Size)
+	}
+	req, err := newUpstreamRequest(context.Background(), "GET", j.FetchURL)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(fi.Size(), 10)+"-")
+	if etag := j.Meta.Header["ETag"]; etag != "" {
+		req.Header.Set("If-Range", etag)
+	} else {
+		req.Header.Set("If-Range", j.Meta.Header["Last-Modified"])
+	}
+	res, err := doUpstream(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return errors.Errorf("not resumable, upstream changed: %s", res.Status)
+	}
+	log.Printf("resume %s from %d bytes", j.Meta.URL, fi.Size())
+	m := *j.Meta
+	var body io.Reader = res.Body
+	if d.DownloadSpeed > 0 {
+		body = newSpeedLimitReader(body, d.DownloadSpeed)
+	}
+	// keep journal updated, so the resume can be resumed again
+	root := d.cacheRoot(m.URL)
+	j.Offset = 0
+	progress := newJournalProgress(journalFilename(root, m.URL), filepath.Join(root, HashString(m.URL)+".tmp"), j)
+	if _, err := d.storeMeta(&m, io.MultiReader(f, body), progress, ""); err != nil {
+		return err
+	}
+	if m.Size != j.Size {
+		d.removeEntry(d.downloadDir(m.URL))
+		return errors.Errorf("resumed size %d, expect %d", m.Size, j.Size)
+	}
+	return nil
+}
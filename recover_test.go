@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// heldLock is a shared lock held by another instance
+type heldLock struct{}
+
+func (heldLock) Lock(ctx context.Context, key string) (func(), error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// partial files of a download running in another instance sharing the cache dir are kept
+func TestRecoverPartialSharedLock(t *testing.T) {
+	d := NewDownloadCache(t.TempDir())
+	d.sharedLock = heldLock{}
+	url := "https://github.com/owner/repo/releases/download/v1/asset"
+	data, _ := json.Marshal(downloadJournal{Meta: &Meta{URL: url}, FetchURL: url, Size: 100})
+	journal := journalFilename(d.CacheDir, url)
+	tmp := filepath.Join(d.CacheDir, HashString(url)+".tmp")
+	orphan := filepath.Join(d.CacheDir, HashString("no journal")+".tmp")
+	for name, content := range map[string][]byte{journal: data, tmp: []byte("partial"), orphan: []byte("partial")} {
+		if err := ioutil.WriteFile(name, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.RecoverPartial()
+	for _, name := range []string{journal, tmp, orphan} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s: %v", filepath.Base(name), err)
+		}
+	}
+
+	d.sharedLock = nil
+	d.Offline = true // not resumed
+	d.RecoverPartial()
+	for _, name := range []string{journal, tmp, orphan} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s is not removed without shared cache dir", filepath.Base(name))
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SharedLock prevent instances sharing a cache dir (eg over NFS) from downloading the same url at once
+// the in-process workers map only dedups downloads inside one instance
+type SharedLock interface {
+	// Lock block until key is locked by this instance
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+}
+
+// lua scripts make sure only the owner of the lock extends or releases it
+const (
+	redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+	redisExtendScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`
+)
+
+// RedisLock is a SharedLock using SET NX PX, the lock is extended while held
+// so a crashed instance only blocks others for TTL
+type RedisLock struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	TTL      time.Duration
+}
+
+// NewRedisLock parse url like redis://:password@host:6379/0
+func NewRedisLock(rawurl string) (*RedisLock, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, errors.Errorf("invalid redis url %s, eg redis://:password@host:6379/0", strconv.Quote(rawurl))
+	}
+	l := &RedisLock{Addr: u.Host, Prefix: "github-mirror:lock:", TTL: 30 * time.Second}
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		l.Addr = net.JoinHostPort(l.Addr, "6379")
+	}
+	if u.User != nil {
+		l.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if l.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("invalid redis db %s", strconv.Quote(db))
+		}
+	}
+	return l, nil
+}
+
+func (l *RedisLock) Lock(ctx context.Context, key string) (func(), error) {
+	key = l.Prefix + key
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+	ttl := strconv.FormatInt(l.TTL.Milliseconds(), 10)
+	for {
+		reply, err := l.do("SET", key, token, "NX", "PX", ttl)
+		if err != nil {
+			return nil, errors.Wrap(err, "redis lock")
+		}
+		if reply == "OK" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := l.do("EVAL", redisExtendScript, "1", key, token, ttl); err != nil {
+					logErrorf("redis lock extend %s: %v", key, err)
+				}
+			}
+		}
+	}()
+	unlock := func() {
+		close(done)
+		if _, err := l.do("EVAL", redisUnlockScript, "1", key, token); err != nil {
+			logErrorf("redis unlock %s: %v", key, err)
+		}
+	}
+	return unlock, nil
+}
+
+// do send one command on a new connection, locks are taken once per download so pooling is not worth it
+// reply is the string of a simple, integer or bulk reply, empty for nil
+func (l *RedisLock) do(args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", l.Addr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	if l.Password != "" {
+		if _, err := redisCommand(conn, r, "AUTH", l.Password); err != nil {
+			return "", err
+		}
+	}
+	if l.DB != 0 {
+		if _, err := redisCommand(conn, r, "SELECT", strconv.Itoa(l.DB)); err != nil {
+			return "", err
+		}
+	}
+	return redisCommand(conn, r, args...)
+}
+
+// redisCommand write command in RESP and read a non-array reply
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) (string, error) {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(w, cmd); err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New("redis: " + line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return "", err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+	return "", errors.Errorf("redis: unexpected reply %s", strconv.Quote(line))
+}
+
+// downloadShared download url while holding the shared lock, the download is skipped if
+// another instance stored url at or after since while we were waiting for the lock
+func (d *DownloadCache) downloadShared(ctx context.Context, url, filename string, since time.Time, conditional bool) error {
+	if d.sharedLock == nil {
+		return d.fetch(ctx, url, filename, conditional)
+	}
+	unlock, err := d.sharedLock.Lock(ctx, d.entryHash(url))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if m, err := verifyEntry(d.downloadDir(url), false); err == nil && m.Time >= since.Unix() {
+		log.Printf("%s downloaded by another instance", url)
+		return nil
+	}
+	return d.fetch(ctx, url, filename, conditional)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const refreshQueryParam = "mirror-refresh"
+
+// removeQueryParam remove name from raw query, keep order of other params
+func removeQueryParam(rawQuery, name string) (query string, found bool) {
+	if rawQuery == "" {
+		return "", false
+	}
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		if part == name || strings.HasPrefix(part, name+"=") {
+			found = true
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&"), found
+}
+
+// refreshLimiter allow non admin clients to force refresh an url once per interval
+type refreshLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func (l *refreshLimiter) Allow(url string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for k, t := range l.last {
+		if now.Sub(t) > l.interval {
+			delete(l.last, k)
+		}
+	}
+	if _, ok := l.last[url]; ok {
+		return false
+	}
+	l.last[url] = now
+	return true
+}
+
+// canForceRefresh admin can always refresh, other clients are rate limited per url
+func (d *DownloadCache) canForceRefresh(r *http.Request, url string) bool {
+	if d.isAdmin(r) {
+		return true
+	}
+	return d.refreshLimiter.interval > 0 && d.refreshLimiter.Allow(url)
+}
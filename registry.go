@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// registryPattern match blobs and manifests of container registry, eg ghcr.io
+var registryPattern = regexp.MustCompile(`^/v2/.+/(blobs|manifests)/[^/]+$`)
+
+var manifestPattern = regexp.MustCompile(`^/v2/.+/manifests/[^/]+$`)
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// manifestAccept is sent when fetching manifests, registry returns docker v2 schema1 without it
+var manifestAccept = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+// registryTokens cache anonymous bearer tokens by realm and scope
+var registryTokens = struct {
+	sync.Mutex
+	m map[string]registryToken
+}{m: make(map[string]registryToken)}
+
+// parseBearerChallenge parse WWW-Authenticate: Bearer realm="...",service="...",scope="..."
+func parseBearerChallenge(header string) map[string]string {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, m := range challengeParamPattern.FindAllStringSubmatch(header, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return nil
+	}
+	return params
+}
+
+// fetchRegistryToken get anonymous pull token described by bearer challenge
+func fetchRegistryToken(req *http.Request, challenge map[string]string) (string, error) {
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if v := challenge[key]; v != "" {
+			query.Set(key, v)
+		}
+	}
+	tokenURL := challenge["realm"] + "?" + query.Encode()
+	registryTokens.Lock()
+	t, ok := registryTokens.m[tokenURL]
+	registryTokens.Unlock()
+	if ok && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	treq, err := newUpstreamRequest(req.Context(), "GET", tokenURL)
+	if err != nil {
+		return "", err
+	}
+	res, err := upstreamClient.Do(treq)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Wrap(&UpstreamError{StatusCode: res.StatusCode, Status: res.Status}, "registry token")
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "registry token")
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.ExpiresIn <= 0 {
+		body.ExpiresIn = 300
+	}
+	registryTokens.Lock()
+	registryTokens.m[tokenURL] = registryToken{
+		token:   body.Token,
+		expires: time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - 30*time.Second),
+	}
+	registryTokens.Unlock()
+	return body.Token, nil
+}
+
+// doUpstream send request, registry bearer token is fetched and request is retried on 401
+func doUpstream(req *http.Request) (*http.Response, error) {
+	if manifestPattern.MatchString(req.URL.Path) && req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", manifestAccept)
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized || req.Header.Get("Authorization") != "" {
+		return res, err
+	}
+	challenge := parseBearerChallenge(res.Header.Get("WWW-Authenticate"))
+	if challenge == nil {
+		return res, nil
+	}
+	res.Body.Close()
+	token, err := fetchRegistryToken(req, challenge)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return upstreamClient.Do(req)
+}
+
+// manifestMediaType return mediaType declared in cached manifest
+func manifestMediaType(dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cached.file"))
+	if err != nil {
+		return ""
+	}
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &m) != nil {
+		return ""
+	}
+	return m.MediaType
+}
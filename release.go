@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// releasePagePattern match html pages of github releases, expanded_assets is loaded by the release page
+var releasePagePattern = regexp.MustCompile(`^/[^/]+/[^/]+/releases(/|/latest|/tag/[^/]+|/expanded_assets/[^/]+)?$`)
+
+var rootLinkPattern = regexp.MustCompile(`(href|src|action)="/([^/"])`)
+
+// mirrorBaseURL return url of mirror as seen by client, eg http://gh.corp/ghmirror
+func (d *DownloadCache) mirrorBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + d.BasePath
+}
+
+// serveReleasePage proxy release html page, links to upstream are rewritten to the mirror
+// so asset downloads clicked in browser go through the cache
+func (d *DownloadCache) serveReleasePage(w http.ResponseWriter, r *http.Request, rule *MirrorRule, url string) {
+	req, err := newUpstreamRequest(r.Context(), "GET", url)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	req.Header.Set("Accept", "text/html")
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		page := strings.Replace(string(body), `"`+strings.TrimSuffix(rule.URLPrefix, "/")+"/",
+			`"`+d.mirrorBaseURL(r)+"/", -1)
+		if d.BasePath != "" {
+			page = rootLinkPattern.ReplaceAllString(page, `$1="`+d.BasePath+`/$2`)
+		}
+		body = []byte(page)
+	}
+	w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("X-Cache", CacheBypass)
+	w.WriteHeader(res.StatusCode)
+	w.Write(body)
+}
+
+// mirrorURLOf return url on mirror which is cached from upstream url, empty if no rule matches
+func (d *DownloadCache) mirrorURLOf(r *http.Request, url string) string {
+	rules := d.rules()
+	for i := range rules {
+		rule := &rules[i]
+		prefix := strings.TrimSuffix(rule.URLPrefix, "/")
+		if !strings.HasPrefix(url, prefix+"/") {
+			continue
+		}
+		p := strings.TrimPrefix(url, prefix)
+		if matchRuleIndex(rules, r.Host, p) == i {
+			return d.mirrorBaseURL(r) + p
+		}
+	}
+	return ""
+}
+
+// handleAPIReleases list releases of repo with download urls pointing to mirror
+// path: /_api/releases/owner/repo
+func (d *DownloadCache) handleAPIReleases(w http.ResponseWriter, r *http.Request) {
+	repo := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_api/releases/"), "/")
+	if strings.Count(repo, "/") != 1 {
+		http.Error(w, "path must be /_api/releases/owner/repo", http.StatusBadRequest)
+		return
+	}
+	releases, err := listReleases(r.Context(), repo)
+	if err != nil {
+		status := http.StatusBadGateway
+		if ue, ok := err.(*UpstreamError); ok && ue.StatusCode == http.StatusNotFound {
+			status = http.StatusNotFound
+		} else if errors.Is(err, ErrRateLimited) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	for i := range releases {
+		for j := range releases[i].Assets {
+			a := &releases[i].Assets[j]
+			if u := d.mirrorURLOf(r, a.BrowserDownloadURL); u != "" {
+				a.Cached = d.IsCached(a.BrowserDownloadURL)
+				a.BrowserDownloadURL = u
+			}
+		}
+	}
+	writeJSON(w, releases)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Replicator push every newly cached entry to a standby github-mirror through its PUT /_api/cache,
+// so failover to the standby does not start with a cold cache
+type Replicator struct {
+	Target string // eg http://standby:8000
+	Token  string // admin token of standby
+	queue  chan string
+}
+
+func NewReplicator(target, token string) *Replicator {
+	return &Replicator{Target: strings.TrimSuffix(target, "/"), Token: token, queue: make(chan string, 10000)}
+}
+
+// Enqueue schedule url to be pushed, dropped if queue is full
+func (r *Replicator) Enqueue(url string) {
+	select {
+	case r.queue <- url:
+	default:
+		logWarnf("replicate: queue full, drop %s", url)
+	}
+}
+
+// Run push queued entries one by one, each is tried 3 times
+func (r *Replicator) Run(d *DownloadCache) {
+	for url := range r.queue {
+		var err error
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 5 * time.Second)
+			}
+			if err = r.push(d, url); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logErrorf("replicate %s: %v", url, err)
+		}
+	}
+}
+
+func (r *Replicator) push(d *DownloadCache, rawurl string) error {
+	dir := d.downloadDir(rawurl)
+	meta, err := readMeta(dir)
+	if os.IsNotExist(err) {
+		return nil // evicted meanwhile
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(dir, "cached.file"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	query := url.Values{"url": {meta.URL}, "filename": {meta.Filename}, "sha256": {meta.SHA256}}
+	req, err := http.NewRequest("PUT", r.Target+"/_api/cache?"+query.Encode(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = meta.Size
+	info := *meta
+	info.Hits = 0
+	data, _ := json.Marshal(info)
+	req.Header.Set("X-Mirror-Meta", string(data))
+	req.Header.Set("X-Mirror-Replica", "1")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		return nil // standby is downloading it by itself
+	}
+	if res.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("standby: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// replicated queue entry for replication, entries received from replication are not pushed again
+func (d *DownloadCache) replicated(m *Meta) {
+	if d.replicator != nil && !m.replica {
+		d.replicator.Enqueue(m.URL)
+	}
+}
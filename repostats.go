@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// RepoUsage is downloads of an upstream repo in a period with its files in cache
+type RepoUsage struct {
+	Repo        string `json:"repo"` // host/owner/repo
+	Downloads   int64  `json:"downloads"`
+	BytesServed int64  `json:"bytes_served"`
+	CachedFiles int    `json:"cached_files"`
+	CachedSize  int64  `json:"cached_size"`
+}
+
+// RepoUsage merge downloads of period prefix (see usagePeriod) with cached size per repo,
+// sorted by bytes served, then cached size
+func (d *DownloadCache) RepoUsage(prefix string) ([]RepoUsage, error) {
+	st, err := d.Stats()
+	if err != nil {
+		return nil, err
+	}
+	repos := make(map[string]*RepoUsage)
+	for _, rs := range st.Repos {
+		repos[rs.Repo] = &RepoUsage{Repo: rs.Repo, CachedFiles: rs.Count, CachedSize: rs.Size}
+	}
+	if d.usage != nil {
+		report, err := d.usage.RepoReport(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, cu := range report {
+			ru := repos[cu.Client]
+			if ru == nil {
+				ru = &RepoUsage{Repo: cu.Client}
+				repos[cu.Client] = ru
+			}
+			ru.Downloads, ru.BytesServed = cu.Requests, cu.Bytes
+		}
+	}
+	result := make([]RepoUsage, 0, len(repos))
+	for _, ru := range repos {
+		result = append(result, *ru)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].BytesServed != result[j].BytesServed {
+			return result[i].BytesServed > result[j].BytesServed
+		}
+		return result[i].CachedSize > result[j].CachedSize
+	})
+	return result, nil
+}
+
+// repoEntries return cached files of repo, newest first
+func (d *DownloadCache) repoEntries(repo string) ([]Entry, error) {
+	entries, err := d.Entries()
+	if err != nil {
+		return nil, err
+	}
+	filtered := entries[:0]
+	for _, e := range entries {
+		if repoOf(e.URL) == repo {
+			filtered = append(filtered, e)
+		}
+	}
+	sortEntries(filtered, "time")
+	return filtered, nil
+}
+
+// handleAPIRepos report downloads, bytes served and cached size per upstream repo
+// query: period=day|month|year (default month), date=2026-10 (default current), repo=github.com/cli/cli for one repo with its files
+func (d *DownloadCache) handleAPIRepos(w http.ResponseWriter, r *http.Request) {
+	prefix, repos, ok := d.repoUsageOfRequest(w, r)
+	if !ok {
+		return
+	}
+	repo := r.FormValue("repo")
+	if repo == "" {
+		writeJSON(w, map[string]interface{}{"period": prefix, "repos": repos})
+		return
+	}
+	usage := RepoUsage{Repo: repo}
+	for _, ru := range repos {
+		if ru.Repo == repo {
+			usage = ru
+		}
+	}
+	entries, err := d.repoEntries(repo)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"period": prefix, "repo": usage, "files": entries})
+}
+
+func (d *DownloadCache) repoUsageOfRequest(w http.ResponseWriter, r *http.Request) (string, []RepoUsage, bool) {
+	period := r.FormValue("period")
+	if period == "" {
+		period = "month"
+	}
+	prefix, err := usagePeriod(period, r.FormValue("date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, false
+	}
+	repos, err := d.RepoUsage(prefix)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return "", nil, false
+	}
+	return prefix, repos, true
+}
+
+// handleDashboardRepos render repos by usage, with ?repo= the page of one repo with its cached files
+func (d *DownloadCache) handleDashboardRepos(w http.ResponseWriter, r *http.Request) {
+	prefix, repos, ok := d.repoUsageOfRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	base := d.BasePath + "/_dashboard/repos"
+	row := func(ru RepoUsage) string {
+		return fmt.Sprintf("<tr><td><a href=\"%s?repo=%s\">%s</a></td><td align=\"right\">%d</td><td align=\"right\">%s</td><td align=\"right\">%d</td><td align=\"right\">%s</td></tr>",
+			base, url.QueryEscape(ru.Repo), html.EscapeString(ru.Repo), ru.Downloads, datasize.ByteSize(ru.BytesServed).HR(),
+			ru.CachedFiles, datasize.ByteSize(ru.CachedSize).HR())
+	}
+	header := "<table><tr><th align=\"left\">Repo</th><th>Downloads " + prefix + "</th><th>Served</th><th>Cached files</th><th>Cached size</th></tr>"
+
+	repo := r.FormValue("repo")
+	if repo == "" {
+		output := "<html><body><h2>Repositories</h2>" + header
+		for _, ru := range repos {
+			output += row(ru)
+		}
+		io.WriteString(w, output+"</table></body></html>")
+		return
+	}
+	entries, err := d.repoEntries(repo)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	usage := RepoUsage{Repo: repo}
+	for _, ru := range repos {
+		if ru.Repo == repo {
+			usage = ru
+		}
+	}
+	browse := d.BasePath + "/_browse/" + strings.Replace(repo, ":", "_", 1) + "/"
+	output := "<html><body><h2><a href=\"" + base + "\">Repositories</a> / " + html.EscapeString(repo) + "</h2>" + header + row(usage) + "</table>"
+	output += "<h3>Cached files</h3><p><a href=\"" + html.EscapeString(browse) + "\">browse</a></p>" + browseTableHeader
+	for i := range entries {
+		output += d.browseFileRow(r, entries[i].Filename, &entries[i])
+	}
+	io.WriteString(w, output+"</table></body></html>")
+}
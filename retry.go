@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var retryBucket = []byte("retry")
+
+// retry backoff starts from retryMinDelay and doubles up to retryMaxDelay, failed after retryMaxAttempts
+const (
+	retryMinDelay    = time.Minute
+	retryMaxDelay    = 6 * time.Hour
+	retryMaxAttempts = 20
+)
+
+// RetryItem is a failed download job waiting for retry
+type RetryItem struct {
+	URL       string    `json:"url"`
+	Filename  string    `json:"filename"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error"`
+}
+
+// downloadJob download url without a waiting client, 404 is not retried
+func (d *DownloadCache) downloadJob(url string) error {
+	if err := d.deferOffPeak("download " + url); err != nil {
+		return err
+	}
+	_, err := d.DownloadAndWait(url, path.Base(strings.SplitN(url, "?", 2)[0]))
+	if ue, ok := errors.Cause(err).(*UpstreamError); ok && ue.StatusCode == http.StatusNotFound {
+		return permanent(err)
+	}
+	return err
+}
+
+// importRetryQueue queue items of retry.db written by older versions as download jobs, then remove it
+func (d *DownloadCache) importRetryQueue(filename string) error {
+	if _, err := os.Stat(filename); err != nil {
+		return nil
+	}
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "open retry queue")
+	}
+	var urls []string
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(retryBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			urls = append(urls, string(k))
+			return nil
+		})
+	})
+	db.Close()
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		if _, err := d.jobs.Enqueue(JobDownload, url); err != nil {
+			return err
+		}
+	}
+	log.Printf("imported %d items of %s as download jobs", len(urls), filename)
+	return os.Remove(filename)
+}
+
+// handleAPIRetry GET list failed download jobs waiting for retry, DELETE ?url= cancel retries of url
+// kept for compatibility, see /_api/jobs
+func (d *DownloadCache) handleAPIRetry(w http.ResponseWriter, r *http.Request) {
+	if d.jobs == nil {
+		writeJSON(w, []RetryItem{})
+		return
+	}
+	if r.Method == "DELETE" {
+		url := r.FormValue("url")
+		if url == "" {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+		job, ok, err := d.jobs.Active(JobDownload, url)
+		if err == nil && ok {
+			_, err = d.jobs.Cancel(job.ID)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	jobs, err := d.jobs.List(JobQueued, JobDownload)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	items := make([]RetryItem, 0)
+	for _, job := range jobs {
+		if job.Attempts == 0 {
+			continue
+		}
+		items = append(items, RetryItem{
+			URL:       job.Arg,
+			Filename:  path.Base(strings.SplitN(job.Arg, "?", 2)[0]),
+			Attempts:  job.Attempts,
+			NextTry:   job.NextTry,
+			LastError: job.Error,
+		})
+	}
+	writeJSON(w, items)
+}
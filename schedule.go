@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule decide when a task runs next
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// everySchedule run at fixed interval, eg @every 10m
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cronSchedule is a standard 5 field cron expression: minute hour day-of-month month day-of-week
+// each field is a bitset of allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parse cron expression (eg "30 3 * * 1-5", "*/15 * * * *"), macros like @daily,
+// or "@every <duration>"
+func ParseSchedule(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := parseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("invalid schedule %s", strconv.Quote(expr))
+		}
+		return everySchedule(d), nil
+	}
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("invalid schedule %s, must be 5 fields: minute hour day month weekday", strconv.Quote(expr))
+	}
+	var c cronSchedule
+	var err error
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		if *sets[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, errors.Wrapf(err, "schedule %s", strconv.Quote(expr))
+		}
+	}
+	if c.dow&(1<<7) != 0 { // 7 is sunday too
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField support *, n, a-b, */n, a-b/n and comma separated lists of them
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid step %s", strconv.Quote(part))
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("invalid value %s", strconv.Quote(part))
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Errorf("invalid range %s", strconv.Quote(part))
+				}
+			} else if step > 1 {
+				hi = max // eg 5/15
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.Errorf("%s out of range %d-%d", strconv.Quote(part), min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatch(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	// like cron, if both day fields are restricted, either one matching is enough
+	if !c.domStar && !c.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Next return first matching minute after t, zero time if none within 5 years (eg Feb 30)
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatch(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+type scheduledTask struct {
+	Name     string    `json:"name"`
+	Expr     string    `json:"schedule"`
+	LastRun  time.Time `json:"last_run"`
+	NextRun  time.Time `json:"next_run"`
+	Duration string    `json:"duration"`
+	schedule Schedule
+	run      func()
+}
+
+// Scheduler run maintenance tasks by their schedule, a task never overlaps with itself
+type Scheduler struct {
+	mu    sync.Mutex
+	tasks []*scheduledTask
+}
+
+func (s *Scheduler) Add(name, expr string, run func()) error {
+	schedule, err := ParseSchedule(expr)
+	if err != nil {
+		return errors.Wrap(err, name)
+	}
+	s.mu.Lock()
+	s.tasks = append(s.tasks, &scheduledTask{Name: name, Expr: expr, schedule: schedule, run: run})
+	s.mu.Unlock()
+	return nil
+}
+
+// Reschedule change schedule of task, it takes effect after the pending run
+func (s *Scheduler) Reschedule(name, expr string) error {
+	schedule, err := ParseSchedule(expr)
+	if err != nil {
+		return errors.Wrap(err, name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range s.tasks {
+		if task.Name == name {
+			task.Expr, task.schedule = expr, schedule
+			return nil
+		}
+	}
+	return errors.Errorf("unknown schedule task %s", strconv.Quote(name))
+}
+
+// Start run every task in its own goroutine
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range s.tasks {
+		go s.loop(task)
+	}
+}
+
+func (s *Scheduler) loop(task *scheduledTask) {
+	for {
+		s.mu.Lock()
+		next := task.schedule.Next(time.Now())
+		task.NextRun = next
+		s.mu.Unlock()
+		if next.IsZero() {
+			logWarnf("schedule %s: %s never runs", task.Name, task.Expr)
+			return
+		}
+		time.Sleep(time.Until(next))
+		start := time.Now()
+		task.run()
+		s.mu.Lock()
+		task.LastRun = start
+		task.Duration = time.Since(start).Round(time.Millisecond).String()
+		s.mu.Unlock()
+	}
+}
+
+// scheduleTasks are all maintenance tasks of -schedule and schedule of config,
+// scrub and sync run only with -scrub-fraction and -sync-from, watch not with -offline
+var scheduleTasks = []string{"clean", "scrub", "sync", "retry", "usage", "watch"}
+
+// checkSchedule validate task names and cron expressions of schedule
+func checkSchedule(schedule map[string]string) error {
+	for task, expr := range schedule {
+		known := false
+		for _, name := range scheduleTasks {
+			known = known || name == task
+		}
+		if !known {
+			return errors.Errorf("unknown schedule task %s, must be one of %s", strconv.Quote(task), strings.Join(scheduleTasks, ", "))
+		}
+		if _, err := ParseSchedule(expr); err != nil {
+			return errors.Wrapf(err, "schedule %s", task)
+		}
+	}
+	return nil
+}
+
+// Has report whether task is added
+func (s *Scheduler) Has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range s.tasks {
+		if task.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// warnDisabled log schedules of tasks not added, eg scrub without -scrub-fraction
+func (s *Scheduler) warnDisabled(schedule map[string]string) {
+	for task := range schedule {
+		if !s.Has(task) {
+			logWarnf("schedule of %s is ignored, the task is disabled", task)
+		}
+	}
+}
+
+// Tasks return copy of tasks sorted by name
+func (s *Scheduler) Tasks() []scheduledTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]scheduledTask, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks
+}
+
+// scheduleFlag collect repeated -schedule task=expr flags
+type scheduleFlag map[string]string
+
+func (s scheduleFlag) String() string {
+	return ""
+}
+
+func (s scheduleFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid schedule %s, must be task=expr, eg clean=0 3 * * *", strconv.Quote(v))
+	}
+	s[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// handleAPISchedule list maintenance tasks with their last and next run
+func (d *DownloadCache) handleAPISchedule(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.scheduler.Tasks())
+}
+
+// timeWindow is a daily time range in minutes since midnight, end before start crosses midnight
+type timeWindow struct {
+	start, end int
+}
+
+// TimeWindows are daily windows like 22:00-06:00 in local time, eg for metered daytime bandwidth
+type TimeWindows []timeWindow
+
+// ParseTimeWindows parse comma separated windows, eg "22:00-06:00,12:00-13:30"
+func ParseTimeWindows(s string) (TimeWindows, error) {
+	var windows TimeWindows
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) != 2 {
+			return nil, errors.Errorf("invalid time window %s, eg 22:00-06:00", strconv.Quote(part))
+		}
+		var w timeWindow
+		for i, p := range []*int{&w.start, &w.end} {
+			t, err := time.Parse("15:04", strings.TrimSpace(bounds[i]))
+			if err != nil {
+				return nil, errors.Errorf("invalid time window %s, eg 22:00-06:00", strconv.Quote(part))
+			}
+			*p = t.Hour()*60 + t.Minute()
+		}
+		if w.start == w.end {
+			return nil, errors.Errorf("empty time window %s", strconv.Quote(part))
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// Contains report if t is inside any window, no windows means any time
+func (ws TimeWindows) Contains(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range ws {
+		if w.start < w.end && m >= w.start && m < w.end {
+			return true
+		}
+		if w.start > w.end && (m >= w.start || m < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next return t if inside a window, otherwise start of the next window
+func (ws TimeWindows) Next(t time.Time) time.Time {
+	if ws.Contains(t) {
+		return t
+	}
+	var next time.Time
+	for _, w := range ws {
+		start := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+func (ws TimeWindows) String() string {
+	parts := make([]string, 0, len(ws))
+	for _, w := range ws {
+		parts = append(parts, fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60))
+	}
+	return strings.Join(parts, ",")
+}
+
+// deferOffPeak postpone background jobs until an off-peak window, interactive requests never wait
+func (d *DownloadCache) deferOffPeak(what string) error {
+	if next := d.OffPeak.Next(time.Now()); time.Until(next) > 0 {
+		log.Printf("%s deferred to off-peak window at %s", what, next.Format("15:04"))
+		return deferredError{until: next}
+	}
+	return nil
+}
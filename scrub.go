@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const quarantineDirName = "_quarantine"
+
+// ScrubReport is the result of last scrub
+type ScrubReport struct {
+	Time    time.Time
+	Checked int
+	Corrupt []string // urls
+}
+
+func (r ScrubReport) String() string {
+	if r.Time.IsZero() {
+		return "never run"
+	}
+	return fmt.Sprintf("%s: checked %d, corrupt %d", r.Time.Format(time.RFC3339), r.Checked, len(r.Corrupt))
+}
+
+type scrubber struct {
+	mu     sync.Mutex
+	report ScrubReport
+}
+
+func (s *scrubber) Report() ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+// Scrub re-hash a random fraction of cached files and check size of all, so truncated files are found
+// quickly. corrupt entries are moved into _quarantine dir and downloaded again
+func (d *DownloadCache) Scrub(fraction float64) ScrubReport {
+	report := ScrubReport{Time: time.Now()}
+	entries, _ := d.Entries()
+	n := int(math.Ceil(float64(len(entries)) * fraction))
+	rehash := make(map[int]bool, n)
+	for _, i := range rand.Perm(len(entries))[:n] {
+		rehash[i] = true
+	}
+	for i, e := range entries {
+		// an entry being refreshed mismatches its meta for a moment, it is checked next time
+		hash := d.entryHash(e.URL)
+		if !d.lockWorker(hash) {
+			continue
+		}
+		_, err := verifyEntry(e.Dir, rehash[i])
+		report.Checked++
+		metricScrubChecked.Add(1)
+		if errors.Cause(err) == ErrCorrupt {
+			logErrorf("scrub %s: %v", e.URL, err)
+			report.Corrupt = append(report.Corrupt, e.URL)
+			metricScrubCorrupt.Add(1)
+			if qerr := d.quarantine(e.Dir); qerr != nil {
+				logErrorf("quarantine %s: %v", e.Dir, qerr)
+			} else {
+				d.enqueue(JobDownload, e.URL)
+			}
+			d.unlockWorker(hash, err) // waiters must not serve the quarantined file
+		} else {
+			d.unlockWorker(hash, nil)
+		}
+		if rehash[i] {
+			time.Sleep(100 * time.Millisecond) // low priority, leave disk io for serving
+		}
+	}
+	metricScrubLastRun.Set(report.Time.Unix())
+	d.scrubber.mu.Lock()
+	d.scrubber.report = report
+	d.scrubber.mu.Unlock()
+	return report
+}
+
+// quarantine move files of entry into _quarantine of its cache root for later inspection,
+// child entries in dir of url layout are kept
+func (d *DownloadCache) quarantine(dir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.quarantineLocked(dir)
+}
+
+func (d *DownloadCache) quarantineLocked(dir string) error {
+	root := d.rootOf(dir)
+	if root == "" {
+		root = d.CacheDir
+	}
+	qdir := filepath.Join(root, quarantineDirName)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(qdir, fmt.Sprintf("%s-%d", HashString(dir), time.Now().Unix()))
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	// meta.json first, an entry without it is not served
+	for _, name := range []string{"meta.json", "cached.file"} {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(target, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	d.pruneEmptyDirs(dir)
+	return nil
+}
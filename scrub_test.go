@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// corrupt truncate cached file of url
+func corrupt(t *testing.T, d *DownloadCache, url string) {
+	if err := ioutil.WriteFile(filepath.Join(d.downloadDir(url), "cached.file"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// in url layout, dir of a repo entry holds entries of its releases
+func TestQuarantineKeepsChildEntries(t *testing.T) {
+	d := NewDownloadCache(t.TempDir())
+	d.Layout = LayoutURL
+	d.Offline = true // no download again
+	parent := "https://github.com/owner/repo"
+	child := "https://github.com/owner/repo/releases/download/v1/asset"
+	for _, url := range []string{parent, child} {
+		if _, err := d.store(url, "f", strings.NewReader("content of "+url), nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(t, d, parent)
+	report := d.Scrub(1)
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != parent {
+		t.Fatalf("corrupt %v, want %s", report.Corrupt, parent)
+	}
+	if _, err := verifyEntry(d.downloadDir(child), true); err != nil {
+		t.Errorf("child entry: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.downloadDir(parent), "meta.json")); !os.IsNotExist(err) {
+		t.Errorf("meta of corrupt entry is not moved: %v", err)
+	}
+	moved, _ := filepath.Glob(filepath.Join(d.CacheDir, quarantineDirName, "*", "cached.file"))
+	if len(moved) != 1 {
+		t.Errorf("quarantined files %v, want cached.file of %s", moved, parent)
+	}
+}
+
+func TestScrubSkipsBusyEntry(t *testing.T) {
+	d := NewDownloadCache(t.TempDir())
+	d.Offline = true
+	url := "https://github.com/owner/repo/releases/download/v1/asset"
+	if _, err := d.store(url, "asset", strings.NewReader("content"), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, d, url) // as if being refreshed
+	hash := d.entryHash(url)
+	d.lockWorker(hash)
+	if report := d.Scrub(1); report.Checked != 0 || len(report.Corrupt) != 0 {
+		t.Errorf("busy entry is scrubbed: %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(d.downloadDir(url), "meta.json")); err != nil {
+		t.Errorf("busy entry is quarantined: %v", err)
+	}
+	d.unlockWorker(hash, nil)
+	if report := d.Scrub(1); len(report.Corrupt) != 1 {
+		t.Errorf("corrupt %v after refresh finished, want %s", report.Corrupt, url)
+	}
+}
+
+// a refresh replaces cached.file before meta.json, scrub must not take the moment for corruption
+func TestScrubWhileRefreshing(t *testing.T) {
+	n := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++ // requests are serialized by the worker lock
+		w.Write([]byte(strings.Repeat("x", 1000+n%100)))
+	}))
+	defer upstream.Close()
+	d := NewDownloadCache(t.TempDir())
+	d.Rules = []MirrorRule{{Pattern: regexp.MustCompile(`^/`), URLPrefix: upstream.URL + "/"}}
+	url := upstream.URL + "/owner/repo/releases/download/v1/asset"
+	if err := d.refresh(url, "asset", false); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			d.refresh(url, "asset", false)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if report := d.Scrub(0); len(report.Corrupt) > 0 { // sizes only, no pause of rehash
+			<-done
+			t.Fatalf("entry being refreshed is quarantined: %v", report.Corrupt)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// searchResult is a cached file matching search, with its download url on mirror
+type searchResult struct {
+	Entry
+	MirrorURL string `json:"mirror_url,omitempty"`
+}
+
+// Search return cached files whose filename, source url, tags or note contain all words of q, case insensitive,
+// newest first. the tree of cached files is used as index, it is rebuilt at most every few seconds
+func (d *DownloadCache) Search(q string, limit int) ([]Entry, error) {
+	words := strings.Fields(strings.ToLower(q))
+	if len(words) == 0 {
+		return []Entry{}, nil
+	}
+	root, err := d.files.tree()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Entry, 0)
+	var walk func(n *davNode)
+	walk = func(n *davNode) {
+		if e := n.entry; e != nil {
+			text := strings.ToLower(e.Filename + " " + e.URL + " " + strings.Join(e.Tags, " ") + " " + e.Note)
+			for _, word := range words {
+				if !strings.Contains(text, word) {
+					return
+				}
+			}
+			results = append(results, *e)
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(root)
+	sortEntries(results, "time")
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// handleAPISearch find cached files, eg to check whether a tool version is mirrored
+// query: q=kubectl 1.31, limit=100
+func (d *DownloadCache) handleAPISearch(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v, err := strconv.Atoi(r.FormValue("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	entries, err := d.Search(r.FormValue("q"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	results := make([]searchResult, 0, len(entries))
+	for _, e := range entries {
+		results = append(results, searchResult{Entry: e, MirrorURL: d.mirrorURLOf(r, e.URL)})
+	}
+	writeJSON(w, results)
+}
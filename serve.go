@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var listenAddrs, dataDir string
+	var keep, keepTags, sidecars string
+	var logOutput, logTag, syslogFacility string
+	var maxPerIP, jobWorkers int
+	var requireAPIKey bool
+	var privateDashboard bool
+	var oauth OAuth
+	var oauthAdmins string
+	var tlsCert, tlsKey, tlsClientCA, tlsClientAuth string
+	var breakerThreshold int
+	var breakerCooldown time.Duration
+	var notifyWebhook string
+	var notifyThreshold int
+	var minFree string
+	var compressMinSize string
+	var negativeTTL string
+	var maxSize, downloadSpeed, offPeak string
+	var basePath string
+	var trustedProxies string
+	var proxy string
+	var socketMode string
+	var maxHeaderBytes string
+	var adminToken string
+	var configFile string
+	var auditLog string
+	var ipPrivacy string
+	var otlpEndpoint string
+	var statsdAddr, statsdPrefix, statsdTags string
+	var eviction string
+	var offline bool
+	var replicateTo, replicateToken string
+	var clusterNodes, clusterSelf string
+	var clusterRedirect bool
+	var peers string
+	var peerInterval time.Duration
+	var lockRedis, stateDir string
+	var accelRedirect string
+	var sendfile bool
+	var redirectHits, redirectSecret string
+	var redirectTTL time.Duration
+	schedules := scheduleFlag{}
+	var layout string
+	var verifyChecksum bool
+	var goProxy bool
+	var preset string
+	var ttl string
+	var refreshInterval time.Duration
+	var staleWhileRevalidate bool
+	var scrubFraction float64
+	var syncFrom string
+	var syncInterval time.Duration
+	var corsOrigins, corsMethods, corsHeaders string
+	var dnsServer, dohURL string
+	resolveHosts := hostsFlag{}
+	var connectTimeout, tlsTimeout, headerTimeout, idleTimeout time.Duration
+	fs.StringVar(&listenAddrs, "listen", ":8000", "Listen addresses, comma separated, eg 0.0.0.0:8000,[::1]:8001,unix:///run/github-mirror.sock")
+	fs.StringVar(&proxy, "proxy", "", "Proxy addr or command to get proxy")
+	fs.StringVar(&layout, "layout", LayoutHash, "Cache directory layout, hash or url (human readable, eg github.com/owner/repo/releases/download/v1/asset)")
+	fs.StringVar(&preset, "preset", "", "Comma separated rule presets: actions,github,go,golang,goproxy,nodejs,rust, golang is go releases with -goproxy")
+	fs.BoolVar(&goProxy, "goproxy", false, "Also mirror go module proxy and checksum database, for GOPROXY=http://this-server")
+	fs.BoolVar(&verifyChecksum, "verify-checksum", false, "Verify sha256 of cached file before serving, costs disk io on every request")
+	fs.Float64Var(&scrubFraction, "scrub-fraction", 0, "Fraction of cached files to re-hash every hour, eg 0.05, 0 to disable")
+	fs.StringVar(&UpstreamUserAgent, "user-agent", UpstreamUserAgent, "User-Agent sent to upstream")
+	fs.Var(headerFlag(UpstreamHeaders), "header", "Extra header sent to upstream, eg \"X-Token: abc\", can be repeated")
+	fs.StringVar(&ttl, "ttl", "0", "Default time to live of cached files, eg 1h, 7d, 0 to never expire")
+	fs.BoolVar(&staleWhileRevalidate, "stale-while-revalidate", true, "Serve expired files while refreshing in background, if false wait for refresh and serve expired files only when upstream fails")
+	fs.DurationVar(&refreshInterval, "refresh-interval", 10*time.Minute, "Non admin clients can force refresh (?mirror-refresh=1) an url once per interval, 0 to allow admin only")
+	fs.StringVar(&socketMode, "socket-mode", "0660", "Permission of unix socket listener")
+	fs.DurationVar(&ServerLimits.ReadHeaderTimeout, "read-header-timeout", ServerLimits.ReadHeaderTimeout, "Close connections not sending request headers within this duration, 0 to disable")
+	fs.DurationVar(&ServerLimits.IdleTimeout, "keepalive-timeout", ServerLimits.IdleTimeout, "Close idle keep-alive connections after this duration")
+	fs.DurationVar(&ServerLimits.WriteTimeout, "write-timeout", 0, "Abort responses not finished within this duration, must be longer than the slowest download, 0 to disable")
+	fs.StringVar(&maxHeaderBytes, "max-header-bytes", "64KB", "Max size of request headers")
+	fs.IntVar(&ServerLimits.MaxConns, "max-conns", 0, "Max concurrent connections per listen address, 0 for unlimited")
+	fs.StringVar(&configFile, "config", "", "Config file in json format, eg: mirror rules")
+	fs.StringVar(&ipPrivacy, "ip-privacy", "", "Anonymize client ip in audit log and usage stats, truncate (/24 of ipv4, /48 of ipv6) or hash")
+	fs.StringVar(&otlpEndpoint, "otlp-endpoint", "", "Export traces to OpenTelemetry collector (OTLP/HTTP), eg http://localhost:4318, OTEL_EXPORTER_OTLP_* env are used too")
+	fs.StringVar(&statsdAddr, "statsd", "", "Push metrics to statsd or DogStatsD every 10s, eg 127.0.0.1:8125")
+	fs.StringVar(&statsdPrefix, "statsd-prefix", "github_mirror.", "Prefix of statsd metric names")
+	fs.StringVar(&statsdTags, "statsd-tags", "", "DogStatsD tags, comma separated, eg env:prod,team:infra")
+	fs.Var(schedules, "schedule", "Cron schedule of maintenance task (clean, scrub, sync, retry, usage, watch), tasks are queued as jobs, eg \"clean=0 3 * * *\", can be repeated")
+	fs.StringVar(&auditLog, "audit-log", "", "Append downloads and admin actions to this file as json lines, eg data/audit.log")
+	fs.StringVar(&dataDir, "d", "data", "cached data store path")
+	fs.StringVar(&dnsServer, "dns", "", "DNS server to resolve upstream hosts, eg 223.5.5.5:53")
+	fs.StringVar(&dohURL, "dns-over-https", "", "Resolve upstream hosts with DNS-over-HTTPS json api, eg https://1.1.1.1/dns-query")
+	fs.Var(resolveHosts, "resolve", "Static address of upstream host, eg github.com=140.82.112.3, can be repeated")
+	fs.DurationVar(&connectTimeout, "connect-timeout", 10*time.Second, "upstream connect timeout")
+	fs.DurationVar(&tlsTimeout, "tls-timeout", 10*time.Second, "upstream TLS handshake timeout")
+	fs.DurationVar(&headerTimeout, "header-timeout", 30*time.Second, "upstream response header timeout")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 60*time.Second, "abort download if no bytes received for this duration, 0 to disable")
+	fs.StringVar(&adminToken, "admin-token", os.Getenv("GITHUB_MIRROR_ADMIN_TOKEN"), "Bearer token required by admin api, if empty only loopback clients are allowed")
+	fs.BoolVar(&offline, "offline", false, "Serve cached files only and never connect to upstream, for air-gapped sites seeded by import")
+	fs.StringVar(&replicateTo, "replicate-to", "", "Push every newly cached file to this standby github-mirror, eg http://standby:8000")
+	fs.StringVar(&replicateToken, "replicate-token", os.Getenv("GITHUB_MIRROR_REPLICATE_TOKEN"), "Admin token of -replicate-to")
+	fs.StringVar(&clusterNodes, "cluster-nodes", "", "Comma separated urls of all cluster nodes, each url is cached by one node only, eg http://m1:8000,http://m2:8000")
+	fs.StringVar(&clusterSelf, "cluster-self", "", "Url of this node in -cluster-nodes")
+	fs.BoolVar(&clusterRedirect, "cluster-redirect", false, "Redirect clients to the node owning url instead of proxying")
+	fs.StringVar(&peers, "peers", "", "Comma separated urls of other mirrors, cache misses are downloaded from a peer having the file before upstream, eg http://office2:8000")
+	fs.StringVar(&PeerToken, "peer-token", os.Getenv("GITHUB_MIRROR_PEER_TOKEN"), "Shared token of mirrors, sent to -peers and -sync-from and accepted by cache file apis, needed with -private-dashboard or -require-api-key")
+	fs.DurationVar(&peerInterval, "peer-interval", time.Minute, "How often cached file lists of -peers are fetched")
+	fs.StringVar(&lockRedis, "lock-redis", "", "Redis url to lock downloads among instances sharing the cache dir, eg redis://:password@redis:6379/0")
+	fs.StringVar(&stateDir, "state-dir", "", "Directory of databases owned by this instance (jobs.db, usage.db), default is -d, set it when -d is shared")
+	fs.StringVar(&accelRedirect, "x-accel-redirect", "", "Let nginx send cached files with X-Accel-Redirect, value is the internal location aliased to -d, eg /_cache")
+	fs.BoolVar(&sendfile, "x-sendfile", false, "Let front proxy (apache, lighttpd) send cached files with X-Sendfile")
+	fs.StringVar(&redirectHits, "redirect-hits", "", "Redirect cache hits to this cdn or file server serving -d, eg https://cdn.corp/github-mirror")
+	fs.StringVar(&redirectSecret, "redirect-secret", os.Getenv("GITHUB_MIRROR_REDIRECT_SECRET"), "Sign -redirect-hits urls for nginx secure_link, empty to redirect unsigned")
+	fs.DurationVar(&redirectTTL, "redirect-ttl", 5*time.Minute, "Lifetime of signed -redirect-hits urls")
+	fs.IntVar(&githubRateLimiter.Reserve, "github-api-reserve", githubRateLimiter.Reserve, "Stop calling github api when this many calls of its rate limit are left, expired responses are used until reset")
+	fs.DurationVar(&GraphQLCacheTTL, "graphql-ttl", GraphQLCacheTTL, "Cache responses of /graphql queries for this duration, 0 to disable caching")
+	fs.StringVar(&syncFrom, "sync-from", "", "Periodically copy cached files from another github-mirror, eg http://hq-mirror:8000")
+	fs.DurationVar(&syncInterval, "sync-interval", time.Hour, "Interval of -sync-from")
+	fs.StringVar(&corsOrigins, "cors-origin", "", "Access-Control-Allow-Origin, comma separated origins or *, empty to disable CORS")
+	fs.StringVar(&corsMethods, "cors-methods", "GET, HEAD, OPTIONS", "Access-Control-Allow-Methods")
+	fs.StringVar(&corsHeaders, "cors-headers", "Range, If-None-Match, If-Modified-Since", "Access-Control-Allow-Headers")
+	fs.StringVar(&trustedProxies, "trusted-proxies", "", "Comma separated CIDR list of reverse proxies, whose X-Forwarded-For/X-Real-IP is used as client ip, unix for reverse proxy on -listen unix://")
+	fs.StringVar(&basePath, "base-path", "", "Serve under url path prefix, e.g. /ghmirror")
+	fs.StringVar(&maxSize, "max-size", "0", "Files larger than this are passed through without caching, eg 2GB, 0 for unlimited")
+	fs.StringVar(&offPeak, "off-peak", "", "Daily time windows of background prefetch, retry and sync downloads, eg 22:00-06:00,12:00-13:00, empty for any time")
+	fs.IntVar(&jobWorkers, "job-workers", 4, "Max concurrent background jobs (prefetch, sync, scrub, watch)")
+	fs.StringVar(&downloadSpeed, "download-speed", "0", "Max speed of each upstream download per second, eg 10MB, 0 for unlimited")
+	fs.StringVar(&negativeTTL, "negative-ttl", DefaultNegativeTTL, "Remember upstream failures by status code or class, empty to disable")
+	fs.StringVar(&compressMinSize, "compress-min-size", "1KB", "Compress text responses (gzip or brotli) not smaller than this, 0 to disable")
+	fs.StringVar(&eviction, "eviction", "", "Which files are evicted first for -min-free: lru (default), lfu, size (large and idle) or age (cached earliest)")
+	fs.StringVar(&minFree, "min-free", "0", "Keep this much free disk space, evict old files or refuse downloads, eg 5GB")
+	fs.StringVar(&notifyWebhook, "notify-webhook", "", "Post alerts of repeated failures, disk full and upstream outage to this url, slack compatible")
+	fs.IntVar(&notifyThreshold, "notify-threshold", 3, "Alert after this many consecutive failures")
+	fs.IntVar(&breakerThreshold, "breaker-threshold", 5, "Fail fast for upstream host after this many consecutive failures, 0 to disable")
+	fs.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "Time before trying a failing upstream host again")
+	fs.IntVar(&maxPerIP, "max-per-ip", 5, "Max concurrent downloads of a client ip (or client certificate), 0 for unlimited")
+	fs.BoolVar(&privateDashboard, "private-dashboard", false, "Dashboard, stats and cache listings need an api key with viewer or admin role, or the admin token")
+	fs.StringVar(&oauth.ClientID, "oauth-client-id", "", "Client id of github oauth app, dashboard users log in with github, implies -private-dashboard")
+	fs.StringVar(&oauth.ClientSecret, "oauth-client-secret", os.Getenv("GITHUB_MIRROR_OAUTH_SECRET"), "Client secret of github oauth app")
+	fs.StringVar(&oauth.Org, "oauth-org", "", "Github org whose members can log in as viewer, required with -oauth-client-id")
+	fs.StringVar(&oauthAdmins, "oauth-admins", "", "Comma separated github logins with admin role")
+	fs.StringVar(&oauth.RedirectURL, "oauth-redirect-url", "", "Callback url of oauth app, default /_oauth/callback of request host, eg https://gh.corp/_oauth/callback behind tls proxy")
+	fs.BoolVar(&requireAPIKey, "require-api-key", false, "Reject mirror requests without api key (X-API-Key or bearer token), keys are managed by /_api/keys")
+	fs.StringVar(&tlsCert, "tls-cert", "", "Serve https with this certificate file")
+	fs.StringVar(&tlsKey, "tls-key", "", "Private key file of -tls-cert")
+	fs.StringVar(&tlsClientCA, "tls-client-ca", "", "Verify client certificates with this CA file (mutual TLS)")
+	fs.StringVar(&tlsClientAuth, "tls-client-auth", "require", "With -tls-client-ca, require or optional client certificate")
+	fs.StringVar(&keep, "keep", "7d", "Remove files not accessed for this duration, checked every hour")
+	fs.StringVar(&sidecars, "sidecars", DefaultSidecars, "Comma separated suffixes of checksum and signature files cached together with release assets, empty to disable")
+	fs.StringVar(&keepTags, "keep-tags", "", "Comma separated tags of files never evicted or removed by clean, eg approved,security-scanned")
+	fs.StringVar(&logOutput, "log-output", "stderr", "Log to stderr, syslog (local), syslog://host:514 (udp), syslog+tcp://host:601 or journald")
+	fs.StringVar(&logTag, "log-tag", "github-mirror", "Tag of syslog messages and SYSLOG_IDENTIFIER of journald")
+	fs.StringVar(&syslogFacility, "syslog-facility", "daemon", "Syslog facility, user, daemon or local0-7")
+	fs.Parse(args)
+
+	if err := setLogOutput(logOutput, logTag, syslogFacility); err != nil {
+		return err
+	}
+	if layout != LayoutHash && layout != LayoutURL {
+		return errors.Errorf("invalid -layout %s, must be hash or url", strconv.Quote(layout))
+	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return errors.Errorf("invalid -socket-mode %s", strconv.Quote(socketMode))
+	}
+	UnixSocketMode = os.FileMode(mode)
+	headerBytes, err := parseSize(maxHeaderBytes)
+	if err != nil {
+		return err
+	}
+	ServerLimits.MaxHeaderBytes = int(headerBytes)
+
+	if err := SetTrustedProxies(splitComma(trustedProxies)); err != nil {
+		return err
+	}
+	if tlsCert != "" {
+		if ServerTLSConfig, err = NewServerTLSConfig(tlsCert, tlsKey, tlsClientCA, tlsClientAuth); err != nil {
+			return err
+		}
+	} else if tlsClientCA != "" {
+		return errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	shutdownTracing, err := SetupTracing(otlpEndpoint)
+	if err != nil {
+		return errors.Wrap(err, "setup tracing")
+	}
+	// flush spans still buffered by the batcher on exit
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logWarnf("shutdown tracing: %v", err)
+		}
+	}()
+	SetUpstreamTimeouts(connectTimeout, tlsTimeout, headerTimeout)
+	if err := SetUpstreamResolver(resolveHosts, dohURL, dnsServer); err != nil {
+		return err
+	}
+	// before any upstream request, probes, resumes and jobs start below
+	if isProxyURL(proxy) {
+		SetUpstreamProxy(func() string {
+			return proxy
+		})
+	} else if proxy != "" {
+		SetUpstreamProxy(func() string {
+			output, err := exec.Command("bash", "-c", proxy).Output()
+			if err != nil {
+				logErrorf("command %s: %v", proxy, err)
+				return ""
+			} else {
+				return strings.TrimSpace(string(output))
+			}
+		})
+	}
+	if offline {
+		if syncFrom != "" {
+			return errors.New("-sync-from can not be used with -offline")
+		}
+		SetUpstreamOffline()
+	}
+	d := NewDownloadCache(dataDir)
+	d.Layout = layout
+	if d.TTL, err = parseDuration(ttl); err != nil {
+		return err
+	}
+	d.Presets = preset
+	if goProxy {
+		d.Presets += ",goproxy"
+	}
+	if configFile != "" {
+		if err := d.applyConfig(configFile); err != nil {
+			return err
+		}
+	} else if d.Rules, err = withPresets(d.Rules, d.Presets); err != nil {
+		return err
+	}
+	d.configFile = configFile
+	if err := checkPrivacyMode(ipPrivacy); err != nil {
+		return err
+	}
+	d.IPPrivacy = ipPrivacy
+	if auditLog != "" {
+		if d.auditLog, err = OpenAuditLog(auditLog); err != nil {
+			return err
+		}
+		d.auditLog.Record(AuditEntry{Action: "config", Client: "system", Detail: configDigest(fs, configFile)})
+	}
+	d.StaleWhileRevalidate = staleWhileRevalidate
+	d.Offline = offline
+	d.AccelRedirect = accelRedirect
+	d.Sendfile = sendfile
+	if redirectHits != "" {
+		d.RedirectHits = &RedirectHits{BaseURL: redirectHits, Secret: redirectSecret, TTL: redirectTTL}
+	}
+	d.IdleTimeout = idleTimeout
+	d.KeepTags = splitComma(keepTags)
+	d.Sidecars = splitComma(sidecars)
+	d.perIPLimiter.max = maxPerIP
+	d.apiKeys.Required = requireAPIKey
+	d.PrivateDashboard = privateDashboard
+	if oauth.ClientID != "" {
+		if oauth.ClientSecret == "" || oauth.Org == "" {
+			return errors.New("-oauth-client-id needs -oauth-client-secret and -oauth-org")
+		}
+		oauth.Admins = splitComma(oauthAdmins)
+		d.OAuth = &oauth
+		d.PrivateDashboard = true
+	}
+	d.breaker.threshold = breakerThreshold
+	d.breaker.cooldown = breakerCooldown
+	d.notifier.WebhookURL = notifyWebhook
+	d.notifier.FailThreshold = notifyThreshold
+	if eviction != "" {
+		if d.Eviction, err = ParseEvictionPolicy(eviction); err != nil {
+			return err
+		}
+	}
+	if d.MinFree, err = parseSize(minFree); err != nil {
+		return err
+	}
+	if d.CompressMinSize, err = parseSize(compressMinSize); err != nil {
+		return err
+	}
+	if d.negative.ttls, err = parseNegativeTTL(negativeTTL); err != nil {
+		return err
+	}
+	if d.MaxFileSize, err = parseSize(maxSize); err != nil {
+		return err
+	}
+	if d.DownloadSpeed, err = parseSize(downloadSpeed); err != nil {
+		return err
+	}
+	if d.OffPeak, err = ParseTimeWindows(offPeak); err != nil {
+		return err
+	}
+	d.refreshLimiter.interval = refreshInterval
+	d.VerifyChecksum = verifyChecksum
+	d.AdminToken = adminToken
+	d.BasePath = strings.TrimSuffix(basePath, "/")
+	if d.BasePath != "" && !strings.HasPrefix(d.BasePath, "/") {
+		d.BasePath = "/" + d.BasePath
+	}
+	if corsOrigins != "" {
+		d.CORS = NewCORS(corsOrigins)
+		d.CORS.AllowMethods = corsMethods
+		d.CORS.AllowHeaders = corsHeaders
+	}
+	if _, err := parseDuration(keep); err != nil {
+		return err
+	}
+	if stateDir == "" {
+		stateDir = dataDir
+	} else if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	d.stateDir = stateDir
+	if jobWorkers < 1 {
+		return errors.New("-job-workers must be at least 1")
+	}
+	if d.jobs, err = OpenJobQueue(filepath.Join(stateDir, "jobs.db"), d.jobHandlers()); err != nil {
+		return err
+	}
+	d.jobs.Workers = jobWorkers
+	if err := d.importRetryQueue(filepath.Join(stateDir, "retry.db")); err != nil {
+		return err
+	}
+	if d.usage, err = OpenUsageLog(filepath.Join(stateDir, "usage.db")); err != nil {
+		return err
+	}
+
+	if !offline {
+		go d.ProbeLoop(5 * time.Minute)
+	}
+	if lockRedis != "" {
+		lock, err := NewRedisLock(lockRedis)
+		if err != nil {
+			return err
+		}
+		d.sharedLock = lock
+	}
+	if clusterNodes != "" {
+		if d.cluster, err = NewCluster(clusterSelf, splitComma(clusterNodes), clusterRedirect); err != nil {
+			return err
+		}
+		d.cluster.TrustNodes()
+	}
+	if peers != "" && !offline {
+		d.peers = NewPeers(splitComma(peers), peerInterval)
+		d.peers.Start()
+	}
+	if replicateTo != "" {
+		d.replicator = NewReplicator(replicateTo, replicateToken)
+		go d.replicator.Run(d)
+	}
+	if statsdAddr != "" {
+		statsd := &StatsD{Addr: statsdAddr, Prefix: statsdPrefix, Tags: splitComma(statsdTags)}
+		go statsd.Loop(10 * time.Second)
+	}
+
+	tasks := map[string]func(){
+		"clean": func() { d.enqueue(JobClean, keep) },
+		"retry": d.jobs.Wake, // due jobs are dispatched by job queue, kept for compatibility
+		"usage": func() {
+			if err := d.usage.Flush(); err != nil {
+				logErrorf("usage log: %v", err)
+			}
+		},
+	}
+	defaults := map[string]string{
+		"clean": "@hourly",
+		"retry": "@every 1m",
+		"usage": "@every 1m",
+		"scrub": "@hourly",
+		"sync":  "@every " + syncInterval.String(),
+		"watch": "@every 30m",
+	}
+	if scrubFraction > 0 {
+		tasks["scrub"] = func() { d.enqueue(JobScrub, strconv.FormatFloat(scrubFraction, 'g', -1, 64)) }
+	}
+	if syncFrom != "" {
+		tasks["sync"] = func() { d.enqueue(JobSync, syncFrom) }
+	}
+	if !offline {
+		tasks["watch"] = func() { d.enqueue(JobWatch, "") } // watch list may be added in settings
+	}
+	for task, expr := range schedules {
+		if d.schedule == nil {
+			d.schedule = make(map[string]string)
+		}
+		d.schedule[task] = expr
+	}
+	if err := checkSchedule(d.schedule); err != nil {
+		return err
+	}
+	for task, run := range tasks {
+		expr := defaults[task]
+		if v, ok := d.schedule[task]; ok {
+			expr = v
+		}
+		if err := d.scheduler.Add(task, expr, run); err != nil {
+			return err
+		}
+	}
+	d.scheduler.warnDisabled(d.schedule)
+	d.RecoverPartial()
+	d.scheduler.Start()
+	d.jobs.Start()
+	d.enqueue(JobClean, keep)
+	if syncFrom != "" {
+		d.enqueue(JobSync, syncFrom)
+	}
+	if d.watcher != nil && !offline {
+		d.enqueue(JobWatch, "")
+	}
+
+	return ListenAndServe(splitComma(listenAddrs), d)
+}
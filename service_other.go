@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+func runService(args []string) error {
+	return errors.New("service command is only supported on windows, use systemd or supervisor instead")
+}
@@ -0,0 +1,163 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "github-mirror"
+
+// eventLogWriter send log output to windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	level, msg := logLevel(strings.TrimSpace(string(p)))
+	var err error
+	switch level {
+	case levelError:
+		err = w.elog.Error(1, msg)
+	case levelWarning:
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+type mirrorService struct {
+	args []string
+}
+
+func (s *mirrorService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- runServe(s.args)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errC:
+			logErrorf("serve exited: %v", err)
+			return true, 1
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				StopServe()
+				<-errC
+				return false, 0
+			}
+		}
+	}
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.Errorf("service %s already exists", serviceName)
+	}
+	// relative data dir would be resolved against C:\Windows\System32
+	for i, arg := range args {
+		if arg == "-d" && i+1 < len(args) && !filepath.IsAbs(args[i+1]) {
+			if args[i+1], err = filepath.Abs(args[i+1]); err != nil {
+				return err
+			}
+		}
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "GitHub Mirror",
+		Description: "Local cache of github release files",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return errors.Wrap(err, "install event log source")
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		s.Control(svc.Stop)
+		for i := 0; i < 10; i++ {
+			time.Sleep(time.Second)
+			if status, err = s.Query(); err != nil || status.State == svc.Stopped {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+func runAsService(args []string) error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	log.SetOutput(&eventLogWriter{elog})
+	log.SetFlags(log.Lshortfile)
+	return svc.Run(serviceName, &mirrorService{args: args})
+}
+
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: github-mirror service install|uninstall|run [serve flags]")
+	}
+	switch args[0] {
+	case "install":
+		if err := installService(args[1:]); err != nil {
+			return err
+		}
+		fmt.Println("service installed, start with: sc start", serviceName)
+		return nil
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		return runAsService(args[1:])
+	}
+	return errors.Errorf("unknown service command %s", args[0])
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// maxConfigSize limit body of PUT /_api/config
+const maxConfigSize = 1 << 20
+
+// handleAPIConfig GET return config file as is, PUT validate, save and apply a new config file.
+// rules, eviction, watch list and schedules are applied without restart
+func (d *DownloadCache) handleAPIConfig(w http.ResponseWriter, r *http.Request) {
+	if d.configFile == "" {
+		http.Error(w, "404 started without -config, settings can not be saved", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		data, err := ioutil.ReadFile(d.configFile)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(data)
+	case "PUT", "POST":
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.saveConfig(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"rules": len(d.rules()), "watch": len(d.watchList())})
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveConfig validate data, write it to config file and apply it, nothing is changed if invalid
+func (d *DownloadCache) saveConfig(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields() // catch typos of field names
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	lc, err := d.prepareConfig(cfg)
+	if err != nil {
+		return err
+	}
+	// the running config is changed only if the file is saved
+	tmp := filepath.Join(filepath.Dir(d.configFile), "."+filepath.Base(d.configFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.configFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d.applyLive(lc)
+	d.scheduler.warnDisabled(cfg.Schedule)
+	for task, expr := range cfg.Schedule {
+		if d.scheduler.Has(task) {
+			d.scheduler.Reschedule(task, expr) // expr is checked by prepareConfig
+		}
+	}
+	if d.currentWatcher() != nil && !d.Offline {
+		d.enqueue(JobWatch, "")
+	}
+	return nil
+}
+
+// handleSettings is the page to edit config file, admin token is sent by script from the page
+func (d *DownloadCache) handleSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, settingsPage)
+}
+
+const settingsPage = `<html><head><title>Settings</title></head><body><h2>Settings</h2>
+<p>Mirror rules, ttl and size limits of rules, eviction, watch list and schedules of the config file,
+see README for fields. Changes are validated, saved to the config file and applied without restart,
+except cache_dir which needs maintenance commands to move files.</p>
+<p>Admin token or key, not needed if logged in with github <input id="token" type="password" size="40"> <button onclick="load()">Load</button></p>
+<textarea id="config" rows="30" cols="120" spellcheck="false"></textarea>
+<p><button onclick="save()">Save and apply</button> <span id="status"></span></p>
+<script>
+function headers() {
+  var token = document.getElementById("token").value;
+  return token ? {"Authorization": "Bearer " + token} : {};
+}
+function status(text) { document.getElementById("status").textContent = text; }
+function load() {
+  fetch("../_api/config", {headers: headers()}).then(function(res) {
+    return res.text().then(function(text) {
+      if (!res.ok) throw new Error(text);
+      document.getElementById("config").value = text;
+      status("loaded");
+    });
+  }).catch(function(e) { status(e.message); });
+}
+function save() {
+  fetch("../_api/config", {method: "PUT", headers: headers(), body: document.getElementById("config").value}).then(function(res) {
+    return res.text().then(function(text) {
+      if (!res.ok) throw new Error(text);
+      var r = JSON.parse(text);
+      status("saved, " + r.rules + " rules, " + r.watch + " watched repos");
+    });
+  }).catch(function(e) { status(e.message); });
+}
+load();
+</script></body></html>`
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newSettingsCache(t *testing.T) *DownloadCache {
+	d := NewDownloadCache(t.TempDir())
+	d.configFile = filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(d.configFile, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.scheduler.Add("clean", "@hourly", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// scrub is not added without -scrub-fraction, its schedule is accepted as on startup
+func TestSaveConfigDisabledTask(t *testing.T) {
+	d := newSettingsCache(t)
+	if err := d.saveConfig([]byte(`{"schedule": {"clean": "0 3 * * *", "scrub": "0 4 * * *"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := d.scheduler.Tasks(); len(tasks) != 1 || tasks[0].Expr != "0 3 * * *" {
+		t.Errorf("tasks %+v, want clean rescheduled only", tasks)
+	}
+	if err := d.saveConfig([]byte(`{"schedule": {"compact": "0 3 * * *"}}`)); err == nil {
+		t.Error("unknown task is saved")
+	}
+}
+
+func TestSaveConfigWriteFailure(t *testing.T) {
+	d := newSettingsCache(t)
+	rules := d.rules()
+	d.configFile = filepath.Join(t.TempDir(), "missing", "config.json")
+	if err := d.saveConfig([]byte(`{"rules": [{"pattern": "^/", "upstream": "https://example.com/"}]}`)); err == nil {
+		t.Fatal("saved to missing dir")
+	}
+	if got := d.rules(); len(got) != len(rules) || &got[0] != &rules[0] {
+		t.Error("rules are applied although config file is not written")
+	}
+}
+
+// run with -race, requests match rules while settings replace them
+func TestSaveConfigWhileMatching(t *testing.T) {
+	d := newSettingsCache(t)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if d.matchRule("localhost", "/owner/repo/releases/download/v1/a") == nil {
+				t.Error("no rule matches")
+				return
+			}
+			d.currentWatcher()
+			d.eviction()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := d.saveConfig([]byte(`{"rules": [{"pattern": "^/", "upstream": "https://example.com/"}], "watch": [{"repo": "cli/cli"}]}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if rule := d.matchRule("localhost", "/a"); rule == nil || rule.URLPrefix != "https://example.com/" {
+		t.Errorf("rule %+v, want saved rule", rule)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shareSecret is the hmac key of share links, generated once and stored as <CacheDir>/share.key
+type shareSecret struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+func (d *DownloadCache) shareKey() ([]byte, error) {
+	d.share.once.Do(func() {
+		filename := filepath.Join(d.CacheDir, "share.key")
+		data, err := ioutil.ReadFile(filename)
+		if err == nil && len(data) > 0 {
+			d.share.key = data
+			return
+		}
+		if !os.IsNotExist(err) && err != nil {
+			d.share.err = err
+			return
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			d.share.err = err
+			return
+		}
+		d.share.key = []byte(hex.EncodeToString(key))
+		d.share.err = ioutil.WriteFile(filename, d.share.key, 0600)
+	})
+	return d.share.key, d.share.err
+}
+
+func shareSignature(key []byte, url string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(url + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handleAPISign create a link of cached file which can be downloaded without auth until expired
+// query: url=<upstream-url>, expires=1h
+func (d *DownloadCache) handleAPISign(w http.ResponseWriter, r *http.Request) {
+	rawurl := r.FormValue("url")
+	if !d.IsCached(rawurl) {
+		http.Error(w, "404 Not Found, url is not cached", 404)
+		return
+	}
+	ttl := time.Hour
+	if v := r.FormValue("expires"); v != "" {
+		var err error
+		if ttl, err = parseDuration(v); err != nil || ttl <= 0 {
+			http.Error(w, "invalid expires", http.StatusBadRequest)
+			return
+		}
+	}
+	key, err := d.shareKey()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{
+		"url":     {rawurl},
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {shareSignature(key, rawurl, expires)},
+	}
+	writeJSON(w, map[string]interface{}{
+		"url":     d.mirrorBaseURL(r) + "/_share?" + query.Encode(),
+		"expires": time.Unix(expires, 0),
+	})
+}
+
+// handleShare serve cached file of a signed link
+func (d *DownloadCache) handleShare(w http.ResponseWriter, r *http.Request) {
+	rawurl := r.FormValue("url")
+	expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		http.Error(w, "403 Forbidden, link expired", http.StatusForbidden)
+		return
+	}
+	key, err := d.shareKey()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sig := strings.ToLower(r.FormValue("sig"))
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(shareSignature(key, rawurl, expires))) != 1 {
+		http.Error(w, "403 Forbidden, invalid signature", http.StatusForbidden)
+		return
+	}
+	d.ServeFile(w, r, rawurl)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSidecars are suffixes of checksum and signature files published beside release assets
+const DefaultSidecars = ".sha256,.asc,.sig,.minisig"
+
+// fetchSidecars cache checksum and signature files of a newly cached release asset in background,
+// so verifying a cached binary never misses. most assets have no sidecars, 404 is not logged
+func (d *DownloadCache) fetchSidecars(url string) {
+	if len(d.Sidecars) == 0 || strings.Contains(url, "?") || !strings.Contains(url, "/releases/download/") {
+		return
+	}
+	for _, ext := range d.Sidecars {
+		if strings.HasSuffix(url, ext) {
+			return // sidecar itself
+		}
+	}
+	d.enqueue(JobSidecars, url)
+}
+
+// downloadSidecars cache missing sidecars of url
+func (d *DownloadCache) downloadSidecars(url string) {
+	for _, ext := range d.Sidecars {
+		sidecar := url + ext
+		if d.IsCached(sidecar) {
+			continue
+		}
+		_, err := d.DownloadAndWait(sidecar, path.Base(sidecar))
+		if ue, ok := errors.Cause(err).(*UpstreamError); ok && ue.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			logWarnf("sidecar %s: %v", sidecar, err)
+		}
+	}
+}
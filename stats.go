@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// repoOf return host/owner/repo of rawurl, eg github.com/openatx/atx-agent
+func repoOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "unknown"
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return u.Host + "/" + strings.Join(parts, "/")
+}
+
+type RepoStat struct {
+	Repo  string `json:"repo"`
+	Count int    `json:"count"`
+	Size  int64  `json:"size"`
+}
+
+type Stats struct {
+	Entries int        `json:"entries"`
+	Size    int64      `json:"size"`
+	Repos   []RepoStat `json:"repos"`
+	Oldest  *Meta      `json:"oldest,omitempty"`
+	Newest  *Meta      `json:"newest,omitempty"`
+	// HitRate is hits / requests since server started, -1 if unknown
+	HitRate float64 `json:"hit_rate"`
+}
+
+func (d *DownloadCache) Stats() (*Stats, error) {
+	entries, err := d.Entries()
+	if err != nil {
+		return nil, err
+	}
+	st := &Stats{HitRate: -1}
+	repos := make(map[string]*RepoStat)
+	for _, e := range entries {
+		st.Entries++
+		st.Size += e.Size
+		name := repoOf(e.URL)
+		rs, ok := repos[name]
+		if !ok {
+			rs = &RepoStat{Repo: name}
+			repos[name] = rs
+		}
+		rs.Count++
+		rs.Size += e.Size
+		if st.Oldest == nil || e.Time < st.Oldest.Time {
+			st.Oldest = e.Meta
+		}
+		if st.Newest == nil || e.Time > st.Newest.Time {
+			st.Newest = e.Meta
+		}
+	}
+	st.Repos = make([]RepoStat, 0, len(repos))
+	for _, rs := range repos {
+		st.Repos = append(st.Repos, *rs)
+	}
+	sort.Slice(st.Repos, func(i, j int) bool {
+		return st.Repos[i].Size > st.Repos[j].Size
+	})
+	return st, nil
+}
+
+// hitRate of requests served by this process
+func hitRate() float64 {
+	hits := metricCacheHit.Value() + metricCacheStale.Value()
+	total := hits + metricCacheMiss.Value() + metricCacheWait.Value()
+	if total == 0 {
+		return -1
+	}
+	return float64(hits) / float64(total)
+}
+
+func runStats(args []string) error {
+	var c cliFlags
+	fs := newCommandFlagSet("stats", "[--top N] [-d data | -server URL]")
+	c.register(fs)
+	top := fs.Int("top", 10, "Show top N repositories by size")
+	fs.Parse(args)
+	var st *Stats
+	if c.server != "" {
+		st = &Stats{}
+		if err := c.api("GET", "/_api/stats", nil, st); err != nil {
+			return err
+		}
+	} else {
+		d, err := c.cache()
+		if err != nil {
+			return err
+		}
+		if st, err = d.Stats(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Entries: %d\n", st.Entries)
+	fmt.Printf("Size:    %s\n", datasize.ByteSize(st.Size).HR())
+	if st.Oldest != nil {
+		fmt.Printf("Oldest:  %s %s\n", time.Unix(st.Oldest.Time, 0).Format("2006-01-02 15:04"), st.Oldest.URL)
+		fmt.Printf("Newest:  %s %s\n", time.Unix(st.Newest.Time, 0).Format("2006-01-02 15:04"), st.Newest.URL)
+	}
+	if st.HitRate >= 0 {
+		fmt.Printf("Hit rate: %.1f%%\n", st.HitRate*100)
+	} else if c.server == "" {
+		fmt.Println("Hit rate: unknown, use -server to get hit rate of running server")
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tFILES\tREPO")
+	for i, rs := range st.Repos {
+		if i >= *top {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", datasize.ByteSize(rs.Size).HR(), rs.Count, rs.Repo)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// gaugeMetrics are sent to statsd as gauges, other expvar ints are counters
+var gaugeMetrics = map[string]bool{
+	"scrub_last_run": true,
+}
+
+// StatsD push expvar int metrics to statsd (or DogStatsD with tags) over udp
+// counters are sent as delta since last push
+type StatsD struct {
+	Addr   string   // eg 127.0.0.1:8125
+	Prefix string   // eg github_mirror.
+	Tags   []string // DogStatsD tags, eg env:prod
+
+	last map[string]int64
+}
+
+func (s *StatsD) Loop(interval time.Duration) {
+	conn, err := net.Dial("udp", s.Addr)
+	if err != nil {
+		logWarnf("statsd: %v", err)
+		return
+	}
+	defer conn.Close()
+	s.last = make(map[string]int64)
+	for {
+		for _, packet := range s.packets() {
+			if _, err := conn.Write(packet); err != nil {
+				logWarnf("statsd: %v", err)
+				break
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// packets format metrics, one metric per line, packets are kept below 1432 bytes (udp over ethernet)
+func (s *StatsD) packets() [][]byte {
+	tags := ""
+	if len(s.Tags) > 0 {
+		tags = "|#" + strings.Join(s.Tags, ",")
+	}
+	var packets [][]byte
+	var buf bytes.Buffer
+	expvar.Do(func(kv expvar.KeyValue) {
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		value := v.Value()
+		var line string
+		if gaugeMetrics[kv.Key] {
+			line = fmt.Sprintf("%s%s:%d|g%s\n", s.Prefix, kv.Key, value, tags)
+		} else {
+			delta := value - s.last[kv.Key]
+			s.last[kv.Key] = value
+			if delta == 0 {
+				return
+			}
+			line = fmt.Sprintf("%s%s:%d|c%s\n", s.Prefix, kv.Key, delta, tags)
+		}
+		if buf.Len()+len(line) > 1432 {
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	})
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// handleSHA256Sums generate SHA256SUMS of cached files in a release (or any directory) from stored checksums,
+// in sha256sum format, so scripts can verify binaries without upstream
+// path: /_sha256sums/<mirror path of directory>, eg /_sha256sums/cli/cli/releases/download/v2.0.0/
+func (d *DownloadCache) handleSHA256Sums(w http.ResponseWriter, r *http.Request) {
+	dir := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/_sha256sums"), "SHA256SUMS")
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	rule := d.matchRule(r.Host, dir)
+	if rule == nil {
+		http.NotFound(w, r)
+		return
+	}
+	prefix := strings.TrimSuffix(rule.URLPrefix, "/") + dir
+	entries, err := d.Entries()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sums := make(map[string]string)
+	for _, e := range entries {
+		name := strings.TrimPrefix(e.URL, prefix)
+		if name == e.URL || name == "" || strings.ContainsAny(name, "/?") || e.SHA256 == "" {
+			continue
+		}
+		sums[name] = e.SHA256
+	}
+	if len(sums) == 0 {
+		http.Error(w, "no cached files in "+prefix, http.StatusNotFound)
+		return
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache") // changes when more assets are cached
+	for _, name := range names {
+		fmt.Fprintf(w, "%s  %s\n", sums[name], name)
+	}
+}
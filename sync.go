@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// peerClient is used to talk with other github-mirror instances
+var peerClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               nil,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// PeerToken is sent to and accepted from -peers and -sync-from, see requirePeer
+var PeerToken string
+
+func peerGet(ctx context.Context, rawurl string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if PeerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+PeerToken)
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.Errorf("peer %s: %s", rawurl, res.Status)
+	}
+	return res, nil
+}
+
+// SyncFrom copy entries missing in local cache from another github-mirror instance
+func (d *DownloadCache) SyncFrom(ctx context.Context, base string) (count int, err error) {
+	base = strings.TrimSuffix(base, "/")
+	res, err := peerGet(ctx, base+"/_api/cache")
+	if err != nil {
+		return 0, err
+	}
+	var entries []Meta
+	err = json.NewDecoder(res.Body).Decode(&entries)
+	res.Body.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "decode entries")
+	}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		if d.IsCached(e.URL) {
+			continue
+		}
+		if err := d.syncEntry(ctx, base, e); err != nil {
+			logWarnf("sync %s: %v", e.URL, err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (d *DownloadCache) syncEntry(ctx context.Context, base string, e Meta) error {
+	hash := d.entryHash(e.URL)
+	if !d.lockWorker(hash) {
+		return nil // downloading by someone else
+	}
+	res, err := peerGet(ctx, base+"/_api/cache/file?url="+url.QueryEscape(e.URL))
+	if err != nil {
+		d.unlockWorker(hash, err)
+		return err
+	}
+	defer res.Body.Close()
+	// keep etag, content type and tags of the entry, like storeFromPeer
+	m := &Meta{}
+	if v := res.Header.Get("X-Mirror-Meta"); v != "" {
+		if err := json.Unmarshal([]byte(v), m); err != nil {
+			err = errors.Wrap(err, "invalid X-Mirror-Meta")
+			d.unlockWorker(hash, err)
+			return err
+		}
+	}
+	m.URL, m.Filename, m.Hits = e.URL, e.Filename, 0
+	_, err = d.storeMeta(m, res.Body, nil, e.SHA256)
+	d.unlockWorker(hash, err)
+	return err
+}
+
+// syncJob sync from base, failures are retried by job queue
+func (d *DownloadCache) syncJob(base string) error {
+	if err := d.deferOffPeak("sync from " + base); err != nil {
+		return err
+	}
+	count, err := d.SyncFrom(context.Background(), base)
+	if err != nil {
+		return err
+	}
+	log.Printf("sync from %s: %d new entries", base, count)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// updateMeta modify meta.json of cached url
+func (d *DownloadCache) updateMeta(url string, update func(m *Meta)) (*Meta, error) {
+	dir := d.downloadDir(url)
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	m, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	update(m)
+	return m, writeMeta(dir, m)
+}
+
+// hasTag report if m has any of tags
+func (m *Meta) hasTag(tags ...string) bool {
+	for _, tag := range tags {
+		for _, t := range m.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keptByTag report if entry is exempt from eviction and clean by -keep-tags
+func (d *DownloadCache) keptByTag(m *Meta) bool {
+	return len(d.KeepTags) > 0 && m.hasTag(d.KeepTags...)
+}
+
+// handleAPITags attach tags and note to cached file
+// GET: count of entries by tag
+// PUT/POST: url=<upstream-url>, tag=<tag> (repeatable) are added, note=<text> replaces note if given
+// DELETE: url=<upstream-url>, tag=<tag> (repeatable) are removed, without tag all tags and note are removed
+func (d *DownloadCache) handleAPITags(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		entries, err := d.Entries()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		counts := make(map[string]int)
+		for _, e := range entries {
+			for _, tag := range e.Tags {
+				counts[tag]++
+			}
+		}
+		writeJSON(w, counts)
+		return
+	}
+	r.ParseForm()
+	url := r.Form.Get("url")
+	if url == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	var tags []string
+	for _, tag := range r.Form["tag"] {
+		for _, t := range strings.Split(tag, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	var update func(m *Meta)
+	switch r.Method {
+	case "PUT", "POST":
+		_, hasNote := r.Form["note"]
+		if len(tags) == 0 && !hasNote {
+			http.Error(w, "tag or note is required", http.StatusBadRequest)
+			return
+		}
+		update = func(m *Meta) {
+			for _, tag := range tags {
+				if !m.hasTag(tag) {
+					m.Tags = append(m.Tags, tag)
+				}
+			}
+			sort.Strings(m.Tags)
+			if hasNote {
+				m.Note = r.Form.Get("note")
+			}
+		}
+	case "DELETE":
+		update = func(m *Meta) {
+			if len(tags) == 0 {
+				m.Tags, m.Note = nil, ""
+				return
+			}
+			remove := make(map[string]bool)
+			for _, tag := range tags {
+				remove[tag] = true
+			}
+			kept := m.Tags[:0]
+			for _, t := range m.Tags {
+				if !remove[t] {
+					kept = append(kept, t)
+				}
+			}
+			m.Tags = kept
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := d.updateMeta(url, update)
+	if os.IsNotExist(err) {
+		http.Error(w, "url is not cached", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// filterEntriesByTag keep entries having tag, all entries if tag is empty
+func filterEntriesByTag(entries []Entry, tag string) []Entry {
+	if tag == "" {
+		return entries
+	}
+	filtered := entries[:0]
+	for _, e := range entries {
+		if e.hasTag(tag) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrIdleTimeout = errors.New("upstream idle timeout")
+
+// idleTimeoutReader close the underlying reader when no bytes received for timeout
+type idleTimeoutReader struct {
+	rd      io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	mu      sync.Mutex
+	expired bool
+}
+
+func newIdleTimeoutReader(rd io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{rd: rd, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.expired = true
+		r.mu.Unlock()
+		rd.Close()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && err != io.EOF {
+		r.mu.Lock()
+		if r.expired {
+			err = ErrIdleTimeout
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.rd.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ServerTLSConfig is used by ListenAndServe when not nil
+var ServerTLSConfig *tls.Config
+
+// NewServerTLSConfig load server certificate, clients must present a certificate signed by clientCA if set
+// clientAuth: require (reject clients without certificate) or optional
+func NewServerTLSConfig(certFile, keyFile, clientCA, clientAuth string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load tls certificate")
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA == "" {
+		return conf, nil
+	}
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificate found in %s", clientCA)
+	}
+	switch clientAuth {
+	case "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, errors.Errorf("invalid client auth %s, must be require or optional", strconv.Quote(clientAuth))
+	}
+	return conf, nil
+}
+
+// clientIdentity return CN of verified client certificate, or its first SAN if CN is empty
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// clientKey identify client for limits, certificate identity if any, otherwise ip
+func clientKey(r *http.Request) string {
+	if id := clientIdentity(r); id != "" {
+		return "cert:" + id
+	}
+	return clientIP(r)
+}
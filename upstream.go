@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var upstreamDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// upstreamTransport is shared by all upstream requests so connections can be reused
+var upstreamTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           upstreamDialer.DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   16,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+var upstreamClient = &http.Client{
+	Transport: upstreamTransport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	},
+}
+
+// SetUpstreamTimeouts configure timeouts used when connect to upstream
+func SetUpstreamTimeouts(connect, tlsHandshake, responseHeader time.Duration) {
+	upstreamDialer.Timeout = connect
+	upstreamTransport.TLSHandshakeTimeout = tlsHandshake
+	upstreamTransport.ResponseHeaderTimeout = responseHeader
+}
+
+// SetUpstreamProxy make every upstream request call getProxy to decide which proxy to use
+// supported schemes: http, https, socks5
+func SetUpstreamProxy(getProxy func() string) {
+	upstreamTransport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxy := getProxy()
+		if proxy == "" {
+			return nil, nil
+		}
+		if !isProxyURL(proxy) {
+			logErrorf("Invalid proxy %s, must startswith http://, https:// or socks5://", strconv.Quote(proxy))
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+}
+
+func isProxyURL(s string) bool {
+	for _, scheme := range []string{"http://", "https://", "socks5://"} {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamUserAgent and UpstreamHeaders are sent with every upstream request
+var (
+	UpstreamUserAgent = "github-mirror"
+	UpstreamHeaders   = http.Header{}
+)
+
+func newUpstreamRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range UpstreamHeaders {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if UpstreamUserAgent != "" {
+		req.Header.Set("User-Agent", UpstreamUserAgent)
+	}
+	injectTrace(ctx, req)
+	return req, nil
+}
+
+// headerFlag collect repeated -header "Name: value" flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return ""
+}
+
+func (h headerFlag) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return errors.Errorf("invalid header %s, must be \"Name: value\"", strconv.Quote(s))
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
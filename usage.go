@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usageBucket     = []byte("usage")
+	repoUsageBucket = []byte("repo_usage") // Client of ClientUsage is host/owner/repo
+)
+
+// ClientUsage is bytes and requests served to a client (ip, key:<name> or cert:<cn>)
+type ClientUsage struct {
+	Client   string `json:"client"`
+	Bytes    int64  `json:"bytes"`
+	Requests int64  `json:"requests"`
+}
+
+// UsageLog store daily usage of clients and repos in bbolt, key is <yyyy-mm-dd> \x00 <client>
+// counters are kept in memory and flushed periodically
+type UsageLog struct {
+	db      *bolt.DB
+	mu      sync.Mutex
+	pending map[usageKey]*ClientUsage
+}
+
+type usageKey struct {
+	bucket string
+	key    string
+}
+
+func OpenUsageLog(filename string) (*UsageLog, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "open usage log")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usageBucket, repoUsageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &UsageLog{db: db, pending: make(map[usageKey]*ClientUsage)}, nil
+}
+
+func (u *UsageLog) Close() error {
+	u.Flush()
+	return u.db.Close()
+}
+
+// Add count a request of client which received n bytes
+func (u *UsageLog) Add(client string, n int64) {
+	u.add(usageBucket, client, n)
+}
+
+// AddRepo count a download of repo, eg github.com/cli/cli, which sent n bytes
+func (u *UsageLog) AddRepo(repo string, n int64) {
+	u.add(repoUsageBucket, repo, n)
+}
+
+func (u *UsageLog) add(bucket []byte, client string, n int64) {
+	key := usageKey{bucket: string(bucket), key: time.Now().UTC().Format("2006-01-02") + "\x00" + client}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cu := u.pending[key]
+	if cu == nil {
+		cu = &ClientUsage{Client: client}
+		u.pending[key] = cu
+	}
+	cu.Bytes += n
+	cu.Requests++
+}
+
+// Flush write pending counters into db
+func (u *UsageLog) Flush() error {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[usageKey]*ClientUsage)
+	u.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return u.db.Update(func(tx *bolt.Tx) error {
+		for key, cu := range pending {
+			b := tx.Bucket([]byte(key.bucket))
+			var total ClientUsage
+			if data := b.Get([]byte(key.key)); data != nil {
+				json.Unmarshal(data, &total)
+			}
+			total.Client = cu.Client
+			total.Bytes += cu.Bytes
+			total.Requests += cu.Requests
+			data, _ := json.Marshal(total)
+			if err := b.Put([]byte(key.key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Report sum usage of clients in days starting with prefix, eg 2026, 2026-10, 2026-10-16
+// sorted by bytes desc
+func (u *UsageLog) Report(prefix string) ([]ClientUsage, error) {
+	return u.report(usageBucket, prefix)
+}
+
+// RepoReport sum downloads of repos in days starting with prefix, sorted by bytes desc
+func (u *UsageLog) RepoReport(prefix string) ([]ClientUsage, error) {
+	return u.report(repoUsageBucket, prefix)
+}
+
+func (u *UsageLog) report(bucket []byte, prefix string) ([]ClientUsage, error) {
+	if err := u.Flush(); err != nil {
+		return nil, err
+	}
+	totals := make(map[string]*ClientUsage)
+	err := u.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var cu ClientUsage
+			if json.Unmarshal(v, &cu) != nil {
+				continue
+			}
+			total := totals[cu.Client]
+			if total == nil {
+				total = &ClientUsage{Client: cu.Client}
+				totals[cu.Client] = total
+			}
+			total.Bytes += cu.Bytes
+			total.Requests += cu.Requests
+		}
+		return nil
+	})
+	report := make([]ClientUsage, 0, len(totals))
+	for _, cu := range totals {
+		report = append(report, *cu)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Bytes > report[j].Bytes })
+	return report, err
+}
+
+// usagePeriod convert period (day, month, year) and optional date to key prefix
+func usagePeriod(period, date string) (string, error) {
+	layouts := map[string]string{"day": "2006-01-02", "month": "2006-01", "year": "2006"}
+	layout, ok := layouts[period]
+	if !ok {
+		return "", errors.Errorf("invalid period %q, must be day, month or year", period)
+	}
+	if date == "" {
+		return time.Now().UTC().Format(layout), nil
+	}
+	t, err := time.Parse(layout, date)
+	if err != nil {
+		return "", errors.Errorf("invalid date %q of period %s, eg %s", date, period, layout)
+	}
+	return t.Format(layout), nil
+}
+
+// handleAPIUsage report bytes served per client
+// query: period=day|month|year (default month), date=2026-10 (default current)
+func (d *DownloadCache) handleAPIUsage(w http.ResponseWriter, r *http.Request) {
+	period := r.FormValue("period")
+	if period == "" {
+		period = "month"
+	}
+	prefix, err := usagePeriod(period, r.FormValue("date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := []ClientUsage{}
+	if d.usage != nil {
+		if report, err = d.usage.Report(prefix); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	writeJSON(w, map[string]interface{}{"period": prefix, "clients": report})
+}
+
+// usageHTML render top clients of this month for dashboard
+func (d *DownloadCache) usageHTML() string {
+	if d.usage == nil {
+		return ""
+	}
+	prefix, _ := usagePeriod("month", "")
+	report, err := d.usage.Report(prefix)
+	if err != nil || len(report) == 0 {
+		return ""
+	}
+	output := "<h3>Usage " + prefix + "</h3><table><tr><th>Client</th><th>Requests</th><th>Bytes</th></tr>"
+	for i, cu := range report {
+		if i >= 20 {
+			break
+		}
+		output += fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%s</td></tr>",
+			html.EscapeString(cu.Client), cu.Requests, datasize.ByteSize(cu.Bytes).HR())
+	}
+	return output + "</table>"
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+var ErrCorrupt = errors.New("cache corrupt")
+
+// verifyEntry compare cached.file with meta.json
+// size is always checked, sha256 only when checksum is true
+func verifyEntry(dir string, checksum bool) (*Meta, error) {
+	m, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, "cached.file"))
+	if err != nil {
+		return m, errors.Wrap(ErrCorrupt, err.Error())
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return m, err
+	}
+	if fi.Size() != m.Size {
+		return m, errors.Wrapf(ErrCorrupt, "size %d, expect %d", fi.Size(), m.Size)
+	}
+	if m.ContentLength > 0 && m.Size != m.ContentLength {
+		return m, errors.Wrapf(ErrCorrupt, "truncated, size %d, upstream content length %d", m.Size, m.ContentLength)
+	}
+	if !checksum || m.SHA256 == "" {
+		return m, nil
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return m, err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != m.SHA256 {
+		return m, errors.Wrapf(ErrCorrupt, "sha256 %s, expect %s", sum, m.SHA256)
+	}
+	return m, nil
+}
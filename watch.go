@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WatchConfig is a repo whose new releases are cached automatically, eg
+//
+//	{"repo": "cli/cli", "assets": ["*_linux_amd64.tar.gz", "*_checksums.txt"], "releases": 2}
+type WatchConfig struct {
+	Repo       string   `json:"repo"`       // owner/repo
+	Assets     []string `json:"assets"`     // glob patterns of asset names, empty for all assets
+	Releases   int      `json:"releases"`   // number of latest releases kept warm, default 1
+	Prerelease bool     `json:"prerelease"` // include prereleases
+}
+
+// WatchStatus is result of the last check of a watched repo
+type WatchStatus struct {
+	WatchConfig
+	LastCheck  time.Time `json:"last_check"`
+	Tags       []string  `json:"tags"`   // releases checked
+	Queued     int       `json:"queued"` // assets not cached yet, downloaded in background
+	Error      string    `json:"error,omitempty"`
+	lastQueued map[string]bool
+}
+
+// Watcher poll releases of watched repos on "watch" schedule and cache new assets
+type Watcher struct {
+	mu    sync.Mutex
+	repos []*WatchStatus
+}
+
+func NewWatcher(configs []WatchConfig) (*Watcher, error) {
+	w := &Watcher{}
+	for _, c := range configs {
+		if strings.Count(c.Repo, "/") != 1 {
+			return nil, errors.Errorf("watch repo %s, must be owner/repo", c.Repo)
+		}
+		for _, pattern := range c.Assets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Errorf("watch %s: invalid asset pattern %s", c.Repo, pattern)
+			}
+		}
+		if c.Releases <= 0 {
+			c.Releases = 1
+		}
+		w.repos = append(w.repos, &WatchStatus{WatchConfig: c})
+	}
+	return w, nil
+}
+
+// matchAsset report if asset name matches any pattern, no patterns match all
+func (c *WatchConfig) matchAsset(name string) bool {
+	if len(c.Assets) == 0 {
+		return true
+	}
+	for _, pattern := range c.Assets {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWatched list releases of watched repos and download assets missing in cache,
+// downloads are download jobs, so they wait for -off-peak and failures are retried
+func (d *DownloadCache) checkWatched() {
+	watcher := d.currentWatcher()
+	if watcher == nil {
+		return
+	}
+	watcher.mu.Lock()
+	repos := append([]*WatchStatus(nil), watcher.repos...)
+	watcher.mu.Unlock()
+	for _, ws := range repos {
+		urls, tags, err := d.watchedAssets(&ws.WatchConfig)
+		queued := 0
+		for _, url := range urls {
+			if d.IsCached(url) {
+				continue
+			}
+			queued++
+			if ws.lastQueued[url] {
+				continue // download job queued
+			}
+			log.Printf("watch %s: cache %s", ws.Repo, url)
+			d.enqueue(JobDownload, url)
+		}
+		watcher.mu.Lock()
+		ws.LastCheck, ws.Tags, ws.Queued, ws.Error = time.Now(), tags, queued, ""
+		if err != nil {
+			ws.Error = err.Error()
+			logWarnf("watch %s: %v", ws.Repo, err)
+		}
+		ws.lastQueued = make(map[string]bool)
+		for _, url := range urls {
+			ws.lastQueued[url] = !d.IsCached(url)
+		}
+		watcher.mu.Unlock()
+	}
+}
+
+// watchedAssets return download urls of matching assets in latest releases of c
+func (d *DownloadCache) watchedAssets(c *WatchConfig) (urls, tags []string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	releases, err := listReleases(ctx, c.Repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, release := range releases {
+		if len(tags) >= c.Releases {
+			break
+		}
+		if release.Prerelease && !c.Prerelease {
+			continue
+		}
+		tags = append(tags, release.TagName)
+		for _, asset := range release.Assets {
+			if c.matchAsset(asset.Name) {
+				urls = append(urls, asset.BrowserDownloadURL)
+			}
+		}
+	}
+	return urls, tags, nil
+}
+
+// handleAPIWatch list watched repos with result of last check
+func (d *DownloadCache) handleAPIWatch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.watchList())
+}
+
+// watchList return copy of watched repos with their status
+func (d *DownloadCache) watchList() []WatchStatus {
+	statuses := make([]WatchStatus, 0)
+	if watcher := d.currentWatcher(); watcher != nil {
+		watcher.mu.Lock()
+		for _, ws := range watcher.repos {
+			statuses = append(statuses, *ws)
+		}
+		watcher.mu.Unlock()
+	}
+	return statuses
+}